@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// authorizeAdmin checks r for the admin bearer token. Admin endpoints are
+// disabled unless a token is configured.
+func (h *handler) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if h.cfg.AdminToken == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// runtimeConfig is the part of the configuration that PATCH /admin/config
+// can change. Durations are in time.ParseDuration format.
+type runtimeConfig struct {
+	MaxBundleBytes   *int64  `json:"maxBundleBytes,omitempty"`
+	RevalidateAfter  *string `json:"revalidateAfter,omitempty"`
+	NegativeCacheTTL *string `json:"negativeCacheTTL,omitempty"`
+	// ReadOnlyMode turns read-only mode, which refuses new builds, on or
+	// off.
+	ReadOnlyMode *bool `json:"readOnlyMode,omitempty"`
+}
+
+// serveAdminConfig reports the effective configuration on GET and changes
+// the runtime tunable settings on PATCH. Everything else needs a restart
+// to change and is reported as read-only.
+func (h *handler) serveAdminConfig(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var patch runtimeConfig
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&patch); err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, fmt.Sprintf("Request body is limited to %d bytes", maxErr.Limit), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Invalid config patch, only maxBundleBytes, revalidateAfter, negativeCacheTTL and readOnlyMode can be changed: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var revalidateAfter, negativeTTL time.Duration
+		var err error
+		if patch.RevalidateAfter != nil {
+			if revalidateAfter, err = time.ParseDuration(*patch.RevalidateAfter); err != nil {
+				http.Error(w, "Invalid revalidateAfter: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if patch.NegativeCacheTTL != nil {
+			if negativeTTL, err = time.ParseDuration(*patch.NegativeCacheTTL); err != nil {
+				http.Error(w, "Invalid negativeCacheTTL: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		// Apply only once everything is known to be valid
+		if patch.MaxBundleBytes != nil {
+			h.maxBundleBytes.Store(*patch.MaxBundleBytes)
+		}
+		if patch.RevalidateAfter != nil {
+			h.revalidateAfter.Store(int64(revalidateAfter))
+		}
+		if patch.NegativeCacheTTL != nil {
+			h.negCache.setTTL(negativeTTL)
+		}
+		if patch.ReadOnlyMode != nil {
+			h.readOnly.Store(*patch.ReadOnlyMode)
+		}
+		logger(r.Context()).Info("runtime config changed",
+			"max_bundle_bytes", h.maxBundleBytes.Load(),
+			"revalidate_after", time.Duration(h.revalidateAfter.Load()),
+			"negative_cache_ttl", h.negCache.getTTL(),
+			"read_only", h.readOnly.Load())
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	readOnly := map[string]any{
+		"cacheDir":                 h.cfg.CacheDir,
+		"cacheBackend":             cacheBackendName(h.cache),
+		"cacheShardDepth":          h.cfg.CacheShardDepth,
+		"projectRoot":              h.cfg.ProjectRoot,
+		"templates":                slices.Sorted(maps.Keys(h.cfg.Templates)),
+		"trustProxy":               h.cfg.TrustProxy,
+		"userAgent":                h.cfg.UserAgent,
+		"forwardHeaders":           h.cfg.ForwardHeaders,
+		"ignoredQueryParams":       h.cfg.IgnoredQueryParams,
+		"forwardQuery":             h.cfg.ForwardQuery,
+		"forwardQueryParams":       h.cfg.ForwardQueryParams,
+		"pins":                     h.cfg.Pins,
+		"contentAddressedRedirect": h.cfg.ContentAddressedRedirect,
+		"compressCache":            h.cfg.CompressCache,
+		"compressResponses":        h.cfg.CompressResponses,
+		"gzipLevel":                h.cfg.CompressionLevels.gzip,
+		"brotliLevel":              h.cfg.CompressionLevels.brotli,
+		"allowedSchemes":           h.cfg.AllowedSchemes,
+		"refreshTop":               h.cfg.RefreshTop,
+		"refreshInterval":          h.cfg.RefreshInterval.String(),
+		"refreshMaxAge":            h.cfg.RefreshMaxAge.String(),
+		"depcheckExitCodes":        h.cfg.DepcheckExitCodes,
+		"buildOptionsHeader":       h.cfg.BuildOptionsHeader,
+		"sriHeader":                h.cfg.SRIHeader,
+		"verifyBundles":            h.cfg.VerifyBundles,
+		"fetchTimeout":             h.cfg.FetchTimeout.String(),
+		"watchInterval":            h.cfg.WatchInterval.String(),
+		"watchTimeout":             h.cfg.WatchTimeout.String(),
+		"contentKeyHosts":          h.cfg.ContentKeyHosts,
+		"installMode":              h.cfg.InstallMode,
+		"lenientInstall":           h.cfg.LenientInstall,
+		"denyPackages":             h.cfg.DenyPackages,
+		"maxBodyBytes":             h.cfg.MaxBodyBytes,
+		"serveLastGood":            h.cfg.ServeLastGood,
+		"maxConcurrentFetches":     h.cfg.MaxConcurrentFetches,
+		"envDefines":               slices.Sorted(maps.Keys(h.cfg.EnvDefines)),
+		"etagHash":                 h.cfg.ETagHash,
+		"weakCompressedETags":      h.cfg.WeakCompressedETags,
+	}
+	for name, v := range h.cfg.ServerSettings {
+		readOnly[name] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"runtime": map[string]any{
+			"maxBundleBytes":   h.maxBundleBytes.Load(),
+			"revalidateAfter":  time.Duration(h.revalidateAfter.Load()).String(),
+			"negativeCacheTTL": h.negCache.getTTL().String(),
+			"readOnlyMode":     h.readOnly.Load(),
+		},
+		"readOnly": readOnly,
+	})
+}
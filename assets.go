@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Files emitted by loaders like file and copy are cached as
+// <hash>.asset.<name> and served from /_a/<hash>/<name>. Bundles reference
+// them through esbuild's public path, which is pointed at that route.
+// Chunks produced with ?splitting=true are stored the same way and served
+// from /chunks/<hash>/<name>, along with the assets of that build.
+
+// assetNamePattern matches the names of emitted asset files. Names are
+// chosen by esbuild from the imported file's name and the assetNames
+// template, so anything unusual is refused rather than escaped.
+var assetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+
+// assetPublicPath returns the public path the assets of the cache entry
+// hash are referenced by. Without a configured publicPath it is relative
+// to the root of this service, which only resolves for pages served from
+// the same origin.
+func (h *handler) assetPublicPath(hash string) string {
+	return strings.TrimSuffix(h.cfg.BuildOptions.PublicPath, "/") + "/_a/" + hash + "/"
+}
+
+// chunkPublicPath is assetPublicPath for builds split into chunks.
+func (h *handler) chunkPublicPath(hash string) string {
+	return strings.TrimSuffix(h.cfg.BuildOptions.PublicPath, "/") + "/chunks/" + hash + "/"
+}
+
+// assetCacheName returns the cache file name of the emitted file at path
+// for the cache entry hash.
+func assetCacheName(hash, path string) (string, error) {
+	name := filepath.Base(path)
+	if !assetNamePattern.MatchString(name) {
+		return "", fmt.Errorf("build emitted an asset with an unsupported name %q", name)
+	}
+	return hash + ".asset." + name, nil
+}
+
+var assetRoutePattern = regexp.MustCompile(`^/(?:_a|chunks)/([0-9a-f]{20})/([^/]+)$`)
+
+// serveAsset serves a file emitted by the build of a cached bundle, or one
+// of its chunks.
+func (h *handler) serveAsset(w http.ResponseWriter, r *http.Request) {
+	m := assetRoutePattern.FindStringSubmatch(r.URL.Path)
+	if m == nil || !assetNamePattern.MatchString(m[2]) {
+		http.Error(w, "Invalid asset path", http.StatusBadRequest)
+		return
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(m[2]))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if !h.serveCached(w, r, m[1]+".asset."+m[2], contentType, h.sidecarCacheControl()) {
+		http.NotFound(w, r)
+	}
+}
+
+var mapRoutePattern = regexp.MustCompile(`^/_map/([0-9a-f]{20})\.(js|css)\.map$`)
+
+// serveSourceMap serves the linked or external sourcemap of a cached
+// bundle or its stylesheet.
+func (h *handler) serveSourceMap(w http.ResponseWriter, r *http.Request) {
+	m := mapRoutePattern.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		http.Error(w, "Invalid sourcemap path", http.StatusBadRequest)
+		return
+	}
+	if !h.serveCached(w, r, m[1]+"."+m[2]+".map", "application/json", h.sidecarCacheControl()) {
+		http.NotFound(w, r)
+	}
+}
+
+var cssSourceMappingURLPattern = regexp.MustCompile(`/\*# sourceMappingURL=[^*]*\*/`)
+
+// linkSourceMap points the sourceMappingURL comment of a bundle (ext "js")
+// or its stylesheet (ext "css") at the /_map/ route. esbuild writes it
+// relative to the output file, which would resolve against the bundle's
+// URL instead.
+func (h *handler) linkSourceMap(contents []byte, hash, ext string) []byte {
+	url := strings.TrimSuffix(h.cfg.BuildOptions.PublicPath, "/") + "/_map/" + hash + "." + ext + ".map"
+	if ext == "css" {
+		return cssSourceMappingURLPattern.ReplaceAllLiteral(contents, []byte("/*# sourceMappingURL="+url+" */"))
+	}
+	return sourceMappingURLPattern.ReplaceAllLiteral(contents, []byte("//# sourceMappingURL="+url+"\n"))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned for fetches to a host whose breaker is open.
+type errCircuitOpen struct {
+	host  string
+	retry time.Duration
+}
+
+func (e *errCircuitOpen) Error() string {
+	return fmt.Sprintf("upstream %s is failing, not retrying for %s", e.host, e.retry.Round(time.Second))
+}
+
+// circuitBreaker stops fetching from hosts that keep failing. After
+// threshold consecutive failures a host's breaker opens and fetches fail
+// immediately for cooldown. Then a single probe is let through: success
+// closes the breaker, failure opens it again. A zero threshold disables it.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	hosts     map[string]*hostBreaker
+}
+
+type hostBreaker struct {
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// Breaker states, as reported by /metrics.
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, hosts: map[string]*hostBreaker{}}
+}
+
+// allow reports whether a fetch from host may go ahead.
+func (b *circuitBreaker) allow(host string) error {
+	if b.threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	hb := b.hosts[host]
+	if hb == nil || hb.openedAt.IsZero() {
+		return nil
+	}
+	if wait := b.cooldown - time.Since(hb.openedAt); wait > 0 || hb.probing {
+		return &errCircuitOpen{host: host, retry: max(wait, 0)}
+	}
+	hb.probing = true
+	return nil
+}
+
+// record updates host's breaker with the outcome of a fetch.
+func (b *circuitBreaker) record(host string, failed bool) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		delete(b.hosts, host)
+		return
+	}
+	hb := b.hosts[host]
+	if hb == nil {
+		hb = &hostBreaker{}
+		b.hosts[host] = hb
+	}
+	hb.failures++
+	if hb.probing || hb.failures >= b.threshold {
+		hb.openedAt = time.Now()
+		hb.probing = false
+	}
+}
+
+// writeMetrics writes the state of every failing host's breaker.
+func (b *circuitBreaker) writeMetrics(w io.Writer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fmt.Fprintln(w, "# HELP upstream_breaker_state Circuit breaker state per upstream host: 0 closed, 1 open, 2 half-open.")
+	fmt.Fprintln(w, "# TYPE upstream_breaker_state gauge")
+	for _, host := range slices.Sorted(maps.Keys(b.hosts)) {
+		hb := b.hosts[host]
+		state := breakerClosed
+		switch {
+		case hb.probing:
+			state = breakerHalfOpen
+		case !hb.openedAt.IsZero():
+			state = breakerOpen
+		}
+		fmt.Fprintf(w, "upstream_breaker_state{host=%q} %d\n", host, state)
+	}
+	fmt.Fprintln(w, "# HELP upstream_breaker_failures Consecutive failed fetches per upstream host.")
+	fmt.Fprintln(w, "# TYPE upstream_breaker_failures gauge")
+	for _, host := range slices.Sorted(maps.Keys(b.hosts)) {
+		fmt.Fprintf(w, "upstream_breaker_failures{host=%q} %d\n", host, b.hosts[host].failures)
+	}
+}
+
+// doHost sends an upstream request through the circuit breaker. Transport
+// errors and 5xx responses count as failures of the host.
+func (h *handler) doHost(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if err := h.breaker.allow(host); err != nil {
+		return nil, err
+	}
+	resp, err := h.client.Do(req)
+	h.breaker.record(host, err != nil || resp.StatusCode >= 500)
+	return resp, err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// buildHint explains a kind of esbuild message to people who don't know
+// esbuild, with what usually causes it.
+type buildHint struct {
+	pattern *regexp.Regexp
+	// explain returns the hint for a message matching pattern, given the
+	// submatches.
+	explain func(m []string) string
+}
+
+var buildHints = []buildHint{
+	{
+		pattern: regexp.MustCompile(`^Could not resolve "([^"]*)"`),
+		explain: func(m []string) string {
+			switch spec := m[1]; {
+			case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+				return fmt.Sprintf("The URL %s couldn't be fetched. Check that it exists and is allowed by this server.", spec)
+			case strings.HasPrefix(spec, ".") || strings.HasPrefix(spec, "/"):
+				return fmt.Sprintf("The file %s wasn't found next to the source. Relative imports are fetched from the source's host, check that it serves them at that path.", spec)
+			default:
+				return fmt.Sprintf("The package %q isn't installed. Check its name, or keep it out of the bundle with ?external=%s.", packageName(spec), packageName(spec))
+			}
+		},
+	},
+	{
+		pattern: regexp.MustCompile(`^fetching (\S+): upstream returned (\d+)`),
+		explain: func(m []string) string {
+			return fmt.Sprintf("The imported URL %s answered with a %s. Check that it exists and that its host serves it to this server.", m[1], m[2])
+		},
+	},
+	{
+		pattern: regexp.MustCompile(`^No matching export in "[^"]*" for import "([^"]*)"|^Import "([^"]*)" will always be undefined`),
+		explain: func(m []string) string {
+			return "A module imports a name another doesn't export. Usually the name is misspelled, a CommonJS module is imported as ESM, or modules import each other in a cycle."
+		},
+	},
+	{
+		pattern: regexp.MustCompile(`^(Expected .* but found|Unexpected|Unterminated|The character .* is not valid|Syntax error)`),
+		explain: func(m []string) string {
+			return "The source doesn't parse. Check that the URL serves the source rather than an error page, and if it's TypeScript or JSX served under another extension, pick the loader with ?loader=ts or ?loader=tsx."
+		},
+	},
+	{
+		pattern: regexp.MustCompile(`to the configured target environment .* is not supported`),
+		explain: func(m []string) string {
+			return "The source uses syntax that can't be lowered to the requested target. Ask for a newer one, like ?target=es2020."
+		},
+	},
+	{
+		pattern: regexp.MustCompile(`^No loader is configured for "(\.[^"]*)" files`),
+		explain: func(m []string) string {
+			return fmt.Sprintf("The source imports a %s file, which esbuild doesn't know how to bundle. Pick a loader for it, like ?loader=%s=file or ?loader=%s=dataurl, or set one in the config file's loader map.", m[1], m[1], m[1])
+		},
+	},
+	{
+		pattern: regexp.MustCompile(`^Top-level await is currently not supported with the "(\w+)" output format`),
+		explain: func(m []string) string {
+			return fmt.Sprintf("Top-level await only works in ES modules, not with format=%s.", m[1])
+		},
+	},
+}
+
+// explainMessages returns human-friendly explanations of the esbuild
+// errors and warnings in msgs, one per line, to go before the raw
+// messages. It is empty when none of them are recognized.
+func explainMessages(msgs ...[]api.Message) string {
+	var hints []string
+	for _, m := range slices.Concat(msgs...) {
+		for _, hint := range buildHints {
+			if sub := hint.pattern.FindStringSubmatch(m.Text); sub != nil {
+				if text := hint.explain(sub); !slices.Contains(hints, text) {
+					hints = append(hints, text)
+				}
+				break
+			}
+		}
+	}
+	if len(hints) == 0 {
+		return ""
+	}
+	return "Hint: " + strings.Join(hints, "\nHint: ") + "\n\n"
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"maps"
+	"path/filepath"
+	"slices"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// buildOptionsSummary is the part of the api.BuildOptions a bundle was
+// built with that decides its output, after the config file and query
+// params are applied. Paths into the build directory are relative to it,
+// and banners and the tsconfig are only flagged, to keep it compact.
+type buildOptionsSummary struct {
+	EntryPoints       []string          `json:"entryPoints"`
+	Bundle            bool              `json:"bundle"`
+	Splitting         bool              `json:"splitting,omitempty"`
+	Target            string            `json:"target,omitempty"`
+	Engines           []string          `json:"engines,omitempty"`
+	Format            string            `json:"format,omitempty"`
+	Platform          string            `json:"platform,omitempty"`
+	GlobalName        string            `json:"globalName,omitempty"`
+	Sourcemap         string            `json:"sourcemap,omitempty"`
+	MinifyWhitespace  bool              `json:"minifyWhitespace,omitempty"`
+	MinifyIdentifiers bool              `json:"minifyIdentifiers,omitempty"`
+	MinifySyntax      bool              `json:"minifySyntax,omitempty"`
+	KeepNames         bool              `json:"keepNames,omitempty"`
+	Charset           string            `json:"charset,omitempty"`
+	LegalComments     string            `json:"legalComments,omitempty"`
+	Drop              []string          `json:"drop,omitempty"`
+	Pure              []string          `json:"pure,omitempty"`
+	Define            map[string]string `json:"define,omitempty"`
+	Loader            map[string]string `json:"loader,omitempty"`
+	External          []string          `json:"external,omitempty"`
+	Alias             map[string]string `json:"alias,omitempty"`
+	Conditions        []string          `json:"conditions,omitempty"`
+	Inject            []string          `json:"inject,omitempty"`
+	NodePaths         []string          `json:"nodePaths,omitempty"`
+	PublicPath        string            `json:"publicPath,omitempty"`
+	Banner            bool              `json:"banner,omitempty"`
+	Footer            bool              `json:"footer,omitempty"`
+	Tsconfig          bool              `json:"tsconfig,omitempty"`
+}
+
+// summarizeBuildOptions describes the options passed to api.Build.
+func summarizeBuildOptions(opts api.BuildOptions) buildOptionsSummary {
+	rel := func(paths []string) []string {
+		var out []string
+		for _, p := range paths {
+			if r, err := filepath.Rel(opts.AbsWorkingDir, p); err == nil {
+				p = r
+			}
+			out = append(out, p)
+		}
+		return out
+	}
+	s := buildOptionsSummary{
+		EntryPoints:       rel(opts.EntryPoints),
+		Bundle:            opts.Bundle,
+		Splitting:         opts.Splitting,
+		Target:            enumName(esTargets, opts.Target),
+		Engines:           engineSpecs(opts.Engines),
+		Format:            enumName(formats, opts.Format),
+		Platform:          enumName(platforms, opts.Platform),
+		GlobalName:        opts.GlobalName,
+		Sourcemap:         enumName(sourceMapModes, opts.Sourcemap),
+		MinifyWhitespace:  opts.MinifyWhitespace,
+		MinifyIdentifiers: opts.MinifyIdentifiers,
+		MinifySyntax:      opts.MinifySyntax,
+		KeepNames:         opts.KeepNames,
+		Charset:           enumName(charsets, opts.Charset),
+		LegalComments:     enumName(legalCommentModes, opts.LegalComments),
+		Pure:              opts.Pure,
+		Define:            opts.Define,
+		External:          opts.External,
+		Alias:             opts.Alias,
+		Conditions:        opts.Conditions,
+		Inject:            rel(opts.Inject),
+		NodePaths:         opts.NodePaths,
+		PublicPath:        opts.PublicPath,
+		Banner:            len(opts.Banner) > 0,
+		Footer:            len(opts.Footer) > 0,
+		Tsconfig:          opts.TsconfigRaw != "",
+	}
+	for _, name := range slices.Sorted(maps.Keys(dropModes)) {
+		if opts.Drop&dropModes[name] != 0 {
+			s.Drop = append(s.Drop, name)
+		}
+	}
+	if len(opts.Loader) > 0 {
+		s.Loader = map[string]string{}
+		for ext, loader := range opts.Loader {
+			s.Loader[ext] = enumName(loaders, loader)
+		}
+	}
+	return s
+}
+
+// engineSpecs returns engines as ?engines= names them, like chrome100.
+func engineSpecs(engines []api.Engine) []string {
+	var specs []string
+	for _, e := range engines {
+		specs = append(specs, enumName(engineNames, e.Name)+e.Version)
+	}
+	return specs
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// entryOutputPath returns the absolute path of the JavaScript esbuild
+// built from entryPoint, as recorded in the metafile of a build run in
+// workDir. It is empty if the metafile doesn't name one, and the path the
+// options imply is used instead.
+func entryOutputPath(metafile, workDir, entryPoint string) string {
+	var meta struct {
+		Outputs map[string]struct {
+			EntryPoint string `json:"entryPoint"`
+		} `json:"outputs"`
+	}
+	if err := json.Unmarshal([]byte(metafile), &meta); err != nil {
+		return ""
+	}
+	entry, err := filepath.Rel(workDir, entryPoint)
+	if err != nil {
+		return ""
+	}
+	for path, out := range meta.Outputs {
+		if filepath.FromSlash(out.EntryPoint) == entry && isJSOutput(path) {
+			return filepath.Join(workDir, filepath.FromSlash(path))
+		}
+	}
+	return ""
+}
+
+func isJSOutput(path string) bool {
+	switch filepath.Ext(path) {
+	case ".js", ".mjs", ".cjs":
+		return true
+	}
+	return false
+}
+
+// missingOutputError explains a build that reported no errors but left no
+// bundle at bundlePath, listing what it did write.
+func missingOutputError(workDir, bundlePath string, outputs []api.OutputFile) *buildError {
+	var wrote []string
+	for _, out := range outputs {
+		if rel, err := filepath.Rel(workDir, out.Path); err == nil {
+			wrote = append(wrote, filepath.ToSlash(rel))
+		} else {
+			wrote = append(wrote, out.Path)
+		}
+	}
+	msg := "Build succeeded but produced no JavaScript for the source"
+	if len(wrote) == 0 {
+		msg += ", nor any other output"
+	} else {
+		msg += ", only " + strings.Join(wrote, ", ")
+	}
+	return newBuildError(kindBuild, msg, fmt.Errorf("%s missing from build outputs", filepath.Base(bundlePath)))
+}
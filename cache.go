@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	// Flush to disk before the rename so a crash can't leave an empty file
+	// under the final name
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// removeStaleTempFiles deletes temporary files left in dir and its
+// subdirectories by writes that were interrupted by a crash. It returns how
+// many were removed.
+func removeStaleTempFiles(dir string) (int, error) {
+	n := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if ok, _ := filepath.Match("*.tmp-*", d.Name()); !ok {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// cacheEntryPattern matches the file names of cached bundles, as opposed to
+// their sidecar files.
+var cacheEntryPattern = regexp.MustCompile(`^[0-9a-f]{20}$`)
+
+// cacheFilePattern matches the names of cache entries and their sidecar
+// files.
+var cacheFilePattern = regexp.MustCompile(`^[0-9a-f]{20}(\.css|\.json|\.legal\.txt|\.meta\.json|\.manifest\.json|\.analysis\.txt|\.upstream\.json|\.lastgood|\.d\.ts|\.sri|\.(js|css)\.map|\.asset\.[A-Za-z0-9_][A-Za-z0-9._-]*?)?(\.br|\.gz)?$`)
+
+// contentHashPattern matches the content hashes bundles are addressed by.
+var contentHashPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// maxShardDepth bounds Config.CacheShardDepth. Each level splits the files
+// in 256 ways, so more than two is only worth it for enormous caches.
+const maxShardDepth = 4
+
+// shardPath returns the path of the file name in dir with depth levels of
+// subdirectories, each named by the next two hex digits of the hash name
+// starts with: ab/cd/abcdef... for a depth of 2.
+func shardPath(dir, name string, depth int) string {
+	parts := []string{dir}
+	for i := range depth {
+		parts = append(parts, name[2*i:2*i+2])
+	}
+	return filepath.Join(append(parts, name)...)
+}
+
+// shardDirPattern matches the names of shard directories.
+var shardDirPattern = regexp.MustCompile(`^[0-9a-f]{2}$`)
+
+// layoutFile records the shard depth of the cache directory, so files only
+// have to be moved when it changes. Like stateFile, it doesn't match
+// cacheFilePattern.
+const layoutFile = "layout.json"
+
+type cacheLayout struct {
+	ShardDepth int `json:"shardDepth"`
+}
+
+// migrateCacheLayout moves the files in the cache directory dir to where
+// they belong with depth levels of shards, from a flat directory or from
+// any other depth, and removes the shard directories left empty. It only
+// looks at the files if the depth changed since the last run, and returns
+// how many were moved.
+func migrateCacheLayout(dir string, depth int) (moved int, err error) {
+	layoutPath := filepath.Join(dir, layoutFile)
+	if b, err := os.ReadFile(layoutPath); err == nil {
+		var layout cacheLayout
+		if json.Unmarshal(b, &layout) == nil && layout.ShardDepth == depth {
+			return 0, nil
+		}
+	}
+	root, content := filepath.Clean(dir), filepath.Join(dir, contentDir)
+	var shardDirs []string
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && path != content && shardDirPattern.MatchString(d.Name()) {
+				shardDirs = append(shardDirs, path)
+			}
+			return nil
+		}
+		var target string
+		switch name := d.Name(); {
+		case cacheFilePattern.MatchString(name):
+			target = shardPath(root, name, depth)
+		case contentHashPattern.MatchString(name) && strings.HasPrefix(path, content+string(filepath.Separator)):
+			target = shardPath(content, name, depth)
+		default:
+			return nil
+		}
+		if target == path {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(path, target); err != nil {
+			return err
+		}
+		moved++
+		return nil
+	})
+	if err != nil {
+		return moved, err
+	}
+	// Deepest first, so parents are empty by the time they are reached.
+	// Directories still holding files stay.
+	for _, d := range slices.Backward(shardDirs) {
+		_ = os.Remove(d)
+	}
+	b, err := json.Marshal(cacheLayout{ShardDepth: depth})
+	if err != nil {
+		return moved, err
+	}
+	return moved, writeFileAtomic(layoutPath, b, 0644)
+}
+
+// flushCache empties dir of cache files and tallies them. The directory
+// itself stays, since it may be a mount point that can't be moved, and so
+// do its layout and state files and the shard directories. Readers holding
+// open files keep reading them, and writes in progress still land.
+func flushCache(dir string) (entries int, size int64, err error) {
+	root := filepath.Clean(dir)
+	keep := []string{filepath.Join(root, layoutFile), filepath.Join(root, stateFile)}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || slices.Contains(keep, path) {
+			return err
+		}
+		if ok, _ := filepath.Match("*.tmp-*", d.Name()); ok {
+			return nil
+		}
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size += info.Size()
+		if cacheEntryPattern.MatchString(d.Name()) {
+			entries++
+		}
+		return nil
+	})
+	return entries, size, err
+}
+
+// writeCacheFile atomically stores data in the cache under name,
+// compressing it if configured to. Compressed files record the content
+// hash of the uncompressed data in their gzip header.
+func (h *handler) writeCacheFile(name string, data []byte) error {
+	if err := checkCacheName(name); err != nil {
+		return err
+	}
+	defer h.dropVariants(name)
+	if !h.cfg.CompressCache {
+		return h.putCacheFile(name, data)
+	}
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, h.cfg.CompressionLevels.gzip)
+	if err != nil {
+		return err
+	}
+	zw.Comment = contentHash(data)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return h.putCacheFile(name, buf.Bytes())
+}
+
+// readCacheFile returns the contents of a cache file, decompressing it if
+// it was stored compressed.
+func (h *handler) readCacheFile(name string) ([]byte, error) {
+	b, err := h.cache.Get(name)
+	if err != nil || !isGzip(b) {
+		return b, err
+	}
+	return gunzip(b)
+}
+
+// isGzip reports whether b starts with the gzip magic number. Source code
+// never does, so compressed and plain entries can be told apart.
+func isGzip(b []byte) bool {
+	return len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b
+}
+
+func gunzip(b []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// gzipContentHash returns the content hash of the data compressed in b,
+// reading it from the gzip header when recorded there.
+func gzipContentHash(b []byte) (string, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+	if zr.Comment != "" {
+		return zr.Comment, nil
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return "", err
+	}
+	return contentHash(data), nil
+}
+
+// acceptsEncoding reports whether r's Accept-Encoding allows encoding.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) && strings.TrimSpace(name) != "*" {
+			continue
+		}
+		q := strings.ReplaceAll(strings.TrimSpace(params), " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
+
+// entryInfo describes how a cache entry was produced. It is stored next to
+// the entry as <hash>.json.
+type entryInfo struct {
+	// URL is the upstream URL the source was fetched from, empty for
+	// sources posted to /build.
+	URL string `json:"url,omitempty"`
+	// RequestURI is the request that triggered the build.
+	RequestURI string `json:"requestURI"`
+	// Options are the build params given in the query string.
+	Options string `json:"options,omitempty"`
+	// SourceHash is the SHA-256 of the source that was built.
+	SourceHash  string `json:"sourceHash"`
+	ContentHash string `json:"contentHash"`
+	// Integrity is the bundle's subresource integrity, see integrity.
+	Integrity string `json:"integrity"`
+	Size      int    `json:"size"`
+	// BuildOptions are the options the bundle was built with, absent for
+	// ?raw=true transforms.
+	BuildOptions *buildOptionsSummary `json:"buildOptions,omitempty"`
+	// InstallWarning lists the packages a lenient install left out.
+	InstallWarning string    `json:"installWarning,omitempty"`
+	Esbuild        string    `json:"esbuild"`
+	Version        string    `json:"version"`
+	BuiltAt        time.Time `json:"builtAt"`
+}
+
+// manifest is what ?manifest=true serves: a small description of the
+// bundle that a deploy step can record to reference it by content.
+type manifest struct {
+	URL string `json:"url,omitempty"`
+	// Path is where the bundle is served by content hash, relative to the
+	// service's root.
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+	// Integrity is the value of an integrity attribute pinning the
+	// bundle, see integrity.
+	Integrity string    `json:"integrity"`
+	Size      int       `json:"size"`
+	BuiltAt   time.Time `json:"builtAt"`
+}
+
+// writeEntryInfo stores info as the description of the cache entry hash,
+// along with its manifest and integrity.
+func (h *handler) writeEntryInfo(hash string, info entryInfo) error {
+	b, err := json.MarshalIndent(manifest{
+		URL:       info.URL,
+		Path:      "/_b/" + info.ContentHash,
+		Hash:      info.ContentHash,
+		Integrity: info.Integrity,
+		Size:      info.Size,
+		BuiltAt:   info.BuiltAt,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := h.writeCacheFile(hash+integritySuffix, []byte(info.Integrity)); err != nil {
+		return err
+	}
+	if err := h.writeCacheFile(hash+".manifest.json", b); err != nil {
+		return err
+	}
+	if b, err = json.MarshalIndent(info, "", "  "); err != nil {
+		return err
+	}
+	return h.writeCacheFile(hash+".json", b)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testModule is a small source with nothing to install.
+const testModule = "export const greet = (name: string): string => `hello ${name}`;\n"
+
+func TestCacheMissThenHit(t *testing.T) {
+	upstream := newTestUpstream(t, map[string]string{"/mod.ts": testModule})
+	h := newTestHandler(t, Config{})
+	path := "/" + upstream.URL + "/mod.ts"
+
+	miss := get(t, h, path)
+	if miss.Code != http.StatusOK {
+		t.Fatalf("first request: status = %d\n%s", miss.Code, miss.Body)
+	}
+	if got := miss.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("first request: X-Cache = %q, want MISS", got)
+	}
+	// The bundle is written to the cache after it is served
+	if err := h.waitForBuilds(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	params, err := parseBuildParams(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := cacheKey(upstream.URL+"/mod.ts", params, h.keySalt)
+	cached, err := os.ReadFile(filepath.Join(h.cfg.CacheDir, hash))
+	if err != nil {
+		t.Fatalf("bundle wasn't cached: %v", err)
+	}
+	if !bytes.Equal(cached, miss.Body.Bytes()) {
+		t.Errorf("cached bundle differs from the one served")
+	}
+
+	hit := get(t, h, path)
+	if hit.Code != http.StatusOK {
+		t.Fatalf("second request: status = %d\n%s", hit.Code, hit.Body)
+	}
+	if got := hit.Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("second request: X-Cache = %q, want HIT", got)
+	}
+	if !bytes.Equal(hit.Body.Bytes(), miss.Body.Bytes()) {
+		t.Errorf("cache hit served different bytes:\n%s\nwant:\n%s", hit.Body, miss.Body)
+	}
+	etag := hit.Header().Get("ETag")
+	if etag == "" || etag != miss.Header().Get("ETag") {
+		t.Errorf("ETag = %q, want %q from the build", etag, miss.Header().Get("ETag"))
+	}
+
+	notModified := get(t, h, path, "If-None-Match", etag)
+	if notModified.Code != http.StatusNotModified {
+		t.Fatalf("conditional request: status = %d, want 304", notModified.Code)
+	}
+	if notModified.Body.Len() != 0 {
+		t.Errorf("304 has a body: %s", notModified.Body)
+	}
+
+	if changed := get(t, h, path, "If-None-Match", `"something-else"`); changed.Code != http.StatusOK {
+		t.Errorf("request with a stale ETag: status = %d, want 200", changed.Code)
+	}
+}
+
+func TestFlushCacheEmptiesInPlace(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := migrateCacheLayout(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	cache := newDiskCache(dir, 1)
+	hash := "0123456789abcdef0123"
+	for name, data := range map[string]string{
+		hash:                                  "export {};",
+		hash + ".css":                         "a{}",
+		contentName(strings.Repeat("ab", 16)): hash,
+	} {
+		if err := cache.Put(name, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, stateFile), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, size, err := cache.Flush()
+	if err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if entries != 1 || size != int64(len("export {};a{}")+len(hash)) {
+		t.Errorf("Flush() = %d entries, %d bytes", entries, size)
+	}
+	// Emptied rather than replaced, as a mount point has to be
+	if after, err := os.Stat(dir); err != nil || !os.SameFile(before, after) {
+		t.Errorf("cache directory was replaced: %v", err)
+	}
+	for _, name := range []string{hash, hash + ".css"} {
+		if _, err := cache.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s survived the flush: %v", name, err)
+		}
+	}
+	for _, name := range []string{layoutFile, stateFile} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s was flushed: %v", name, err)
+		}
+	}
+	if err := cache.Put(hash, []byte("export {};")); err != nil {
+		t.Errorf("Put after Flush: %v", err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "0123456789abcdef0123")
+	bundles := [][]byte{
+		bytes.Repeat([]byte("export const a = 1;\n"), 50000),
+		bytes.Repeat([]byte("export const bb = 2;\n"), 40000),
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				if err := writeFileAtomic(path, bundles[i%2], 0644); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for reads := 0; ; reads++ {
+		select {
+		case <-done:
+			if reads == 0 {
+				t.Fatal("no reads overlapped the writes")
+			}
+			entries, err := os.ReadDir(filepath.Dir(path))
+			if err != nil || len(entries) != 1 {
+				t.Errorf("temporary files left behind: %v %v", entries, err)
+			}
+			return
+		default:
+		}
+		b, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, bundles[0]) && !bytes.Equal(b, bundles[1]) {
+			t.Fatalf("read %d bytes that are neither bundle", len(b))
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache stores the files of cache entries by name: bundles under their
+// hash, their sidecars under the hash and a suffix like ".css", and
+// content address pointers under contentName. Files are written whole and
+// replaced atomically. Missing files are reported as errors for which
+// os.IsNotExist is true.
+//
+// The disk backend keeps files in Config.CacheDir. Other backends can be
+// shared by several instances, so none of them rebuild what another
+// already built. The hot cache still holds popular files in each
+// instance's memory in front of the backend.
+type Cache interface {
+	Get(name string) ([]byte, error)
+	Put(name string, data []byte) error
+	Delete(name string) error
+	Stat(name string) (CacheFileInfo, error)
+	// Flush removes every file and reports how many cache entries and
+	// bytes there were.
+	Flush() (entries int, size int64, err error)
+}
+
+// CacheFileInfo describes a file in a Cache.
+type CacheFileInfo struct {
+	Size int64
+	// ModTime is when the file was last put.
+	ModTime time.Time
+}
+
+// cacheBackends are the values of CACHE_BACKEND.
+var cacheBackends = []string{"disk", "memory"}
+
+// cacheBackendName returns the name c is configured with, for the admin
+// config.
+func cacheBackendName(c Cache) string {
+	if checked, ok := c.(checkedCache); ok {
+		c = checked.Cache
+	}
+	switch c.(type) {
+	case *diskCache:
+		return "disk"
+	case *memoryCache:
+		return "memory"
+	}
+	return "custom"
+}
+
+// contentName returns the name of the pointer from the content hash sha to
+// the cache entry with that content.
+func contentName(sha string) string {
+	return contentDir + "/" + sha
+}
+
+// checkedCache checks names before passing them on to its backend, so
+// names derived from requests can only ever reach cache files.
+type checkedCache struct{ Cache }
+
+func checkCacheName(name string) error {
+	if sha, ok := strings.CutPrefix(name, contentDir+"/"); ok && contentHashPattern.MatchString(sha) || cacheFilePattern.MatchString(name) {
+		return nil
+	}
+	return fmt.Errorf("invalid cache file name %q", name)
+}
+
+func (c checkedCache) Get(name string) ([]byte, error) {
+	if err := checkCacheName(name); err != nil {
+		return nil, err
+	}
+	return c.Cache.Get(name)
+}
+
+func (c checkedCache) Put(name string, data []byte) error {
+	if err := checkCacheName(name); err != nil {
+		return err
+	}
+	return c.Cache.Put(name, data)
+}
+
+func (c checkedCache) Delete(name string) error {
+	if err := checkCacheName(name); err != nil {
+		return err
+	}
+	return c.Cache.Delete(name)
+}
+
+func (c checkedCache) Stat(name string) (CacheFileInfo, error) {
+	if err := checkCacheName(name); err != nil {
+		return CacheFileInfo{}, err
+	}
+	return c.Cache.Stat(name)
+}
+
+// diskCache is the Cache in a local directory, spread over depth levels of
+// shard directories.
+type diskCache struct {
+	dir   string
+	depth int
+}
+
+func newDiskCache(dir string, depth int) *diskCache {
+	return &diskCache{dir: dir, depth: depth}
+}
+
+func (c *diskCache) path(name string) string {
+	if sha, ok := strings.CutPrefix(name, contentDir+"/"); ok {
+		return shardPath(filepath.Join(c.dir, contentDir), sha, c.depth)
+	}
+	return shardPath(c.dir, name, c.depth)
+}
+
+func (c *diskCache) Get(name string) ([]byte, error) {
+	return os.ReadFile(c.path(name))
+}
+
+func (c *diskCache) Put(name string, data []byte) error {
+	path := c.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+func (c *diskCache) Delete(name string) error {
+	return os.Remove(c.path(name))
+}
+
+func (c *diskCache) Stat(name string) (CacheFileInfo, error) {
+	info, err := os.Stat(c.path(name))
+	if err != nil {
+		return CacheFileInfo{}, err
+	}
+	return CacheFileInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (c *diskCache) Flush() (int, int64, error) {
+	return flushCache(c.dir)
+}
+
+// memoryCache is a Cache in the process's memory, for tests and
+// throwaway instances. It isn't bounded, and is lost on restart.
+type memoryCache struct {
+	mu    sync.RWMutex
+	files map[string]memoryFile
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{files: map[string]memoryFile{}}
+}
+
+func (c *memoryCache) Get(name string) ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	f, ok := c.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return f.data, nil
+}
+
+func (c *memoryCache) Put(name string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files[name] = memoryFile{data: append([]byte(nil), data...), modTime: time.Now()}
+	return nil
+}
+
+func (c *memoryCache) Delete(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(c.files, name)
+	return nil
+}
+
+func (c *memoryCache) Stat(name string) (CacheFileInfo, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	f, ok := c.files[name]
+	if !ok {
+		return CacheFileInfo{}, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return CacheFileInfo{Size: int64(len(f.data)), ModTime: f.modTime}, nil
+}
+
+func (c *memoryCache) Flush() (entries int, size int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, f := range c.files {
+		if cacheEntryPattern.MatchString(name) {
+			entries++
+		}
+		size += int64(len(f.data))
+	}
+	clear(c.files)
+	return entries, size, nil
+}
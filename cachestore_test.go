@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestMemoryCacheBackend(t *testing.T) {
+	upstream := newTestUpstream(t, map[string]string{"/mod.ts": testModule})
+	h := newTestHandler(t, Config{Cache: newMemoryCache()})
+	path := "/" + upstream.URL + "/mod.ts"
+
+	miss := get(t, h, path)
+	if miss.Code != http.StatusOK || miss.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("first request: status = %d, X-Cache = %q\n%s", miss.Code, miss.Header().Get("X-Cache"), miss.Body)
+	}
+	_ = h.waitForBuilds(context.Background())
+	h.hot.clear()
+	hit := get(t, h, path)
+	if hit.Header().Get("X-Cache") != "HIT" || !bytes.Equal(hit.Body.Bytes(), miss.Body.Bytes()) {
+		t.Errorf("second request: X-Cache = %q, want a HIT with the same bundle", hit.Header().Get("X-Cache"))
+	}
+
+	// Nothing goes to the cache directory, and Flush empties the backend
+	if entries, _ := os.ReadDir(h.cfg.CacheDir); len(entries) > 0 {
+		t.Errorf("memory backend wrote %s to the cache directory", entries[0].Name())
+	}
+	entries, size, err := h.cache.Flush()
+	if err != nil || entries != 1 || size == 0 {
+		t.Errorf("Flush() = %d, %d, %v, want 1 entry", entries, size, err)
+	}
+	h.hot.clear()
+	if again := get(t, h, path); again.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("after Flush: X-Cache = %q, want MISS", again.Header().Get("X-Cache"))
+	}
+}
+
+func TestCheckedCacheRejectsOtherNames(t *testing.T) {
+	cache := checkedCache{newMemoryCache()}
+	for _, name := range []string{"../state.json", "layout.json", "0123456789abcdef0123/x", "content/../../etc"} {
+		if err := cache.Put(name, []byte("x")); err == nil {
+			t.Errorf("Put(%q) succeeded", name)
+		}
+		if _, err := cache.Get(name); err == nil || os.IsNotExist(err) {
+			t.Errorf("Get(%q) = %v, want an invalid name error", name, err)
+		}
+	}
+	if err := cache.Put("0123456789abcdef0123.css", []byte("x")); err != nil {
+		t.Errorf("Put of a sidecar: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// checkVerdict is the answer to /check/<url>.
+type checkVerdict struct {
+	OK     bool           `json:"ok"`
+	Status int            `json:"status,omitempty"`
+	Kind   string         `json:"kind,omitempty"`
+	Errors []errorMessage `json:"errors,omitempty"`
+}
+
+// serveCheck answers /check/<url> with whether the URL bundles, for CI
+// checks that a module still builds. It runs the same pipeline and limits
+// as a request for the bundle with ?cache=false, so nothing is cached and
+// a broken upstream is always built afresh, but answers with a verdict
+// instead of the bundle. Failures keep the status the bundle would have
+// been answered with.
+func (h *handler) serveCheck(w http.ResponseWriter, r *http.Request) {
+	// Building can outlast the server's write timeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	// The upstream's params keep their order, which is part of its URL
+	query := stripQueryParams(r.URL.RawQuery, "cache")
+	if query != "" {
+		query += "&"
+	}
+	req := r.Clone(r.Context())
+	req.URL.Path, req.URL.RawPath, req.URL.RawQuery = strings.TrimPrefix(r.URL.Path, "/check"), "", query+"cache=false"
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	h.bundle(rec, req)
+	// Redirected URLs are built at where they lead
+	for range maxModuleRedirects {
+		if rec.Code != http.StatusFound {
+			break
+		}
+		u, err := url.Parse(rec.Header().Get("Location"))
+		if err != nil {
+			break
+		}
+		req.URL.Path, req.URL.RawQuery = u.Path, u.RawQuery
+		rec = httptest.NewRecorder()
+		h.bundle(rec, req)
+	}
+
+	verdict := checkVerdict{OK: rec.Code == http.StatusOK}
+	status := http.StatusOK
+	if !verdict.OK {
+		status = rec.Code
+		if status < 400 {
+			status = http.StatusBadGateway
+		}
+		verdict.Status, verdict.Kind = rec.Code, rec.Header().Get("X-Error-Kind")
+		var body struct {
+			Error    string         `json:"error"`
+			Messages []errorMessage `json:"messages"`
+		}
+		// Requests rejected before building answer in plain text
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			body.Error = strings.TrimSpace(rec.Body.String())
+		}
+		verdict.Errors = body.Messages
+		if len(verdict.Errors) == 0 {
+			verdict.Errors = []errorMessage{{Text: body.Error}}
+		}
+	}
+	logger(r.Context()).Info("checked build", "path", req.URL.Path, "ok", verdict.OK, "status", rec.Code)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(verdict)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestCheckBuildsTheBundlesURL(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/javascript")
+		_, _ = io.WriteString(w, testModule)
+	}))
+	t.Cleanup(upstream.Close)
+	h := newTestHandler(t, Config{})
+	path := "/" + upstream.URL + "/mod.ts?b=1&a=2"
+
+	rec := get(t, h, "/check"+path)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("check: status = %d\n%s", rec.Code, rec.Body)
+	}
+	var verdict checkVerdict
+	if err := json.Unmarshal(rec.Body.Bytes(), &verdict); err != nil || !verdict.OK {
+		t.Fatalf("check: verdict = %+v (%v)\n%s", verdict, err, rec.Body)
+	}
+	_ = h.waitForBuilds(context.Background())
+	if entries, _ := os.ReadDir(h.cfg.CacheDir); len(entries) != 0 {
+		t.Errorf("check cached %d files", len(entries))
+	}
+
+	if rec := get(t, h, path); rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("bundle: status = %d, X-Cache = %q\n%s", rec.Code, rec.Header().Get("X-Cache"), rec.Body)
+	}
+	_ = h.waitForBuilds(context.Background())
+
+	// Both fetched the upstream URL with its params in their order, which
+	// the cache key is made from
+	if len(queries) != 2 || queries[0] != "b=1&a=2" || queries[1] != queries[0] {
+		t.Errorf("upstream queries = %q, want b=1&a=2 twice", queries)
+	}
+	params, err := parseBuildParams(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := cacheKey(upstream.URL+"/mod.ts?b=1&a=2", params, h.keySalt)
+	if _, err := os.Stat(filepath.Join(h.cfg.CacheDir, hash)); err != nil {
+		t.Errorf("bundle isn't cached under the key the check built: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Compressed variants of cache files are stored next to them as
+// <name>.br and <name>.gz, each generated the first time a client
+// accepting that encoding asks for the file. They are removed whenever the
+// file is rewritten. Variants get ETags of their own, as caches must not
+// treat a gzip and a brotli response as interchangeable.
+
+// minCompressSize is the smallest file worth compressing.
+const minCompressSize = 512
+
+// compressionLevels are the gzip and brotli levels files are compressed
+// at, for both the cache with CACHE_COMPRESSION and response variants.
+// Higher levels make smaller files for more CPU: each step past the
+// balanced levels saves a few percent at up to twice the time, and brotli's
+// top levels take seconds on large bundles. Variants are compressed once
+// and served many times, so most deployments can afford more than the
+// cache, which is compressed on every build.
+type compressionLevels struct {
+	gzip, brotli int
+}
+
+// compressionPresets are the values of COMPRESSION_LEVEL. GZIP_LEVEL and
+// BROTLI_LEVEL override either level.
+var compressionPresets = map[string]compressionLevels{
+	"fast":     {gzip: gzip.BestSpeed, brotli: brotli.BestSpeed},
+	"balanced": {gzip: 6, brotli: 6},
+	"best":     {gzip: gzip.BestCompression, brotli: brotli.BestCompression},
+}
+
+// defaultCompression is the preset used without a COMPRESSION_LEVEL.
+const defaultCompression = "balanced"
+
+// validate checks that the levels are in range for their algorithms.
+func (l compressionLevels) validate() error {
+	if l.gzip < gzip.BestSpeed || l.gzip > gzip.BestCompression {
+		return fmt.Errorf("gzip level %d is out of range, expected %d to %d", l.gzip, gzip.BestSpeed, gzip.BestCompression)
+	}
+	if l.brotli < brotli.BestSpeed || l.brotli > brotli.BestCompression {
+		return fmt.Errorf("brotli level %d is out of range, expected %d to %d", l.brotli, brotli.BestSpeed, brotli.BestCompression)
+	}
+	return nil
+}
+
+// contentEncoding is a compression a variant can be stored with.
+type contentEncoding struct {
+	name, ext string
+	compress  func(b []byte, levels compressionLevels) ([]byte, error)
+}
+
+// contentEncodings are the supported encodings, most preferred first.
+var contentEncodings = []contentEncoding{
+	{"br", ".br", func(b []byte, levels compressionLevels) ([]byte, error) {
+		var buf bytes.Buffer
+		bw := brotli.NewWriterLevel(&buf, levels.brotli)
+		if _, err := bw.Write(b); err != nil {
+			return nil, err
+		}
+		err := bw.Close()
+		return buf.Bytes(), err
+	}},
+	{"gzip", ".gz", func(b []byte, levels compressionLevels) ([]byte, error) {
+		var buf bytes.Buffer
+		zw, err := gzip.NewWriterLevel(&buf, levels.gzip)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := zw.Write(b); err != nil {
+			return nil, err
+		}
+		err = zw.Close()
+		return buf.Bytes(), err
+	}},
+}
+
+// preferredEncoding returns the encoding to send r a variant in, if any.
+func preferredEncoding(r *http.Request) *contentEncoding {
+	for i, enc := range contentEncodings {
+		if acceptsEncoding(r, enc.name) {
+			return &contentEncodings[i]
+		}
+	}
+	return nil
+}
+
+// compressible reports whether files of contentType shrink when
+// compressed. Images, fonts and the like already are.
+func compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/javascript" ||
+		mediaType == "application/json" ||
+		mediaType == "application/typescript" ||
+		mediaType == "image/svg+xml"
+}
+
+// variant returns the cache file name compressed with enc, generating and
+// storing it if it doesn't exist yet. data and sum are the file's contents,
+// possibly gzip compressed on disk, and content hash, read when name was
+// at generation gen.
+func (h *handler) variant(name string, data []byte, sum string, gen uint64, enc *contentEncoding) ([]byte, error) {
+	variantName := name + enc.ext
+	if b, _, ok := h.hot.get(variantName); ok {
+		return b, nil
+	}
+	variantGen := h.hot.generation(variantName)
+	b, err := h.cache.Get(variantName)
+	if err == nil {
+		h.hot.add(variantName, b, sum, variantGen)
+		return b, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if isGzip(data) {
+		if data, err = gunzip(data); err != nil {
+			return nil, err
+		}
+	}
+	if b, err = enc.compress(data, h.cfg.CompressionLevels); err != nil {
+		return nil, err
+	}
+	if err := h.putCacheFile(variantName, b); err != nil {
+		return nil, err
+	}
+	// The file was rewritten while this was compressed from the old one
+	if h.hot.generation(name) != gen {
+		_ = h.cache.Delete(variantName)
+		return b, nil
+	}
+	h.hot.add(variantName, b, sum, variantGen)
+	return b, nil
+}
+
+// dropVariants forgets the cache file name and removes its compressed
+// variants, after it is rewritten.
+func (h *handler) dropVariants(name string) {
+	// Invalidating first makes variants being generated concurrently
+	// remove themselves
+	h.hot.invalidate(name)
+	for _, enc := range contentEncodings {
+		h.hot.invalidate(name + enc.ext)
+		_ = h.cache.Delete(name + enc.ext)
+	}
+}
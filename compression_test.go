@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestCompressedResponses(t *testing.T) {
+	// Long enough to be worth compressing once minified
+	module := "export const text = " + strconv.Quote(strings.Repeat("compress me ", 100)) + ";\n"
+	upstream := newTestUpstream(t, map[string]string{"/big.ts": module})
+
+	for _, compressCache := range []bool{false, true} {
+		t.Run("CompressCache="+strconv.FormatBool(compressCache), func(t *testing.T) {
+			h := newTestHandler(t, Config{CompressResponses: true, CompressCache: compressCache, CompressionLevels: compressionPresets[defaultCompression]})
+			path := "/" + upstream.URL + "/big.ts"
+			if rec := get(t, h, path); rec.Code != http.StatusOK {
+				t.Fatalf("build: status = %d\n%s", rec.Code, rec.Body)
+			}
+			if err := h.waitForBuilds(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			plain := get(t, h, path, "Accept-Encoding", "identity")
+			if plain.Code != http.StatusOK || plain.Header().Get("Content-Encoding") != "" {
+				t.Fatalf("identity: status = %d, Content-Encoding = %q", plain.Code, plain.Header().Get("Content-Encoding"))
+			}
+			if got := plain.Header().Get("Content-Length"); got != strconv.Itoa(plain.Body.Len()) {
+				t.Errorf("identity: Content-Length = %s for %d bytes", got, plain.Body.Len())
+			}
+			etags := map[string]string{"": plain.Header().Get("ETag")}
+
+			for _, tt := range []struct {
+				encoding   string
+				decompress func(io.Reader) (io.Reader, error)
+			}{
+				{"gzip", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+				{"br", func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil }},
+			} {
+				rec := get(t, h, path, "Accept-Encoding", tt.encoding)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("%s: status = %d\n%s", tt.encoding, rec.Code, rec.Body)
+				}
+				if got := rec.Header().Get("Content-Encoding"); got != tt.encoding {
+					t.Fatalf("%s: Content-Encoding = %q", tt.encoding, got)
+				}
+				if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(rec.Body.Len()) {
+					t.Errorf("%s: Content-Length = %s for %d compressed bytes", tt.encoding, got, rec.Body.Len())
+				}
+				if rec.Body.Len() >= plain.Body.Len() {
+					t.Errorf("%s: %d bytes isn't smaller than the %d uncompressed", tt.encoding, rec.Body.Len(), plain.Body.Len())
+				}
+				zr, err := tt.decompress(bytes.NewReader(rec.Body.Bytes()))
+				if err != nil {
+					t.Fatalf("%s: %v", tt.encoding, err)
+				}
+				if body, err := io.ReadAll(zr); err != nil || !bytes.Equal(body, plain.Body.Bytes()) {
+					t.Errorf("%s: decompresses to something else (%v):\n%s", tt.encoding, err, body)
+				}
+				if !strings.Contains(rec.Header().Get("Vary"), "Accept-Encoding") {
+					t.Errorf("%s: Vary = %q", tt.encoding, rec.Header().Get("Vary"))
+				}
+				etag := rec.Header().Get("ETag")
+				for other, otherTag := range etags {
+					if etag == otherTag {
+						t.Errorf("%s: shares its ETag %s with the %q response", tt.encoding, etag, other)
+					}
+				}
+				etags[tt.encoding] = etag
+				if again := get(t, h, path, "Accept-Encoding", tt.encoding, "If-None-Match", etag); again.Code != http.StatusNotModified {
+					t.Errorf("%s: revalidating: status = %d, want 304", tt.encoding, again.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressedVariantsAreStoredLazily(t *testing.T) {
+	module := "export const text = " + strconv.Quote(strings.Repeat("compress me ", 100)) + ";\n"
+	upstream := newTestUpstream(t, map[string]string{"/big.ts": module})
+	h := newTestHandler(t, Config{CompressResponses: true, CompressionLevels: compressionPresets[defaultCompression]})
+	path := "/" + upstream.URL + "/big.ts"
+	if rec := get(t, h, path); rec.Code != http.StatusOK {
+		t.Fatalf("build: status = %d\n%s", rec.Code, rec.Body)
+	}
+	if err := h.waitForBuilds(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	params, err := parseBuildParams(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := cacheKey(upstream.URL+"/big.ts", params, h.keySalt)
+	stored := func(ext string) bool {
+		_, err := os.Stat(filepath.Join(h.cfg.CacheDir, hash+ext))
+		return err == nil
+	}
+	if !stored("") || stored(".gz") || stored(".br") {
+		t.Fatalf("after the build: bundle %t, .gz %t, .br %t, want only the bundle", stored(""), stored(".gz"), stored(".br"))
+	}
+
+	bodies := map[string][]byte{}
+	for _, tt := range []struct{ acceptEncoding, encoding, ext string }{
+		{"gzip", "gzip", ".gz"},
+		{"br;q=1.0, gzip;q=0.5", "br", ".br"},
+		{"gzip, br;q=0", "gzip", ".gz"},
+	} {
+		rec := get(t, h, path, "Accept-Encoding", tt.acceptEncoding)
+		if got := rec.Header().Get("Content-Encoding"); got != tt.encoding {
+			t.Fatalf("%q: Content-Encoding = %q, want %q", tt.acceptEncoding, got, tt.encoding)
+		}
+		if !stored(tt.ext) {
+			t.Errorf("%q: %s variant wasn't stored", tt.acceptEncoding, tt.ext)
+		}
+		// The variant stored is the one served, and served again
+		if b, err := os.ReadFile(filepath.Join(h.cfg.CacheDir, hash+tt.ext)); err != nil || !bytes.Equal(b, rec.Body.Bytes()) {
+			t.Errorf("%q: served bytes differ from the stored %s variant (%v)", tt.acceptEncoding, tt.ext, err)
+		}
+		if prev, ok := bodies[tt.encoding]; ok && !bytes.Equal(prev, rec.Body.Bytes()) {
+			t.Errorf("%q: %s variant changed between requests", tt.acceptEncoding, tt.encoding)
+		}
+		bodies[tt.encoding] = rec.Body.Bytes()
+		if _, asked := bodies["br"]; !asked && stored(".br") {
+			t.Errorf("%q: brotli variant stored before a client asked for it", tt.acceptEncoding)
+		}
+	}
+	if bytes.Equal(bodies["gzip"], bodies["br"]) {
+		t.Error("gzip and brotli variants are the same bytes")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// buildConfig is the format of the optional build options file. Its values
+// override the built-in defaults and are themselves overridden by query
+// params, so the precedence is query > file > built-in.
+type buildConfig struct {
+	Target            string            `json:"target,omitempty"`
+	Format            string            `json:"format,omitempty"`
+	Platform          string            `json:"platform,omitempty"`
+	Minify            *bool             `json:"minify,omitempty"`
+	MinifyWhitespace  *bool             `json:"minifyWhitespace,omitempty"`
+	MinifyIdentifiers *bool             `json:"minifyIdentifiers,omitempty"`
+	MinifySyntax      *bool             `json:"minifySyntax,omitempty"`
+	Define            map[string]string `json:"define,omitempty"`
+	External          []string          `json:"external,omitempty"`
+	// Loader maps file extensions to esbuild loaders for imported files,
+	// e.g. {".png": "dataurl", ".svg": "text"}, so sources that import
+	// assets build. ?loader=.ext=name overrides it per extension.
+	Loader map[string]string `json:"loader,omitempty"`
+	// PublicPath is the URL browsers reach this service at, e.g.
+	// https://esm.example.com. Emitted assets and sourcemaps are referenced
+	// under it, and by root-relative URLs without it.
+	PublicPath string `json:"publicPath,omitempty"`
+	// AssetNames is esbuild's template for naming emitted assets, e.g.
+	// "[name]-[hash]". Assets are served from a flat directory per bundle,
+	// so it can't contain a directory.
+	AssetNames string `json:"assetNames,omitempty"`
+	// Inject names shims in the shims directory imported into every
+	// module, e.g. a Buffer polyfill.
+	Inject []string `json:"inject,omitempty"`
+	// NodePaths are extra directories bare imports are resolved from,
+	// after the build's own node_modules, e.g. the node_modules of a
+	// monorepo package. Relative paths are relative to the config file.
+	// They are only configurable here: every file under them can be
+	// bundled into a response, so requests mustn't be able to name them.
+	// Their contents aren't part of cache keys, so changing them needs a
+	// new CACHE_SALT.
+	NodePaths []string `json:"nodePaths,omitempty"`
+}
+
+// loadBuildConfig reads a build options file and applies it on top of
+// opts. A missing file is only an error if required. It returns a
+// fingerprint of the file's effective settings for use in cache keys.
+func loadBuildConfig(path string, required bool, opts *api.BuildOptions) (string, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var cfg buildConfig
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return "", fmt.Errorf("parsing %s: %w", path, err)
+	}
+	// Builds run in their own directory, so paths are made absolute
+	for i, dir := range cfg.NodePaths {
+		if !filepath.IsAbs(dir) {
+			if cfg.NodePaths[i], err = filepath.Abs(filepath.Join(filepath.Dir(path), dir)); err != nil {
+				return "", err
+			}
+		}
+	}
+	if err := cfg.apply(opts); err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	// Marshalling sorts map keys, giving a stable fingerprint
+	canonical, err := json.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	return "config:" + string(canonical), nil
+}
+
+func (c buildConfig) apply(opts *api.BuildOptions) error {
+	if _, err := parseEnum("target", c.Target, esTargets); err != nil {
+		return err
+	}
+	if _, err := parseEnum("format", c.Format, formats); err != nil {
+		return err
+	}
+	if _, err := parseEnum("platform", c.Platform, platforms); err != nil {
+		return err
+	}
+	if strings.Contains(c.AssetNames, "/") || strings.Contains(c.AssetNames, "[dir]") {
+		return fmt.Errorf("assetNames %q can't contain a directory", c.AssetNames)
+	}
+	if c.PublicPath != "" {
+		u, err := url.Parse(c.PublicPath)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("publicPath %q must be an http or https URL without a query", c.PublicPath)
+		}
+		opts.PublicPath = c.PublicPath
+	}
+	for _, name := range c.Inject {
+		if !shimNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid inject %q, expected the file name of a shim", name)
+		}
+	}
+	if len(c.Inject) > 0 {
+		opts.Inject = c.Inject
+	}
+	if c.AssetNames != "" {
+		opts.AssetNames = c.AssetNames
+	}
+	if c.Target != "" {
+		opts.Target = esTargets[c.Target]
+	}
+	if c.Format != "" {
+		opts.Format = formats[c.Format]
+	}
+	if c.Platform != "" {
+		opts.Platform = platforms[c.Platform]
+	}
+	if c.Minify != nil {
+		opts.MinifyWhitespace = *c.Minify
+		opts.MinifyIdentifiers = *c.Minify
+		opts.MinifySyntax = *c.Minify
+	}
+	for flag, value := range map[*bool]*bool{
+		&opts.MinifyWhitespace:  c.MinifyWhitespace,
+		&opts.MinifyIdentifiers: c.MinifyIdentifiers,
+		&opts.MinifySyntax:      c.MinifySyntax,
+	} {
+		if value != nil {
+			*flag = *value
+		}
+	}
+	if len(c.Define) > 0 {
+		opts.Define = c.Define
+	}
+	if len(c.External) > 0 {
+		opts.External = c.External
+	}
+	for ext, name := range c.Loader {
+		loader, ok := loaders[name]
+		if !strings.HasPrefix(ext, ".") || !ok {
+			return fmt.Errorf("invalid loader %q: %q, expected \".ext\": loader", ext, name)
+		}
+		if opts.Loader == nil {
+			opts.Loader = map[string]api.Loader{}
+		}
+		opts.Loader[ext] = loader
+	}
+	for _, dir := range c.NodePaths {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return fmt.Errorf("nodePaths entry %q is not a directory", dir)
+		}
+	}
+	if len(c.NodePaths) > 0 {
+		opts.NodePaths = c.NodePaths
+	}
+	return nil
+}
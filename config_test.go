@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNodePaths(t *testing.T) {
+	dir := t.TempDir()
+	pkg := filepath.Join(dir, "shared", "node_modules", "shared-lib")
+	if err := os.MkdirAll(pkg, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{
+		"package.json": `{"name":"shared-lib","main":"index.js"}`,
+		"index.js":     `export const origin = "from the shared node_modules";`,
+	} {
+		if err := os.WriteFile(filepath.Join(pkg, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configFile := filepath.Join(dir, "esbuild.json")
+	if err := os.WriteFile(configFile, []byte(`{"nodePaths": ["shared/node_modules"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := defaultBuildOptions()
+	if _, err := loadBuildConfig(configFile, true, &opts); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join(dir, "shared", "node_modules")}; len(opts.NodePaths) != 1 || opts.NodePaths[0] != want[0] {
+		t.Fatalf("NodePaths = %q, want %q relative to the config file", opts.NodePaths, want)
+	}
+
+	// Packages found in a node path aren't installed, so a bun refusing to
+	// install any shows they resolved from there
+	upstream := newTestUpstream(t, map[string]string{"/mod.ts": "export { origin } from \"shared-lib\";\n"})
+	h := fakeInstaller(t, Config{BuildOptions: opts})
+	h.cfg.BunBin = writeScript(t, t.TempDir(), "bun", `for pkg; do
+	case $pkg in
+	-*|install) ;;
+	*) echo "asked to install $pkg" >&2; exit 1 ;;
+	esac
+done
+`)
+	rec := get(t, h, "/"+upstream.URL+"/mod.ts", "Accept", "application/json")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "from the shared node_modules") {
+		t.Fatalf("status = %d\n%s", rec.Code, rec.Body)
+	}
+
+	if err := os.WriteFile(configFile, []byte(`{"nodePaths": ["missing"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts = defaultBuildOptions()
+	if _, err := loadBuildConfig(configFile, true, &opts); err == nil || !strings.Contains(err.Error(), "is not a directory") {
+		t.Errorf("nodePaths naming a missing directory: err = %v", err)
+	}
+}
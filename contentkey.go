@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Bundles are normally cached by their URL, which suits CDNs serving
+// immutable, versioned files. Sources from Config.ContentKeyHosts are keyed
+// by their contents instead, so a changed file gets a new entry as soon as
+// it changes. That costs a full fetch on every request, and background
+// refreshes and stale serving don't apply to them, since they find entries
+// by URL.
+
+// contentKeyed reports whether builds of sourceURL are keyed by content.
+func (h *handler) contentKeyed(sourceURL string) bool {
+	if len(h.cfg.ContentKeyHosts) == 0 {
+		return false
+	}
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return false
+	}
+	for _, host := range h.cfg.ContentKeyHosts {
+		if host == "*" || strings.EqualFold(host, u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentKey returns the cache key of a content-keyed build of the source
+// described by info, fetched from sourceURL. Relative imports resolve
+// against the URL, so it is still part of the key. Installed packages
+// resolve through the project's manifest and lockfile, which are covered
+// by lockSalt. salt is the request's salt for cacheKey.
+func (h *handler) contentKey(sourceURL string, params buildParams, info sourceInfo, salt string) string {
+	return cacheKey(sourceURL, params, fmt.Sprintf("%s\x00source:%x\x00%s", salt, info.sum, h.lockSalt))
+}
+
+// projectFingerprint returns a string identifying the package.json and
+// bun.lock in root, which decide the versions installed for bare imports.
+func projectFingerprint(root string) string {
+	hasher := sha256.New()
+	for _, file := range []string{"package.json", "bun.lock"} {
+		b, err := os.ReadFile(filepath.Join(root, file))
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(hasher, "%s\x00%x\x00", file, sha256.Sum256(b))
+	}
+	return fmt.Sprintf("project:%x", hasher.Sum(nil)[:8])
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// corsMaxAge is how long browsers may cache a preflight response.
+const corsMaxAge = 24 * 60 * 60
+
+// servePreflight answers a CORS preflight request. Every route is served to
+// any origin, as its responses are, so whatever the browser asks to send is
+// allowed.
+func servePreflight(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Allow-Methods", "GET, HEAD, POST, OPTIONS")
+	if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		h.Set("Access-Control-Allow-Headers", headers)
+	}
+	h.Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+	h.Add("Vary", "Access-Control-Request-Headers")
+	w.WriteHeader(http.StatusNoContent)
+}
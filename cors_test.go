@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	var fetched atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched.Store(true)
+	}))
+	t.Cleanup(upstream.Close)
+	h := newTestHandler(t, Config{})
+
+	for _, path := range []string{"/" + upstream.URL + "/mod.ts", "/build", "/_b/0123456789abcdef0123456789abcdef"} {
+		req := httptest.NewRequest(http.MethodOptions, path, nil)
+		req.Header.Set("Origin", "https://app.example")
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		req.Header.Set("Access-Control-Request-Headers", "x-custom, authorization")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+			t.Fatalf("%s: status = %d, want 204\n%s", path, rec.Code, rec.Body)
+		}
+		for name, want := range map[string]string{
+			"Access-Control-Allow-Origin":  "*",
+			"Access-Control-Allow-Methods": "GET, HEAD, POST, OPTIONS",
+			"Access-Control-Allow-Headers": "x-custom, authorization",
+			"Access-Control-Max-Age":       strconv.Itoa(corsMaxAge),
+			"Vary":                         "Access-Control-Request-Headers",
+		} {
+			if got := rec.Header().Get(name); got != want {
+				t.Errorf("%s: %s = %q, want %q", path, name, got, want)
+			}
+		}
+	}
+	if fetched.Load() {
+		t.Error("a preflight was fetched upstream")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// declarationsDir is where tsc writes declarations in a build directory.
+const declarationsDir = ".types"
+
+// declarations runs tsc against the source in the build directory dir,
+// whose entry is src/entryFile, and returns the .d.ts it declares. esbuild
+// doesn't emit declarations, so this is a tsc run of its own, as slow as a
+// type check. Declarations are emitted despite type errors, which
+// ?typecheck=true is there to reject. Dependencies have to be installed
+// already, for the types they declare.
+func (h *handler) declarations(ctx context.Context, dir, entryFile string) ([]byte, error) {
+	if h.cfg.NoInstall {
+		return nil, &buildError{kind: kindBuild, status: http.StatusNotImplemented, msg: "This server can't generate declarations because bun isn't installed", err: errors.New("types without bun")}
+	}
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, h.cfg.BunxBin, "--package", "typescript", "tsc",
+		"--declaration", "--emitDeclarationOnly", "--noEmit", "false", "--noEmitOnError", "false",
+		"--allowJs", "--rootDir", "src", "--outDir", declarationsDir, "--pretty", "false", "-p", "tsconfig.json")
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stdout
+	err := h.run(cmd, &stdout)
+	var limitErr *limitError
+	if errors.As(err, &limitErr) {
+		return nil, newBuildError(kindBuild, "tsc "+limitErr.Error(), err)
+	}
+	// tsc exits 2 when it reports errors, which it emits anyway
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() != 2 || err != nil && !ok {
+		return nil, newBuildError(kindBuild, "Failed to run tsc: "+h.redactSecrets(stdout.String()), err)
+	}
+	name := strings.TrimSuffix(entryFile, filepath.Ext(entryFile)) + ".d.ts"
+	b, err := os.ReadFile(filepath.Join(dir, declarationsDir, name))
+	if os.IsNotExist(err) {
+		return nil, newBuildError(kindBuild, "tsc emitted no declarations for the source:\n"+h.redactSecrets(stdout.String()), fmt.Errorf("%s not emitted", name))
+	}
+	return b, err
+}
+
+var typesRoutePattern = regexp.MustCompile(`^/_types/([0-9a-f]{20})\.d\.ts$`)
+
+// typesURL returns where the declarations of the cache entry hash are
+// served for r.
+func (h *handler) typesURL(r *http.Request, hash string) string {
+	return fmt.Sprintf("%s/_types/%s.d.ts", h.origin(r), hash)
+}
+
+// serveTypes serves the declarations generated for a cached bundle with
+// ?types=true.
+func (h *handler) serveTypes(w http.ResponseWriter, r *http.Request) {
+	m := typesRoutePattern.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		http.Error(w, "Invalid declarations path", http.StatusBadRequest)
+		return
+	}
+	if !h.serveCached(w, r, m[1]+".d.ts", "application/typescript; charset=utf-8", h.sidecarCacheControl()) {
+		http.NotFound(w, r)
+	}
+}
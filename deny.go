@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+)
+
+// validDenyPatterns checks that each of Config.DenyPackages is a valid
+// path.Match pattern, so a typo can't quietly let packages through.
+func validDenyPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// deniedPackages returns the packages matching Config.DenyPackages, which
+// are exact names or path.Match patterns. * doesn't cross the / of scoped
+// names, so "@scope/*" denies a whole scope and "*" only unscoped
+// packages.
+func (h *handler) deniedPackages(packages []string) []string {
+	var denied []string
+	for _, pkg := range packages {
+		for _, pattern := range h.cfg.DenyPackages {
+			if ok, _ := path.Match(pattern, pkg); ok || pattern == pkg {
+				if !slices.Contains(denied, pkg) {
+					denied = append(denied, pkg)
+				}
+				break
+			}
+		}
+	}
+	slices.Sort(denied)
+	return denied
+}
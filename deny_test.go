@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeniedPackages(t *testing.T) {
+	upstream := newTestUpstream(t, map[string]string{
+		"/mod.ts": "import \"left-pad\";\nimport \"@evil/miner\";\nimport \"lodash/fp\";\n",
+	})
+	bin := t.TempDir()
+	installed := filepath.Join(bin, "installed")
+	h := newTestHandler(t, Config{
+		DenyPackages: []string{"@evil/*", "left-pad"},
+		BunxBin:      writeScript(t, bin, "bunx", `echo '{"missing":{"left-pad":["src/index.ts"],"@evil/miner":["src/index.ts"],"lodash/fp":["src/index.ts"]}}'`+"\nexit 255\n"),
+		BunBin:       writeScript(t, bin, "bun", "touch "+installed+"\n"),
+	})
+
+	rec := get(t, h, "/"+upstream.URL+"/mod.ts", "Accept", "application/json")
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403\n%s", rec.Code, rec.Body)
+	}
+	if msg, _ := decodeError(t, rec)["error"].(string); msg != "Refusing to install denied packages: @evil/miner, left-pad" {
+		t.Errorf("error = %q, want it to list the denied packages only", msg)
+	}
+	if _, err := os.Stat(installed); !os.IsNotExist(err) {
+		t.Error("bun install ran for a build needing denied packages")
+	}
+
+	for pkg, want := range map[string]bool{
+		"left-pad":      true,
+		"left-pad-2":    false,
+		"@evil/miner":   true,
+		"@evil":         false,
+		"@evil-co/tool": false,
+		"lodash":        false,
+	} {
+		if got := len(h.deniedPackages([]string{pkg})) == 1; got != want {
+			t.Errorf("%s denied = %t, want %t", pkg, got, want)
+		}
+	}
+	if err := validDenyPatterns([]string{"[unclosed"}); err == nil || !strings.Contains(err.Error(), "[unclosed") {
+		t.Errorf("validDenyPatterns accepted a malformed pattern: %v", err)
+	}
+}
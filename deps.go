@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// importPattern matches the specifier of static imports, re-exports,
+// dynamic imports and require calls.
+var importPattern = regexp.MustCompile(`(?:(?:import|export)\s[^'"]*?from\s*|import\s*|(?:import|require)\s*\(\s*)['"]([^'"]+)['"]`)
+
+// hasBareImports reports whether source imports any bare module
+// specifiers, i.e. packages that need to be installed. Relative, absolute,
+// URL and node: builtin imports don't.
+func hasBareImports(source []byte) bool {
+	for _, m := range importPattern.FindAllSubmatch(source, -1) {
+		if isBareSpecifier(string(m[1])) {
+			return true
+		}
+	}
+	return false
+}
+
+func isBareSpecifier(spec string) bool {
+	if strings.HasPrefix(spec, ".") || strings.HasPrefix(spec, "/") {
+		return false
+	}
+	if strings.HasPrefix(spec, "node:") || strings.Contains(spec, "://") {
+		return false
+	}
+	return true
+}
+
+// loadPins reads a JSON object mapping package names to the version (or
+// range) to install them at. A missing file is only an error if required.
+func loadPins(path string, required bool) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pins map[string]string
+	if err := json.Unmarshal(b, &pins); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return pins, nil
+}
+
+// pinsFingerprint returns a stable string identifying a set of pins, so
+// that changing a pin invalidates bundles built with the old versions.
+func pinsFingerprint(pins map[string]string) string {
+	if len(pins) == 0 {
+		return ""
+	}
+	hasher := sha256.New()
+	for _, pkg := range slices.Sorted(maps.Keys(pins)) {
+		fmt.Fprintf(hasher, "%s@%s\x00", pkg, pins[pkg])
+	}
+	return fmt.Sprintf("pins:%x", hasher.Sum(nil))
+}
+
+// How bun install treats the build directory's package.json and bun.lock,
+// set by Config.InstallMode.
+const (
+	// installSave adds installed packages to both, which only ever
+	// touches the build directory's copies.
+	installSave = "save"
+	// installNoSave leaves them as they are.
+	installNoSave = "no-save"
+	// installFrozen also refuses to install anything the lockfile
+	// doesn't already resolve, so sources only ever get the versions the
+	// project has locked. It behaves like installNoSave without a
+	// bun.lock.
+	installFrozen = "frozen"
+)
+
+var installModes = []string{installSave, installNoSave, installFrozen}
+
+// partialInstallError is returned with Config.LenientInstall when some of
+// the missing packages failed to install and the rest were installed
+// anyway, so the build can still be attempted. It describes the first
+// failure.
+type partialInstallError struct {
+	buildError
+	// failed are the packages that weren't installed.
+	failed []string
+}
+
+// warning summarizes the failure for responses that succeeded anyway.
+func (e *partialInstallError) warning() string {
+	return "failed to install " + strings.Join(e.failed, ", ")
+}
+
+// installDependencies runs depcheck against entry, relative to dir, and
+// installs whatever it reports missing. It returns the installed packages.
+// dir must be a build directory: bun install --save rewrites its
+// package.json and bun.lock. Imports of subpaths like pkg/sub install pkg,
+// once however many of them there are. With Config.LenientInstall, packages are
+// installed one at a time after a failed install, and the ones that
+// installed are returned along with a partialInstallError.
+func (h *handler) installDependencies(ctx context.Context, dir, entry string, alias map[string]string, timing *serverTiming) (_ []string, err error) {
+	if root, err := filepath.Abs(h.cfg.ProjectRoot); err == nil && filepath.Clean(dir) == root {
+		return nil, newBuildError(kindInstall, "Refusing to install into the project root", errors.New("install dir is the project root"))
+	}
+	// Run depcheck
+	phaseStart := time.Now()
+	_, span := tracer.Start(ctx, "depcheck")
+	defer func() { endSpan(span, err) }()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, h.cfg.BunxBin, "depcheck", "--json", entry)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = h.run(cmd, &stderr)
+	if err != nil {
+		// depcheck 1.x calls process.exit(-1), exiting 255, whenever it
+		// finds missing or unused dependencies, which is the normal case
+		// here. It exits the same way when it crashes, but then prints no
+		// JSON, which is caught below.
+		var limitErr *limitError
+		if errors.As(err, &limitErr) {
+			return nil, newBuildError(kindInstall, "Depcheck "+limitErr.Error(), err)
+		}
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if !slices.Contains(h.cfg.DepcheckExitCodes, exitErr.ExitCode()) {
+				return nil, newBuildError(kindInstall, "Depcheck failed: "+h.redactSecrets(stdout.String()+"\n"+stderr.String()), exitErr)
+			}
+		} else {
+			return nil, newBuildError(kindInstall, "Depcheck failed "+err.Error(), err)
+		}
+	}
+	output := stdout.Bytes()
+	timing.add("depcheck", time.Since(phaseStart))
+
+	var depcheck struct {
+		Missing map[string][]string `json:"missing"`
+	}
+	if err := json.Unmarshal(output, &depcheck); err != nil {
+		return nil, newBuildError(kindInstall, "Failed to parse depcheck output: "+err.Error(), err)
+	}
+
+	// Install missing dependencies
+	phaseStart = time.Now()
+	// Aliased packages are replaced by their targets, so those are
+	// installed instead
+	var packages, required []string
+	for spec := range depcheck.Missing {
+		pkg := packageName(spec)
+		required = append(required, pkg)
+		if to, ok := alias[pkg]; ok {
+			pkg = packageName(to)
+			required = append(required, pkg)
+		}
+		packages = append(packages, pkg)
+	}
+	slices.Sort(packages)
+	packages = slices.Compact(packages)
+	// Denied packages are refused whether they would be installed or
+	// found in the node paths, and under their aliases too
+	if denied := h.deniedPackages(required); len(denied) > 0 {
+		return nil, newBuildError(kindForbidden, "Refusing to install denied packages: "+strings.Join(denied, ", "), fmt.Errorf("denied packages %v", denied))
+	}
+	// Packages esbuild finds in the configured node paths aren't installed
+	packages = slices.DeleteFunc(packages, h.inNodePaths)
+	span.End()
+	_, span = tracer.Start(ctx, "install", trace.WithAttributes(attribute.StringSlice("packages", packages)))
+	err = h.bunInstall(ctx, dir, packages)
+	var be *buildError
+	if errors.As(err, &be) && h.cfg.LenientInstall && len(packages) > 1 {
+		// bun gives up on every package when one fails, so find out which
+		// ones install on their own
+		var installed, failed []string
+		var first *buildError
+		for _, pkg := range packages {
+			if err := h.bunInstall(ctx, dir, []string{pkg}); err != nil {
+				if !errors.As(err, &be) || ctx.Err() != nil {
+					return nil, err
+				}
+				failed = append(failed, pkg)
+				if first == nil {
+					first = be
+				}
+				continue
+			}
+			installed = append(installed, pkg)
+		}
+		timing.add("install", time.Since(phaseStart))
+		if len(failed) == 0 {
+			return installed, nil
+		}
+		return installed, &partialInstallError{*first, failed}
+	}
+	if err != nil {
+		return nil, err
+	}
+	timing.add("install", time.Since(phaseStart))
+	return packages, nil
+}
+
+// bunInstall adds packages to the build directory dir with bun install,
+// or installs what its package.json lists without any.
+func (h *handler) bunInstall(ctx context.Context, dir string, packages []string) error {
+	// Lifecycle scripts run arbitrary code from the registry, see sandbox.go
+	args := []string{"install"}
+	if !h.cfg.InstallScripts {
+		args = append(args, "--ignore-scripts")
+	}
+	switch h.cfg.InstallMode {
+	case installFrozen:
+		if _, err := os.Stat(filepath.Join(dir, "bun.lock")); err == nil {
+			args = append(args, "--frozen-lockfile")
+		}
+		fallthrough
+	case installNoSave:
+		args = append(args, "--no-save")
+	case installSave:
+		if len(packages) > 0 {
+			args = append(args, "--save")
+		}
+	}
+	for _, pkg := range packages {
+		if version, ok := h.cfg.Pins[pkg]; ok {
+			pkg += "@" + version
+		}
+		args = append(args, pkg)
+	}
+	cmd := exec.CommandContext(ctx, h.cfg.BunBin, args...)
+	cmd.Dir = dir
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stdout
+	err := h.run(cmd, &stdout)
+	if err != nil {
+		var limitErr *limitError
+		if errors.As(err, &limitErr) {
+			return newBuildError(kindInstall, "bun install "+limitErr.Error()+"\n"+h.redactSecrets(stdout.String()), err)
+		}
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			output := h.redactSecrets(stdout.String())
+			status, reason := classifyInstallFailure(output)
+			msg := "bun install failed"
+			if len(packages) > 0 {
+				msg += " for " + strings.Join(packages, ", ")
+			}
+			return &buildError{kind: kindInstall, status: status, msg: msg + ": " + reason + "\n" + output, err: exitErr}
+		}
+		return newBuildError(kindInstall, "bun install failed: "+err.Error(), err)
+	}
+	return nil
+}
+
+// packageName strips the subpath from an import path like
+// @scope/pkg/sub, leaving the package name.
+func packageName(path string) string {
+	parts := strings.SplitN(path, "/", 3)
+	if strings.HasPrefix(path, "@") && len(parts) > 1 {
+		return parts[0] + "/" + parts[1]
+	}
+	return parts[0]
+}
+
+// inNodePaths reports whether pkg is installed in one of the configured
+// node paths.
+func (h *handler) inNodePaths(pkg string) bool {
+	for _, dir := range h.cfg.BuildOptions.NodePaths {
+		if _, err := os.Stat(filepath.Join(dir, pkg, "package.json")); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// installFailures maps signatures found in bun install output to a
+// response status and an explanation. The first match wins.
+var installFailures = []struct {
+	pattern *regexp.Regexp
+	status  int
+	reason  string
+}{
+	{regexp.MustCompile(`(?i)(\b40[13]\b|unauthorized|forbidden|authentication)`), http.StatusBadGateway,
+		"the registry requires authentication for one of the packages"},
+	{regexp.MustCompile(`(?i)(\b404\b|not found|no version matching)`), http.StatusNotFound,
+		"a package could not be found on the registry"},
+	{regexp.MustCompile(`(?i)(ECONNREFUSED|ECONNRESET|ETIMEDOUT|ENOTFOUND|ConnectionRefused|ConnectionClosed|timed? ?out|network|\b5[0-9]{2}\b)`), http.StatusBadGateway,
+		"the package registry could not be reached"},
+}
+
+// classifyInstallFailure inspects bun install output to pick a response
+// status and a human readable reason for the failure.
+func classifyInstallFailure(output string) (int, string) {
+	for _, f := range installFailures {
+		if f.pattern.MatchString(output) {
+			return f.status, f.reason
+		}
+	}
+	return http.StatusInternalServerError, "dependency installation failed"
+}
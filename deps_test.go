@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeInstaller returns a handler whose bunx depcheck reports the package
+// the entry imports from as missing, and whose bun install writes it to
+// node_modules as a module exporting its own name, saving it to
+// package.json like --save does.
+func fakeInstaller(t *testing.T, cfg Config) *handler {
+	t.Helper()
+	bin := t.TempDir()
+	cfg.BunxBin = writeScript(t, bin, "bunx", `pkg=$(sed -n 's/.*from "\([^"]*\)".*/\1/p' "$3")
+echo "{\"missing\":{\"$pkg\":[\"$3\"]}}"
+exit 255
+`)
+	cfg.BunBin = writeScript(t, bin, "bun", `for pkg; do
+	case $pkg in
+	-*|install) ;;
+	*)
+		mkdir -p "node_modules/$pkg"
+		echo "export default \"$pkg\";" > "node_modules/$pkg/index.js"
+		echo "{\"name\":\"$pkg\",\"main\":\"index.js\"}" > "node_modules/$pkg/package.json"
+		sed -i "s/\"dependencies\": {/\"dependencies\": {\"$pkg\": \"1.0.0\",/" package.json
+		;;
+	esac
+done
+# Long enough for concurrent installs to overlap
+sleep 0.2
+`)
+	return newTestHandler(t, cfg)
+}
+
+func TestConcurrentInstallsStayApart(t *testing.T) {
+	upstream := newTestUpstream(t, map[string]string{
+		"/a.ts": "import name from \"pkg-alpha\";\nexport default name;\n",
+		"/b.ts": "import name from \"pkg-beta\";\nexport default name;\n",
+	})
+	h := fakeInstaller(t, Config{})
+	root, err := os.ReadFile("package.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"/a.ts": "pkg-alpha", "/b.ts": "pkg-beta"}
+	got := map[string]string{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for path := range want {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := get(t, h, "/"+upstream.URL+path, "Accept", "application/json")
+			mu.Lock()
+			defer mu.Unlock()
+			if rec.Code != http.StatusOK {
+				t.Errorf("%s: status = %d\n%s", path, rec.Code, rec.Body)
+			}
+			got[path] = rec.Body.String()
+		}()
+	}
+	wg.Wait()
+	_ = h.waitForBuilds(context.Background())
+
+	for path, pkg := range want {
+		if !strings.Contains(got[path], pkg) {
+			t.Errorf("%s: bundle doesn't include %s:\n%s", path, pkg, got[path])
+		}
+		for other, otherPkg := range want {
+			if other != path && strings.Contains(got[path], otherPkg) {
+				t.Errorf("%s: bundle includes %s, installed for %s:\n%s", path, otherPkg, other, got[path])
+			}
+		}
+	}
+	// Installs saved into the builds' copies of the project files
+	if after, _ := os.ReadFile("package.json"); !bytes.Equal(after, root) {
+		t.Errorf("installs changed the project's package.json:\n%s", after)
+	}
+}
+
+func TestDepcheckExitCodes(t *testing.T) {
+	upstream := newTestUpstream(t, map[string]string{
+		"/mod.ts": "import name from \"pkg-alpha\";\nexport default name;\n",
+	})
+
+	// 255 is how depcheck reports missing dependencies, the build goes on
+	// to install them
+	h := fakeInstaller(t, Config{})
+	rec := get(t, h, "/"+upstream.URL+"/mod.ts", "Accept", "application/json")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "pkg-alpha") {
+		t.Fatalf("depcheck exiting 255: status = %d\n%s", rec.Code, rec.Body)
+	}
+
+	// Other codes fail the build unless configured
+	h = fakeInstaller(t, Config{})
+	h.cfg.BunxBin = writeScript(t, t.TempDir(), "bunx", "echo '{\"missing\":{}}'\necho crashed >&2\nexit 2\n")
+	rec = get(t, h, "/"+upstream.URL+"/mod.ts", "Accept", "application/json")
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("depcheck exiting 2: status = %d, want 500\n%s", rec.Code, rec.Body)
+	}
+	if msg, _ := decodeError(t, rec)["error"].(string); !strings.HasPrefix(msg, "Depcheck failed") || !strings.Contains(msg, "crashed") {
+		t.Errorf("depcheck exiting 2: error = %q", msg)
+	}
+
+	h = fakeInstaller(t, Config{DepcheckExitCodes: []int{2, 255}})
+	h.cfg.BunxBin = writeScript(t, t.TempDir(), "bunx", "echo '{\"missing\":{\"pkg-alpha\":[]}}'\nexit 2\n")
+	if rec := get(t, h, "/"+upstream.URL+"/mod.ts"); rec.Code != http.StatusOK {
+		t.Errorf("depcheck exiting an accepted 2: status = %d\n%s", rec.Code, rec.Body)
+	}
+}
+
+func TestPackageName(t *testing.T) {
+	for spec, want := range map[string]string{
+		"react":               "react",
+		"react-dom/client":    "react-dom",
+		"lodash/fp/get":       "lodash",
+		"@scope/pkg":          "@scope/pkg",
+		"@scope/pkg/sub":      "@scope/pkg",
+		"@scope/pkg/sub/deep": "@scope/pkg",
+	} {
+		if got := packageName(spec); got != want {
+			t.Errorf("packageName(%q) = %q, want %q", spec, got, want)
+		}
+	}
+}
+
+func TestInstallArguments(t *testing.T) {
+	upstream := newTestUpstream(t, map[string]string{"/mod.ts": "import \"react\";\n"})
+	bin := t.TempDir()
+	missing := `{"missing":{"lodash/fp":[],"lodash/get":[],"@scope/pkg/sub":[],"@scope/pkg":[],"react":[]}}`
+	for mode, want := range map[string]string{
+		installSave:   "install --ignore-scripts --save @scope/pkg lodash react",
+		installNoSave: "install --ignore-scripts --no-save @scope/pkg lodash react",
+		// The project files copied into the build include a bun.lock
+		installFrozen: "install --ignore-scripts --frozen-lockfile --no-save @scope/pkg lodash react",
+	} {
+		args := filepath.Join(bin, mode+".args")
+		h := newTestHandler(t, Config{
+			InstallMode: mode,
+			BunxBin:     writeScript(t, bin, "bunx", "echo '"+missing+"'\nexit 255\n"),
+			BunBin:      writeScript(t, bin, "bun-"+mode, `echo "$@" > `+args+"\n"),
+		})
+		// The packages aren't really installed, so the build itself fails
+		_ = get(t, h, "/"+upstream.URL+"/mod.ts", "Accept", "application/json")
+		got, err := os.ReadFile(args)
+		if err != nil {
+			t.Fatalf("%s: bun install didn't run: %v", mode, err)
+		}
+		if strings.TrimSpace(string(got)) != want {
+			t.Errorf("%s: bun %s, want bun %s", mode, strings.TrimSpace(string(got)), want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// emergencyEvictShare is the share of the disk cache, in bytes, removed
+// oldest entries first when a write finds the disk full. Freeing more than
+// the write needs keeps the next builds from hitting the limit at once.
+const emergencyEvictShare = 0.1
+
+// isDiskFull reports whether err is a write failing for lack of space.
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// evicter is implemented by caches that can make room when their storage
+// is full.
+type evicter interface {
+	// evictOldest removes the cache entries written longest ago, with all
+	// their files, until at least size bytes are freed. It returns the
+	// names of the files removed.
+	evictOldest(size int64) (names []string, freed int64, err error)
+}
+
+// putCacheFile stores data in the cache under name. A write that finds the
+// disk full evicts the oldest entries and is retried once, for backends
+// that can evict.
+func (h *handler) putCacheFile(name string, data []byte) error {
+	err := h.cache.Put(name, data)
+	if !isDiskFull(err) {
+		return err
+	}
+	var backend Cache = h.cache
+	if checked, ok := backend.(checkedCache); ok {
+		backend = checked.Cache
+	}
+	ev, ok := backend.(evicter)
+	if !ok {
+		slog.Error("cache storage is full", "name", name, "error", err)
+		return err
+	}
+	// Concurrent writes failing together only evict once
+	h.evictMu.Lock()
+	defer h.evictMu.Unlock()
+	if err = h.cache.Put(name, data); !isDiskFull(err) {
+		return err
+	}
+	slog.Error("cache disk is full, evicting the oldest entries", "dir", h.cfg.CacheDir, "name", name, "error", err)
+	names, freed, evictErr := ev.evictOldest(int64(len(data)))
+	for _, evicted := range names {
+		h.hot.invalidate(evicted)
+	}
+	h.metrics.emergencyEvictions.Add(1)
+	slog.Warn("emergency eviction finished", "files", len(names), "bytes", freed, "error", evictErr)
+	if err = h.cache.Put(name, data); isDiskFull(err) {
+		slog.Error("cache disk is still full after evicting", "dir", h.cfg.CacheDir, "name", name, "error", err)
+	}
+	return err
+}
+
+// evictOldest removes whole cache entries by the time their bundle was
+// written, oldest first, until it has freed size bytes or a tenth of the
+// cache, whichever is more. Entries whose bundle isn't written yet are
+// being built, and are left alone. Content address pointers to removed
+// entries are left to dangle, and answer as missing.
+func (c *diskCache) evictOldest(size int64) ([]string, int64, error) {
+	type entry struct {
+		written time.Time
+		paths   []string
+		names   []string
+		size    int64
+	}
+	entries := map[string]*entry{}
+	var total int64
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == contentDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := d.Name()
+		if !cacheFilePattern.MatchString(name) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		hash := name[:20]
+		e := entries[hash]
+		if e == nil {
+			e = &entry{}
+			entries[hash] = e
+		}
+		e.paths, e.names = append(e.paths, path), append(e.names, name)
+		e.size += info.Size()
+		total += info.Size()
+		if name == hash {
+			e.written = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	size = max(size, int64(float64(total)*emergencyEvictShare))
+
+	var oldest []*entry
+	for _, e := range entries {
+		if !e.written.IsZero() {
+			oldest = append(oldest, e)
+		}
+	}
+	slices.SortFunc(oldest, func(a, b *entry) int { return a.written.Compare(b.written) })
+	var names []string
+	var freed int64
+	for _, e := range oldest {
+		if freed >= size {
+			break
+		}
+		for i, path := range e.paths {
+			if err := os.Remove(path); err == nil {
+				names = append(names, e.names[i])
+			}
+		}
+		freed += e.size
+	}
+	return names, freed, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// unsafeFilenameChars are replaced in download filenames, which end up in
+// a quoted header parameter and on users' disks.
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9@._-]+`)
+
+// downloadFilename derives the name a bundle built from sourceURL is saved
+// as: the last segment of its path with a .js extension, or bundle.js.
+func downloadFilename(sourceURL string) string {
+	name := "bundle"
+	if u, err := url.Parse(sourceURL); err == nil {
+		base := path.Base(u.Path)
+		base = strings.TrimSuffix(base, path.Ext(base))
+		base = strings.Trim(unsafeFilenameChars.ReplaceAllString(base, "_"), "._")
+		if base != "" {
+			name = base
+		}
+	}
+	return name + ".js"
+}
+
+// setDownload asks browsers to save the bundle for r as a file with
+// ?download=true, instead of displaying it. Errors are still shown, and
+// the metafile, analysis, manifest and wrapped
+// bundles are left alone.
+func setDownload(w http.ResponseWriter, r *http.Request, sourceURL string) {
+	query := r.URL.Query()
+	if query.Get("download") != "true" || query.Get("meta") == "true" || query.Get("analyze") == "true" || query.Get("manifest") == "true" || query.Get("wrap") != "" {
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+downloadFilename(sourceURL)+`"`)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envString returns the value of the environment variable name, or def if
+// it is unset or empty.
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envList splits a comma separated environment variable into its trimmed,
+// non-empty entries.
+func envList(name string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// envMap parses a comma separated list of key=value pairs, exiting on
+// malformed entries.
+func envMap(name string) map[string]string {
+	m := map[string]string{}
+	for _, entry := range envList(name) {
+		k, v, ok := strings.Cut(entry, "=")
+		if k, v = strings.TrimSpace(k), strings.TrimSpace(v); !ok || k == "" || v == "" {
+			log.Panicf("Invalid %s entry %q, expected key=value", name, entry)
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// envDuration parses a time.ParseDuration formatted environment variable,
+// exiting on malformed values.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Panicf("Invalid %s %q: %v", name, v, err)
+	}
+	return d
+}
+
+// envBool parses a strconv.ParseBool formatted environment variable,
+// exiting on malformed values.
+func envBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Panicf("Invalid %s %q: %v", name, v, err)
+	}
+	return b
+}
+
+// envInt64 parses an integer environment variable, exiting on malformed
+// values.
+func envInt64(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Panicf("Invalid %s %q: %v", name, v, err)
+	}
+	return n
+}
+
+// envIntList parses a comma separated list of integers, exiting on
+// malformed values.
+func envIntList(name string) []int {
+	var list []int
+	for _, v := range envList(name) {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Panicf("Invalid %s %q: %v", name, v, err)
+		}
+		list = append(list, n)
+	}
+	return list
+}
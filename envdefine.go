@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+)
+
+// envNamePattern matches the environment variable names that can be
+// defined in bundles.
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// envDefines returns the Define entries that replace process.env.NAME with
+// the value of each environment variable in names, as a string literal.
+// Only variables named explicitly are read, so secrets in the environment
+// can't end up in bundles by accident. Unset variables are returned in
+// missing and left undefined.
+func envDefines(names []string) (defines map[string]string, missing []string, err error) {
+	defines = map[string]string{}
+	for _, name := range names {
+		if !envNamePattern.MatchString(name) {
+			return nil, nil, fmt.Errorf("invalid environment variable name %q", name)
+		}
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		defines["process.env."+name] = string(b)
+	}
+	return defines, missing, nil
+}
+
+// envDefinesFingerprint returns a stable string identifying defines, so
+// that changing a variable invalidates the bundles it was defined in.
+func envDefinesFingerprint(defines map[string]string) string {
+	if len(defines) == 0 {
+		return ""
+	}
+	hasher := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(defines)) {
+		fmt.Fprintf(hasher, "%s\x00%s\x00", name, defines[name])
+	}
+	return fmt.Sprintf("env:%x", hasher.Sum(nil))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// errorKind is the step of answering a request that failed. It decides
+// the response status, unless the error asks for a more specific one.
+type errorKind int
+
+const (
+	kindInternal errorKind = iota
+	kindBadRequest
+	kindFetch
+	kindInstall
+	kindBuild
+	kindTimeout
+	kindTooLarge
+	kindUnavailable
+	kindForbidden
+)
+
+var errorKinds = []struct {
+	name   string
+	status int
+}{
+	kindInternal:    {"internal", http.StatusInternalServerError},
+	kindBadRequest:  {"bad_request", http.StatusBadRequest},
+	kindFetch:       {"fetch", http.StatusBadGateway},
+	kindInstall:     {"install", http.StatusInternalServerError},
+	kindBuild:       {"build", http.StatusInternalServerError},
+	kindTimeout:     {"timeout", http.StatusGatewayTimeout},
+	kindTooLarge:    {"too_large", http.StatusRequestEntityTooLarge},
+	kindUnavailable: {"unavailable", http.StatusServiceUnavailable},
+	kindForbidden:   {"forbidden", http.StatusForbidden},
+}
+
+func (k errorKind) String() string { return errorKinds[k].name }
+
+// buildError is a failure to fetch, build or serve a bundle, carried up to
+// sendError to be answered with.
+type buildError struct {
+	kind errorKind
+	// status overrides the status of kind, like 404 for fetches of files
+	// missing upstream. Zero keeps it.
+	status int
+	// msg explains the failure to the client, and err is what caused it.
+	msg string
+	err error
+	// messages are the esbuild or tsc errors a build failed with, if any,
+	// for clients that want them structured rather than formatted in msg.
+	messages []api.Message
+}
+
+func newBuildError(kind errorKind, msg string, err error) *buildError {
+	return &buildError{kind: kind, msg: msg, err: err}
+}
+
+func (e *buildError) Error() string { return e.msg }
+func (e *buildError) Unwrap() error { return e.err }
+
+// statusCode returns the status e is answered with.
+func (e *buildError) statusCode() int {
+	if e.status >= 400 {
+		return e.status
+	}
+	return errorKinds[e.kind].status
+}
+
+// detail returns the underlying cause of e, or its message without one.
+func (e *buildError) detail() string {
+	if e.err == nil {
+		return e.msg
+	}
+	return e.err.Error()
+}
+
+// errorMessage is an esbuild message as JSON error responses report it.
+type errorMessage struct {
+	Text     string `json:"text"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	LineText string `json:"lineText,omitempty"`
+}
+
+func errorMessages(msgs []api.Message) []errorMessage {
+	out := make([]errorMessage, len(msgs))
+	for i, m := range msgs {
+		out[i].Text = m.Text
+		if m.Location != nil {
+			out[i].File, out[i].Line, out[i].Column, out[i].LineText = m.Location.File, m.Location.Line, m.Location.Column, m.Location.LineText
+		}
+	}
+	return out
+}
+
+// asBuildError returns err as a *buildError. A passed deadline is a
+// timeout, and anything else unclassified an internal error.
+func asBuildError(err error) *buildError {
+	var be *buildError
+	if errors.As(err, &be) {
+		return be
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return newBuildError(kindTimeout, "Request took longer than this server allows", err)
+	}
+	return newBuildError(kindInternal, err.Error(), err)
+}
+
+// sendError answers r with err, with the status of its kind. The error is
+// rendered as a page for browsers navigating to the URL, as JSON for API
+// clients, and otherwise as a script logging it to the console.
+func sendError(w http.ResponseWriter, r *http.Request, err error) {
+	be := asBuildError(err)
+	status := be.statusCode()
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Del("Content-Disposition")
+	w.Header().Set("X-Error-Kind", be.kind.String())
+	switch errorFormat(r) {
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		_, _ = fmt.Fprintf(w, errorPage, status, http.StatusText(status), html.EscapeString(be.msg), html.EscapeString(be.detail()))
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		body := map[string]any{"status": status, "kind": be.kind.String(), "error": be.msg, "detail": be.detail()}
+		if len(be.messages) > 0 {
+			body["messages"] = errorMessages(be.messages)
+		}
+		_ = json.NewEncoder(w).Encode(body)
+	default:
+		w.Header().Set("Content-Type", "application/javascript")
+		w.WriteHeader(status)
+		v, _ := json.Marshal(be.msg)
+		_, _ = w.Write([]byte(fmt.Sprintf(`console.error(%s);`, v)))
+		_, _ = w.Write([]byte(fmt.Sprintf(`console.error(%q)`, be.detail())))
+	}
+}
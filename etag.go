@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// What ETags are derived from, set by Config.ETagHash.
+const (
+	// etagShort is the truncated content hash bundles are addressed by,
+	// which compressed cache files and the hot cache already record, so
+	// only plain files read from disk are hashed again.
+	etagShort = "short"
+	// etagFull is the whole SHA-256 of the content, hashed on every read
+	// from disk.
+	etagFull = "full"
+	// etagFile is the cache file's name, size and modification time, so
+	// nothing is hashed. It changes whenever the file is rewritten, even
+	// with the same content.
+	etagFile = "file"
+)
+
+var etagHashes = []string{etagShort, etagFull, etagFile}
+
+// fileSum returns what the ETag of the cache file name, holding data, is
+// made from.
+func (h *handler) fileSum(name string, data []byte) (string, error) {
+	switch h.cfg.ETagHash {
+	case etagFull:
+		if isGzip(data) {
+			var err error
+			if data, err = gunzip(data); err != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+	case etagFile:
+		info, err := h.cache.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s-%x-%x", name, info.Size, info.ModTime.UnixNano()), nil
+	}
+	return cacheFileSum(data)
+}
+
+// bundleSum is fileSum for a bundle served straight after building it.
+// With etagFile bundles are written before they are served instead.
+func (h *handler) bundleSum(bundle []byte) string {
+	if h.cfg.ETagHash == etagFull {
+		return fmt.Sprintf("%x", sha256.Sum256(bundle))
+	}
+	return contentHash(bundle)
+}
+
+// etag returns the ETag of a response whose content sum is sum, sent with
+// encoding. Each encoding gets its own strong ETag, or they share a weak
+// one with Config.WeakCompressedETags, since the bytes differ but mean the
+// same thing.
+func (h *handler) etag(sum, encoding string) string {
+	switch {
+	case encoding == "":
+		return `"` + sum + `"`
+	case h.cfg.WeakCompressedETags:
+		return `W/"` + sum + `"`
+	}
+	return `"` + sum + "-" + encoding + `"`
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// eventBufferSize is how many events a subscriber can fall behind by
+// before it misses some.
+const eventBufferSize = 64
+
+// eventKeepAlive is how often idle event streams get a comment, so
+// proxies don't close them.
+const eventKeepAlive = 15 * time.Second
+
+// eventBroker fans build lifecycle events out to the clients of /events.
+// Events are dropped for subscribers that don't keep up rather than
+// holding up builds.
+type eventBroker struct {
+	mu   sync.Mutex
+	subs map[chan map[string]any]struct{}
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subs: map[chan map[string]any]struct{}{}}
+}
+
+func (b *eventBroker) subscribe() chan map[string]any {
+	ch := make(chan map[string]any, eventBufferSize)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[ch] = struct{}{}
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan map[string]any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, ch)
+}
+
+// publish sends the event named event to every subscriber. args are
+// key-value pairs like slog's, with durations converted to milliseconds.
+// The request ID and the URL being built are added from ctx.
+func (b *eventBroker) publish(ctx context.Context, event string, args ...any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.subs) == 0 {
+		return
+	}
+	e := map[string]any{"event": event, "time": time.Now().UTC()}
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		e["requestID"] = id
+	}
+	if u, ok := ctx.Value(eventURLKey{}).(string); ok {
+		e["url"] = u
+	}
+	for i := 0; i+1 < len(args); i += 2 {
+		key := fmt.Sprint(args[i])
+		if d, ok := args[i+1].(time.Duration); ok {
+			e[key] = float64(d) / float64(time.Millisecond)
+			continue
+		}
+		e[key] = args[i+1]
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+type eventURLKey struct{}
+
+// withEventURL records the URL a request builds, for the events it
+// publishes.
+func withEventURL(ctx context.Context, url string) context.Context {
+	return context.WithValue(ctx, eventURLKey{}, url)
+}
+
+// logEvent logs msg with args, and publishes the same as event.
+func (h *handler) logEvent(ctx context.Context, event, msg string, args ...any) {
+	logger(ctx).Info(msg, args...)
+	h.events.publish(ctx, event, args...)
+}
+
+// serveEvents streams build lifecycle events to /events as Server-Sent
+// Events, for dashboards watching builds as they happen. Each event's
+// data is a JSON object with the event name, time, request ID, the URL
+// being built and the attributes its log line has, durations in
+// milliseconds. The events are fetch_started, fetch_finished, cache_hit,
+// cache_revalidated, cache_miss, negative_cache_hit, install_started,
+// install_finished, build_finished, build_failed and build_abandoned.
+// Streams end when the client goes away, or at REQUEST_TIMEOUT, after
+// which EventSource clients reconnect by themselves.
+func (h *handler) serveEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// Streams outlast the server's write timeout
+	_ = rc.SetWriteDeadline(time.Time{})
+	ch := h.events.subscribe()
+	defer h.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case e := <-ch:
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e["event"], data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// doFallback sends an upstream request, retrying it against the mirror configured
+// for its host in HostFallbacks if the host fails. If the mirror fails too,
+// the primary's failure is returned. resp.Request tells which answered.
+func (h *handler) doFallback(req *http.Request) (*http.Response, error) {
+	resp, err := h.doHost(req)
+	mirror, ok := h.cfg.HostFallbacks[req.URL.Host]
+	if !ok || (err == nil && resp.StatusCode < 500) {
+		return resp, err
+	}
+	log := logger(req.Context())
+	if err != nil {
+		log.Warn("upstream fetch failed, trying mirror", "host", req.URL.Host, "mirror", mirror, "error", err)
+	} else {
+		log.Warn("upstream fetch failed, trying mirror", "host", req.URL.Host, "mirror", mirror, "status", resp.StatusCode)
+	}
+	mirrorReq := req.Clone(req.Context())
+	mirrorReq.URL.Host = mirror
+	mirrorReq.Host = ""
+	mirrorResp, mirrorErr := h.doHost(mirrorReq)
+	if mirrorErr != nil || mirrorResp.StatusCode >= 500 {
+		closeBody(mirrorResp)
+		return resp, err
+	}
+	log.Info("fetched from mirror", "url", mirrorReq.URL.String())
+	closeBody(resp)
+	return mirrorResp, nil
+}
+
+// canonicalURL rewrites rawURL from a mirror to its primary host, so that
+// requests through either share a cache entry.
+func (h *handler) canonicalURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	for primary, mirror := range h.cfg.HostFallbacks {
+		if u.Host == mirror {
+			u.Host = primary
+			return u.String()
+		}
+	}
+	return rawURL
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// fetchLimiter bounds how many upstream fetches are in flight at once. A
+// fetch holds its slot until its response body is read to the end or
+// closed, so a slow upstream can't be worked around by sending headers
+// early. A zero limit only counts them.
+type fetchLimiter struct {
+	slots    chan struct{}
+	inFlight atomic.Int64
+	waiting  atomic.Int64
+}
+
+func newFetchLimiter(limit int) *fetchLimiter {
+	l := &fetchLimiter{}
+	if limit > 0 {
+		l.slots = make(chan struct{}, limit)
+	}
+	return l
+}
+
+// acquire waits for a free slot until ctx is done, and returns the func
+// giving it back.
+func (l *fetchLimiter) acquire(ctx context.Context) (func(), error) {
+	if l.slots != nil {
+		l.waiting.Add(1)
+		select {
+		case l.slots <- struct{}{}:
+			l.waiting.Add(-1)
+		case <-ctx.Done():
+			l.waiting.Add(-1)
+			return nil, ctx.Err()
+		}
+	}
+	l.inFlight.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.inFlight.Add(-1)
+			if l.slots != nil {
+				<-l.slots
+			}
+		})
+	}, nil
+}
+
+// writeMetrics writes how many fetches are in flight and waiting.
+func (l *fetchLimiter) writeMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP upstream_fetches_in_flight Upstream fetches currently in flight.")
+	fmt.Fprintln(w, "# TYPE upstream_fetches_in_flight gauge")
+	fmt.Fprintf(w, "upstream_fetches_in_flight %d\n", l.inFlight.Load())
+	fmt.Fprintln(w, "# HELP upstream_fetches_waiting Upstream fetches waiting for MAX_CONCURRENT_FETCHES.")
+	fmt.Fprintln(w, "# TYPE upstream_fetches_waiting gauge")
+	fmt.Fprintf(w, "upstream_fetches_waiting %d\n", l.waiting.Load())
+}
+
+// limitedBody releases a fetch's slot once its body is done with.
+type limitedBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.release()
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	b.release()
+	return b.ReadCloser.Close()
+}
+
+// do sends an upstream request once the fetch limiter lets it, with the
+// fallbacks of doFallback.
+func (h *handler) do(req *http.Request) (*http.Response, error) {
+	release, err := h.fetches.acquire(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.doFallback(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &limitedBody{resp.Body, release}
+	return resp, nil
+}
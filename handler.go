@@ -0,0 +1,1989 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/evanw/esbuild/pkg/api"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Config configures the bundling handler.
+type Config struct {
+	// CacheDir is the directory built bundles are stored in.
+	CacheDir string
+	// CacheShardDepth is how many levels of subdirectories cache files are
+	// spread over by hash prefix, up to maxShardDepth. Zero keeps them all
+	// in CacheDir.
+	CacheShardDepth int
+	// Cache is where built bundles are stored instead of CacheDir, if set.
+	Cache Cache
+	// BuildTmpDir is where build directories are created, the OS temp
+	// directory if empty. Installs can be large, so it is worth pointing
+	// at a volume bigger than a tmpfs /tmp.
+	BuildTmpDir string
+	// ProjectRoot is the directory package.json, bun.lock and tsconfig.json
+	// are copied into each build from.
+	ProjectRoot string
+	// NegativeCacheTTL is how long build failures are remembered. Zero
+	// disables negative caching.
+	NegativeCacheTTL time.Duration
+	// TrustProxy enables X-Forwarded-Proto and X-Forwarded-Host when
+	// building absolute URLs that point back at this service.
+	TrustProxy bool
+	// UserAgent is sent with every upstream fetch.
+	UserAgent string
+	// ForwardHeaders lists client request headers that are passed through
+	// to upstream fetches, e.g. Authorization for private sources. Nothing
+	// is forwarded unless listed here. Bundles fetched with any of them set
+	// are cached apart for each of their values, and served as private.
+	ForwardHeaders []string
+	// IgnoredQueryParams are dropped from requests before fetching and
+	// keying the cache, e.g. cache-busting nonces added by clients.
+	IgnoredQueryParams []string
+	// ForwardQuery is which of the remaining query params are forwarded
+	// upstream: forwardAll, the default, forwardNone, or forwardAllowlist
+	// for only those in ForwardQueryParams. Upstreams that redirect to
+	// URLs with a query of their own need forwardAll, or the redirect's
+	// params would be dropped too.
+	ForwardQuery       string
+	ForwardQueryParams []string
+	// URLRewrites turn requested URLs into the ones fetched, e.g. GitHub
+	// blob pages into raw files. Nil uses defaultURLRewrites.
+	URLRewrites []urlRewrite
+	// Pins maps package names to the versions missing dependencies are
+	// installed at. Without a pin the latest version is installed.
+	Pins map[string]string
+	// Shims are the files builds can inject, by file name. The config file
+	// and ?inject= pick which.
+	Shims map[string][]byte
+	// Templates are the sets of project files ?template= can pick for a
+	// build instead of ProjectRoot's, by name.
+	Templates map[string]projectTemplate
+	// ContentAddressedRedirect redirects bundle requests to the immutable
+	// /_b/<content hash> URL of the bundle rather than serving it directly.
+	ContentAddressedRedirect bool
+	// CompressCache stores cache entries gzip compressed on disk.
+	CompressCache bool
+	// CompressResponses serves cache files brotli or gzip compressed to
+	// clients accepting it, see compression.go.
+	CompressResponses bool
+	// CompressionLevels are the levels both are compressed at. Zero uses
+	// the balanced preset.
+	CompressionLevels compressionLevels
+	// BuildOptions are the base esbuild options for every build. Entry
+	// points, output paths and per-request options are filled in by the
+	// handler.
+	BuildOptions api.BuildOptions
+	// BuildConfigFingerprint identifies the configured BuildOptions so that
+	// changing them invalidates cached bundles.
+	BuildConfigFingerprint string
+	// EnvDefines are the Define entries for environment variables, from
+	// envDefines. Entries the configured BuildOptions already define are
+	// left as they are.
+	EnvDefines map[string]string
+	// CacheSalt is mixed into every cache key. Changing it is the way to
+	// force every bundle to be rebuilt without flushing the cache. Keys
+	// also cover the esbuild version and built-in build options, so
+	// upgrading either does the same on its own.
+	CacheSalt string
+	// RevalidateAfter is how long a cached bundle is served before its
+	// source is revalidated against the upstream. Zero only revalidates
+	// requests with ?revalidate=true.
+	RevalidateAfter time.Duration
+	// HotCacheEntries and HotCacheBytes bound the in-memory cache of the
+	// most recently served cache files. Zero disables it.
+	HotCacheEntries int
+	HotCacheBytes   int64
+	// MaxBundleBytes is the largest bundle that is cached and served. Zero
+	// means no limit.
+	MaxBundleBytes int64
+	// AllowedSchemes lists the URL schemes that may be fetched. Empty
+	// allows http and https. Schemes other than those need a transport
+	// registered with the HTTP client.
+	AllowedSchemes []string
+	// SelfTest checks bun and builds a snippet at startup, and reports the
+	// service as not ready until it succeeds, or for good if it fails.
+	SelfTest bool
+	// WarmupURLs are request paths, like /https://example.com/mod.ts,
+	// built at startup after the self-test. Requests are refused with 503
+	// until warmup completes.
+	WarmupURLs []string
+	// DevMode rebuilds every bundle requested by URL instead of serving
+	// it from the cache, and tells clients not to cache responses, so
+	// edits upstream show up on reload. Sourcemaps default to inline, and
+	// ?sourcemap= still overrides that.
+	DevMode bool
+	// StaleAfter is how long after its source was last validated a cached
+	// bundle is served without contacting the upstream. Past that it is
+	// still served straight away, but revalidated in the background. Zero
+	// disables stale-while-revalidate.
+	StaleAfter time.Duration
+	// SlowBuildThreshold is how long a build can take before it is logged
+	// as slow. Zero disables the warning.
+	SlowBuildThreshold time.Duration
+	// RefreshTop is how many of the most requested bundles are refreshed
+	// in the background every RefreshInterval, once they were last
+	// validated more than RefreshMaxAge ago. Zero disables refreshing.
+	RefreshTop      int
+	RefreshInterval time.Duration
+	RefreshMaxAge   time.Duration
+	// DepcheckExitCodes are the depcheck exit codes that don't fail a
+	// build, besides 0. Empty accepts 255, which depcheck exits with when
+	// it reports missing dependencies.
+	DepcheckExitCodes []int
+	// BunBin and BunxBin are the bun and bunx executables dependencies
+	// are installed with, "bun" and "bunx" on the PATH by default.
+	BunBin  string
+	BunxBin string
+	// BuildMemoryLimit and BuildCPULimit cap the address space, in bytes,
+	// and CPU time of the bun and bunx processes a build runs. Zero leaves
+	// them unlimited. Linux only, see limits.go.
+	BuildMemoryLimit int64
+	BuildCPULimit    time.Duration
+	// InstallScripts lets bun install run packages' lifecycle scripts, and
+	// SandboxUser runs bun and bunx as an unprivileged user. See
+	// sandbox.go.
+	InstallScripts bool
+	// InstallMode is how bun install treats the build directory's
+	// package.json and bun.lock: installSave, the default, installNoSave
+	// or installFrozen.
+	InstallMode string
+	// LenientInstall builds sources even when some of their packages
+	// failed to install, which only fails if the build needed them.
+	LenientInstall bool
+	// DenyPackages are the packages sources may never need, as exact
+	// names or path.Match patterns like "@scope/*". Sources importing any
+	// of them fail with a 403 before anything is installed.
+	DenyPackages []string
+	// ServeLastGood answers requests whose build failed with the last
+	// bundle built for the same URL and options, marked X-Stale, instead
+	// of the error. See lastgood.go.
+	ServeLastGood bool
+	SandboxUser   *sandboxUser
+	// NoInstall is set when bun isn't available. Sources importing only
+	// URLs are still built, but bare imports are refused.
+	NoInstall bool
+	// Npmrc is copied into each build as .npmrc, to authenticate with
+	// private registries. Tokens should be referenced as ${VAR} and set in
+	// the environment rather than written into the file.
+	Npmrc []byte
+	// RootPage replaces the built-in landing page served at /, and
+	// RootRedirect instead redirects / to another URL. At most one is set.
+	RootPage     []byte
+	RootRedirect string
+	// ImportMapTemplate is the URL external packages are mapped to in the
+	// import maps served from /importmap.json, e.g.
+	// "https://esm.sh/{name}@{version}". Empty disables import maps.
+	ImportMapTemplate string
+	// MaxURLLength is the longest request URL accepted, in bytes. Zero
+	// means 4096.
+	MaxURLLength int
+	// MaxBodyBytes is the largest request body accepted, like sources
+	// posted to /build. Larger ones are refused with a 413. Zero means
+	// 10MB.
+	MaxBodyBytes int64
+	// HostFallbacks maps upstream hosts to mirrors that are fetched from
+	// when the host fails, e.g. esm.sh to esm.run. URLs naming a mirror are
+	// rewritten to its primary so both share cache entries.
+	HostFallbacks map[string]string
+	// BreakerThreshold is how many consecutive failed fetches from a host
+	// stop further fetches from it for BreakerCooldown. Zero disables the
+	// circuit breaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// MaxConcurrentFetches limits how many upstream fetches are in flight
+	// at once, including the URL imports of builds. Zero is unlimited.
+	MaxConcurrentFetches int
+	// AdminToken is the bearer token for the /admin/ endpoints, which are
+	// disabled without one.
+	AdminToken string
+	// ReadOnly serves cached bundles but refuses to build anything else,
+	// for riding out outages of upstreams or the registry. It can be
+	// changed at runtime.
+	ReadOnly bool
+	// BuildOptionsHeader sends the options a bundle was built with as
+	// JSON in an X-Build-Options header on the response that built it.
+	// They are always logged at debug level and kept in the entry's
+	// description.
+	BuildOptionsHeader bool
+	// WatchInterval is how often requests with ?watch=true revalidate the
+	// upstream, and WatchTimeout how long they wait for it to change
+	// before answering 304.
+	WatchInterval time.Duration
+	WatchTimeout  time.Duration
+	// FetchTimeout bounds each upstream fetch, including reading its body.
+	// Zero leaves fetches bounded only by the request's deadline.
+	FetchTimeout time.Duration
+	// SRIHeader sends the subresource integrity of bundles in an X-SRI
+	// header. Manifests always include it.
+	SRIHeader bool
+	// VerifyBundles parses every bundle again before it is cached, failing
+	// builds whose output doesn't parse.
+	VerifyBundles bool
+	// MaxSourceBytes is the largest upstream source that is built. Zero
+	// means no limit.
+	MaxSourceBytes int64
+	// ContentKeyHosts are the upstream hosts whose URLs can change
+	// content, so their bundles are cached by source rather than URL. "*"
+	// matches every host.
+	ContentKeyHosts []string
+	// ETagHash is what ETags are derived from: etagShort, the default,
+	// etagFull or etagFile.
+	ETagHash string
+	// WeakCompressedETags gives compressed responses the weak ETag of the
+	// content instead of a strong one per encoding.
+	WeakCompressedETags bool
+	// ServerSettings describes how the server was started, e.g. its listen
+	// address and timeouts, for /admin/config.
+	ServerSettings map[string]string
+}
+
+// defaultBuildOptions returns the esbuild options used when none are
+// configured.
+func defaultBuildOptions() api.BuildOptions {
+	return api.BuildOptions{
+		Bundle:            true,
+		Write:             true,
+		Target:            api.ES2015,
+		Format:            api.FormatESModule,
+		Sourcemap:         api.SourceMapLinked,
+		MinifyWhitespace:  true,
+		MinifyIdentifiers: true,
+		MinifySyntax:      true,
+	}
+}
+
+type handler struct {
+	cfg      Config
+	client   *http.Client
+	negCache *negativeCache
+	hot      *hotCache
+	events   *eventBroker
+	// cache is Config.Cache, or the disk cache in Config.CacheDir.
+	cache Cache
+	// keySalt is mixed into every cache key, and lockSalt into those of
+	// content-keyed builds.
+	keySalt  string
+	lockSalt string
+	// builds tracks in-flight builds so shutdown can wait for them.
+	builds sync.WaitGroup
+	// hits counts requests per URL for background refreshes.
+	hits    *hitCounter
+	breaker *circuitBreaker
+	fetches *fetchLimiter
+	// maxBundleBytes and revalidateAfter hold Config.MaxBundleBytes and
+	// Config.RevalidateAfter, which can be changed at runtime.
+	maxBundleBytes  atomic.Int64
+	revalidateAfter atomic.Int64
+	// readOnly holds Config.ReadOnly, which can also be changed at
+	// runtime.
+	readOnly atomic.Bool
+	// npmrc is Config.Npmrc, and secrets the environment values it
+	// references, which are redacted from install output.
+	npmrc   []byte
+	secrets []string
+	// revalidating holds the cache entries being revalidated in the
+	// background.
+	revalidating sync.Map
+	// evictMu serializes emergency evictions of a full disk cache.
+	evictMu sync.Mutex
+	metrics serviceMetrics
+	stats   serviceStats
+	// ready is set once the service can serve builds, and selfTestErr if
+	// the startup self-test failed, when it never will be.
+	ready       atomic.Bool
+	selfTestErr atomic.Pointer[error]
+	// mkdirTemp creates the directory a build runs in, and returns how to
+	// remove it once the build is done. Nothing depends on its name being
+	// random, so tests can substitute a fixed directory and keep it to
+	// look at what the build left in it.
+	mkdirTemp func() (dir string, cleanup func(), err error)
+}
+
+func newHandler(cfg Config) *handler {
+	if len(cfg.AllowedSchemes) == 0 {
+		cfg.AllowedSchemes = []string{"http", "https"}
+	}
+	if len(cfg.DepcheckExitCodes) == 0 {
+		cfg.DepcheckExitCodes = []int{255}
+	}
+	if cfg.MaxURLLength <= 0 {
+		cfg.MaxURLLength = 4096
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = 10 << 20
+	}
+	cache := cfg.Cache
+	if cache == nil {
+		cache = newDiskCache(cfg.CacheDir, cfg.CacheShardDepth)
+	}
+	if cfg.BunBin == "" {
+		cfg.BunBin = "bun"
+	}
+	if cfg.BunxBin == "" {
+		cfg.BunxBin = "bunx"
+	}
+	if cfg.InstallMode == "" {
+		cfg.InstallMode = installSave
+	}
+	if cfg.WatchInterval <= 0 {
+		cfg.WatchInterval = 2 * time.Second
+	}
+	if cfg.WatchTimeout <= 0 {
+		cfg.WatchTimeout = 30 * time.Second
+	}
+	if cfg.ForwardQuery == "" {
+		cfg.ForwardQuery = forwardAll
+	}
+	if cfg.URLRewrites == nil {
+		cfg.URLRewrites = defaultURLRewrites
+	}
+	// Dev mode bundles carry their sourcemap, so browsers show the original
+	// source without fetching it from /_map/. The default is part of every
+	// cache key, so dev builds sharing a cache directory with production
+	// ones don't collide.
+	var devSalt string
+	if cfg.DevMode {
+		cfg.BuildOptions.Sourcemap = api.SourceMapInline
+		devSalt = "dev-sourcemap:inline"
+	}
+	h := &handler{
+		cfg: cfg,
+		// Redirects are followed manually so the final URL is known
+		client: &http.Client{
+			Transport: newTransport(),
+			Timeout:   cfg.FetchTimeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		negCache: newNegativeCache(cfg.NegativeCacheTTL),
+		hot:      newHotCache(cfg.HotCacheEntries, cfg.HotCacheBytes),
+		events:   newEventBroker(),
+		cache:    checkedCache{cache},
+		hits:     newHitCounter(),
+		breaker:  newCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown),
+		fetches:  newFetchLimiter(cfg.MaxConcurrentFetches),
+		mkdirTemp: func() (string, func(), error) {
+			dir, err := os.MkdirTemp(cfg.BuildTmpDir, "vite-build-*")
+			return dir, func() { _ = os.RemoveAll(dir) }, err
+		},
+		keySalt: toolchainFingerprint() + pinsFingerprint(cfg.Pins) + shimsFingerprint(cfg.Shims) + templatesFingerprint(cfg.Templates) + cfg.BuildConfigFingerprint + envDefinesFingerprint(cfg.EnvDefines) + devSalt + cfg.CacheSalt,
+	}
+	h.ready.Store(!cfg.SelfTest && len(cfg.WarmupURLs) == 0)
+	h.stats.reset()
+	if len(cfg.Npmrc) > 0 {
+		h.npmrc = cfg.Npmrc
+		h.secrets = npmrcSecrets(cfg.Npmrc)
+	}
+	h.maxBundleBytes.Store(cfg.MaxBundleBytes)
+	h.revalidateAfter.Store(int64(cfg.RevalidateAfter))
+	h.readOnly.Store(cfg.ReadOnly)
+	if len(cfg.EnvDefines) > 0 {
+		define := maps.Clone(cfg.EnvDefines)
+		maps.Copy(define, cfg.BuildOptions.Define)
+		h.cfg.BuildOptions.Define = define
+	}
+	if h.cfg.CompressionLevels == (compressionLevels{}) {
+		h.cfg.CompressionLevels = compressionPresets[defaultCompression]
+	}
+	if h.cfg.ETagHash == "" {
+		h.cfg.ETagHash = etagShort
+	}
+	if len(cfg.ContentKeyHosts) > 0 {
+		h.lockSalt = projectFingerprint(cfg.ProjectRoot)
+	}
+	return h
+}
+
+// newTransport returns the transport shared by all upstream fetches. Most
+// fetches go to a handful of CDNs, so more idle connections are kept per
+// host than the default.
+func newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = 100
+	t.MaxIdleConnsPerHost = 16
+	t.IdleConnTimeout = 90 * time.Second
+	return t
+}
+
+// closeBody drains and closes a response body so its connection can be
+// reused.
+func closeBody(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+}
+
+// errorFormat picks how to render an error for r from the first of
+// text/html and application/json listed in its Accept header. Scripts and
+// fetches accept */* and get the console.error script.
+func errorFormat(r *http.Request) string {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, _, _ := strings.Cut(part, ";")
+			switch strings.TrimSpace(mediaType) {
+			case "text/html":
+				return "html"
+			case "application/json":
+				return "json"
+			}
+		}
+	}
+	return "js"
+}
+
+var errorPage = `<!DOCTYPE html>
+<html>
+<head>
+	<title>Bundle failed</title>
+	<style>
+		body { font-family: system-ui; max-width: 800px; margin: 40px auto; padding: 0 20px; line-height: 1.6; }
+		pre { background: #f4f4f4; padding: 10px; border-radius: 4px; overflow-x: auto; }
+	</style>
+</head>
+<body>
+	<h1>%d %s</h1>
+	<pre>%s</pre>
+	<pre>%s</pre>
+</body>
+</html>
+`
+
+// truncate shortens s to at most n bytes, marking the cut with an ellipsis.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+var htmlPage = `
+<!DOCTYPE html>
+<html>
+<head>
+	<title>TypeScript Bundle Service</title>
+	<link rel="icon" href="https://fav.farm/💐">
+	<style>
+		body { font-family: system-ui; max-width: 800px; margin: 40px auto; padding: 0 20px; line-height: 1.6; }
+		pre { background: #f4f4f4; padding: 15px; border-radius: 5px; overflow-x: auto; white-space: pre-wrap; word-break: break-all; }
+		form { display: flex; gap: 8px; }
+		input { flex: 1; font: inherit; padding: 6px; }
+		button { font: inherit; padding: 6px 12px; }
+		dl { display: grid; grid-template-columns: max-content auto; gap: 4px 12px; }
+		dt { font-weight: bold; }
+		dd { margin: 0; word-break: break-all; }
+		.error { color: #b00020; }
+	</style>
+</head>
+<body>
+	<h1>TypeScript Bundle Service</h1>
+	<p>This service bundles TypeScript files into JavaScript. To use it, append a URL to a TypeScript file to this domain.</p>
+	<p>Example usage:</p>
+	<pre>import "<a href="%[1]s/https://deno.land/std@0.224.0/fmt/colors.ts">%[2]s/https://deno.land/std@0.224.0/fmt/colors.ts</a>"</pre>
+	<h2>Try it</h2>
+	<form id="try">
+		<input id="url" type="url" required placeholder="https://example.com/mod.ts" value="https://deno.land/std@0.224.0/fmt/colors.ts">
+		<button>Bundle</button>
+	</form>
+	<div id="result" hidden>
+		<dl>
+			<dt>Status</dt><dd id="status"></dd>
+			<dt>Resolved URL</dt><dd id="resolved"></dd>
+			<dt>Cache</dt><dd id="cache"></dd>
+			<dt>Timing</dt><dd id="timing"></dd>
+			<dt>Size</dt><dd id="size"></dd>
+		</dl>
+		<pre id="output"></pre>
+	</div>
+	<script>
+		const origin = location.origin;
+		document.getElementById("try").addEventListener("submit", async (event) => {
+			event.preventDefault();
+			const show = (id, text) => { document.getElementById(id).textContent = text; };
+			const output = document.getElementById("output");
+			document.getElementById("result").hidden = false;
+			show("status", "building...");
+			["resolved", "cache", "timing", "size"].forEach((id) => show(id, ""));
+			output.textContent = "";
+			const started = performance.now();
+			try {
+				const resp = await fetch(origin + "/" + document.getElementById("url").value);
+				const body = await resp.text();
+				show("status", resp.status + " " + resp.statusText);
+				show("resolved", decodeURI(resp.url).replace(origin + "/", ""));
+				show("cache", resp.headers.get("X-Cache") || "unknown");
+				show("timing", (resp.headers.get("Server-Timing") || "") + " (" + Math.round(performance.now() - started) + "ms total)");
+				show("size", body.length + " bytes");
+				output.className = resp.ok ? "" : "error";
+				output.textContent = body;
+			} catch (err) {
+				show("status", "request failed");
+				output.className = "error";
+				output.textContent = String(err);
+			}
+		});
+	</script>
+</body>
+</html>`
+
+// origin returns the external scheme and host of this service as seen by
+// the client. When the scheme can't be determined the origin is
+// scheme-relative ("//host").
+func (h *handler) origin(r *http.Request) string {
+	scheme, host := "", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if h.cfg.TrustProxy {
+		if proto := firstHeaderValue(r, "X-Forwarded-Proto"); proto != "" {
+			scheme = proto
+		}
+		if fwdHost := firstHeaderValue(r, "X-Forwarded-Host"); fwdHost != "" {
+			host = fwdHost
+		}
+	}
+	if scheme == "" {
+		return "//" + host
+	}
+	return scheme + "://" + host
+}
+
+// firstHeaderValue returns the first entry of a possibly comma separated
+// header, as appended by chains of proxies.
+func firstHeaderValue(r *http.Request, name string) string {
+	v, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(v)
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	counted := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+	defer h.stats.countRequest(counted)
+	w = counted
+
+	// Pathologically long URLs are refused before they reach fetches or
+	// the cache
+	if n := len(r.URL.RequestURI()); n > h.cfg.MaxURLLength {
+		http.Error(w, fmt.Sprintf("URL is %d bytes, over the %d byte limit", n, h.cfg.MaxURLLength), http.StatusRequestURITooLong)
+		return
+	}
+	// So are bodies over the limit, without reading them when they say
+	// so up front
+	if r.ContentLength > h.cfg.MaxBodyBytes {
+		http.Error(w, fmt.Sprintf("Request body is %d bytes, over the %d byte limit", r.ContentLength, h.cfg.MaxBodyBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, h.cfg.MaxBodyBytes)
+
+	// Preflights are answered for every route rather than fetched as URLs
+	if r.Method == http.MethodOptions {
+		servePreflight(w, r)
+		return
+	}
+
+	// Return helpful HTML page if path is empty
+	if r.URL.Path == "/" {
+		if h.cfg.RootRedirect != "" {
+			http.Redirect(w, r, h.cfg.RootRedirect, http.StatusFound)
+			return
+		}
+		if len(h.cfg.RootPage) > 0 {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write(h.cfg.RootPage)
+			return
+		}
+		origin := h.origin(r)
+		display := origin
+		if strings.HasPrefix(display, "//") {
+			display = "https:" + display
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(fmt.Sprintf(htmlPage, origin, display)))
+		return
+	}
+
+	if r.URL.Path == "/metrics" {
+		h.serveMetrics(w, r)
+		return
+	}
+	if r.URL.Path == "/stats" {
+		h.serveStats(w, r)
+		return
+	}
+	if r.URL.Path == "/readyz" {
+		h.serveReady(w, r)
+		return
+	}
+	if r.URL.Path == "/version" {
+		h.serveVersion(w, r)
+		return
+	}
+	// Everything else waits for warmup, so probes above keep working
+	if h.serveWarming(w, r) {
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/_css/") {
+		h.serveCSS(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/_types/") {
+		h.serveTypes(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/_legal/") {
+		h.serveLegal(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/_a/") || strings.HasPrefix(r.URL.Path, "/chunks/") {
+		h.serveAsset(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/_map/") {
+		h.serveSourceMap(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/_b/") {
+		h.serveContentAddressed(w, r)
+		return
+	}
+	if r.URL.Path == "/admin/config" {
+		h.serveAdminConfig(w, r)
+		return
+	}
+	if r.URL.Path == "/admin/stats" {
+		h.serveAdminStats(w, r)
+		return
+	}
+	if r.URL.Path == "/importmap.json" {
+		h.serveImportMap(w, r)
+		return
+	}
+	if r.URL.Path == "/build" {
+		h.serveBuild(w, r)
+		return
+	}
+	if r.URL.Path == "/prefetch" {
+		h.servePrefetch(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/why/") {
+		h.serveWhy(w, r)
+		return
+	}
+	if r.URL.Path == "/events" {
+		h.serveEvents(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/check/") {
+		h.serveCheck(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/resolve/") {
+		h.serveResolve(w, r)
+		return
+	}
+	if r.URL.Query().Get("watch") == "true" {
+		h.serveWatch(w, r)
+		return
+	}
+
+	h.bundle(w, r)
+}
+
+// waitForBuilds blocks until in-flight builds finish or ctx is done.
+func (h *handler) waitForBuilds(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.builds.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// upstreamFailure maps the status of a failed upstream response to the
+// status to answer with, and explains it. Missing files stay missing, so
+// caches and clients keying on status treat them as such, everything else
+// is the upstream's fault.
+func upstreamFailure(code int) (int, string) {
+	switch {
+	case code == http.StatusNotFound || code == http.StatusGone:
+		return http.StatusNotFound, "check the URL points at an existing file"
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return http.StatusBadGateway, "the file isn't public, or this service is blocked from fetching it"
+	case code == http.StatusTooManyRequests:
+		return http.StatusServiceUnavailable, "the upstream is rate limiting this service, retry later"
+	case code >= 500:
+		return http.StatusBadGateway, "the upstream server failed"
+	default:
+		return http.StatusBadGateway, "expected 200 OK"
+	}
+}
+
+// validateUpstreamURL checks that rawURL is an absolute URL with an allowed
+// scheme.
+func (h *handler) validateUpstreamURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %w", rawURL, err)
+	}
+	switch {
+	case u.Scheme == "":
+		return fmt.Errorf("URL %q has no scheme", rawURL)
+	case !slices.Contains(h.cfg.AllowedSchemes, strings.ToLower(u.Scheme)):
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	case u.Host == "":
+		return fmt.Errorf("URL %q has no host", rawURL)
+	}
+	return nil
+}
+
+// fetch requests url from upstream on behalf of r, without following
+// redirects. Any conditional headers are added to the request.
+func (h *handler) fetch(r *http.Request, url string, conditional http.Header) (resp *http.Response, err error) {
+	// Canceled with r, when its client goes away or its deadline passes
+	ctx, span := tracer.Start(r.Context(), "fetch", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("url.full", url)))
+	defer func() {
+		if resp != nil {
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		}
+		endSpan(span, err)
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range conditional {
+		req.Header[name] = v
+	}
+	if h.cfg.UserAgent != "" {
+		req.Header.Set("User-Agent", h.cfg.UserAgent)
+	}
+	for _, name := range h.cfg.ForwardHeaders {
+		if v := r.Header.Values(name); len(v) > 0 {
+			req.Header[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	return h.do(req)
+}
+
+// forwardsHeaders reports whether r carries any of the headers forwarded
+// upstream.
+func (h *handler) forwardsHeaders(r *http.Request) bool {
+	for _, name := range h.cfg.ForwardHeaders {
+		if r.Header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedSalt returns what the cache keys of a request with header are
+// salted with, so that bundles fetched with a client's credentials are
+// only ever served to requests forwarding the same ones. It is empty when
+// no forwarded header is set, which keeps keys as they were.
+func (h *handler) forwardedSalt(header http.Header) string {
+	hasher := sha256.New()
+	forwarded := false
+	for _, name := range h.cfg.ForwardHeaders {
+		if v := header.Values(name); len(v) > 0 {
+			forwarded = true
+			fmt.Fprintf(hasher, "%s\x00%q\x00", http.CanonicalHeaderKey(name), v)
+		}
+	}
+	if !forwarded {
+		return ""
+	}
+	return fmt.Sprintf("\x00forwarded:%x", hasher.Sum(nil))
+}
+
+// upstreamURL returns the URL to fetch for a request path and query, with
+// the service's own params removed.
+func (h *handler) upstreamURL(path, rawQuery string) (string, error) {
+	upstreamQuery := stripQueryParams(rawQuery, controlParams...)
+	upstreamQuery = stripQueryParams(upstreamQuery, h.cfg.IgnoredQueryParams...)
+	switch h.cfg.ForwardQuery {
+	case forwardNone:
+		upstreamQuery = ""
+	case forwardAllowlist:
+		upstreamQuery = keepQueryParams(upstreamQuery, h.cfg.ForwardQueryParams...)
+	}
+	// Strict upstreams can treat "mod.ts?" differently from "mod.ts"
+	fullURL := strings.TrimPrefix(path, "/")
+	if upstreamQuery != "" {
+		fullURL += "?" + upstreamQuery
+	}
+	fullURL = h.canonicalURL(h.rewriteURL(fullURL))
+	if err := h.validateUpstreamURL(fullURL); err != nil {
+		return "", fmt.Errorf("%w, expected a path of the form /https://example.com/mod.ts", err)
+	}
+	return fullURL, nil
+}
+
+// bundle fetches the URL in the request path, builds it and serves the
+// resulting bundle, using the cache where possible.
+func (h *handler) bundle(w http.ResponseWriter, r *http.Request) {
+	params, err := parseBuildParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fullURL, err := h.upstreamURL(r.URL.Path, r.URL.RawQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Fetching this service from itself would loop
+	if h.isSelfURL(r, fullURL) {
+		http.Error(w, fmt.Sprintf("URL %q points at this service, bundle the URL it proxies instead", fullURL), http.StatusBadRequest)
+		return
+	}
+	originalURL := fullURL
+	start := time.Now()
+	r = r.WithContext(withEventURL(r.Context(), fullURL))
+	log := logger(r.Context())
+	h.logEvent(r.Context(), "fetch_started", "starting bundle process", "url", fullURL)
+	h.recordHit(r)
+	// Point clients at the import map that resolves external packages
+	if u := h.importMapURL(r, params.external); u != "" {
+		w.Header().Set("X-Import-Map", u)
+	}
+	setDownload(w, r, fullURL)
+
+	// Bundles fetched with a client's forwarded headers, like its
+	// credentials, are kept apart from everyone else's
+	salt := h.keySalt + h.forwardedSalt(r.Header)
+	requestHash := cacheKey(originalURL, params, salt)
+	bypass := bypassCache(r)
+	if bypass {
+		log.Info("cache bypassed", "hash", requestHash)
+	}
+	// Background revalidations can't replay the forwarded headers
+	if !bypass && !h.forwardsHeaders(r) && h.serveStale(w, r, requestHash) {
+		return
+	}
+	// Read-only instances serve what they have without asking the
+	// upstream, which may be what is down
+	if h.readOnly.Load() && !bypass && h.isCached(r, requestHash) {
+		h.logEvent(r.Context(), "cache_hit", "cache hit", "hash", requestHash, "read_only", true)
+		w.Header().Set("X-Cache", "HIT")
+		if h.serveBundle(w, r, requestHash) {
+			return
+		}
+		w.Header().Del("X-Cache")
+	}
+
+	// Short-circuit URLs that failed recently
+	if entry, ok := h.negCache.get(requestHash); ok && !h.cfg.DevMode && !bypass {
+		h.logEvent(r.Context(), "negative_cache_hit", "negative cache hit", "hash", requestHash)
+		if !h.serveLastGood(w, r, requestHash, entry.err) {
+			sendError(w, r, entry.err)
+		}
+		return
+	}
+	fail := func(w http.ResponseWriter, err *buildError) {
+		// Nobody is left to answer, and what the build failed with is
+		// only that it was canceled
+		if abandoned(r) {
+			h.logEvent(r.Context(), "build_abandoned", "client went away, build abandoned", "hash", requestHash, "duration", time.Since(start))
+			return
+		}
+		h.events.publish(r.Context(), "build_failed", "hash", requestHash, "kind", err.kind.String(), "status", err.statusCode(), "duration", time.Since(start))
+		// Timeouts aren't remembered, the next request may be faster
+		if deadlineExceeded(w, r) {
+			return
+		}
+		if bypass {
+			sendError(w, r, err)
+			return
+		}
+		h.negCache.add(requestHash, err)
+		if !h.serveLastGood(w, r, requestHash, err) {
+			sendError(w, r, err)
+		}
+	}
+	// Hosts behind an open circuit breaker fail fast, and aren't negatively
+	// cached since the breaker already limits retries
+	fetchFailed := func(w http.ResponseWriter, err error, msg string) {
+		var open *errCircuitOpen
+		if errors.As(err, &open) {
+			be := newBuildError(kindUnavailable, msg+err.Error(), err)
+			h.events.publish(r.Context(), "build_failed", "hash", requestHash, "kind", be.kind.String(), "status", be.statusCode(), "duration", time.Since(start))
+			if !bypass && h.serveLastGood(w, r, requestHash, be) {
+				return
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(int(open.retry.Seconds())+1))
+			sendError(w, r, be)
+			return
+		}
+		fail(w, newBuildError(kindFetch, msg+err.Error(), err))
+	}
+
+	var timing serverTiming
+	phaseStart := start
+	// Entries are only built for URLs that didn't redirect, so the request
+	// hash is also the key of any entry being revalidated
+	var conditional http.Header
+	if !bypass {
+		conditional = h.revalidation(r, requestHash)
+	}
+	resp, err := h.fetch(r, fullURL, conditional)
+	if err != nil {
+		fetchFailed(w, err, "Failed to fetch URL: ")
+		return
+	}
+	defer func() { closeBody(resp) }()
+
+	// Follow redirects manually to get final URL
+	resp, redirects, err := h.followRedirects(r, fullURL, resp)
+	if err != nil {
+		var be *buildError
+		if errors.As(err, &be) {
+			fail(w, be)
+		} else {
+			fetchFailed(w, err, "Failed to follow redirect: ")
+		}
+		return
+	}
+	fullURL = redirects[len(redirects)-1]
+	// Say when a mirror stood in for the upstream
+	if u, err := url.Parse(fullURL); err == nil && resp.Request != nil && resp.Request.URL.Host != u.Host {
+		w.Header().Set("X-Upstream-Host", resp.Request.URL.Host)
+		log.Info("served from mirror", "url", fullURL, "mirror", resp.Request.URL.Host)
+	}
+	if log.Enabled(r.Context(), slog.LevelDebug) {
+		log.Debug("upstream response",
+			"status", resp.StatusCode,
+			"redirects", redirects,
+			"headers", redactHeaders(resp.Header))
+	}
+
+	if resp.StatusCode == http.StatusNotModified && conditional != nil && originalURL == fullURL {
+		closeBody(resp)
+		h.logEvent(r.Context(), "cache_revalidated", "upstream not modified", "hash", requestHash)
+		if err := h.touchValidators(requestHash); err != nil && !os.IsNotExist(err) {
+			log.Info("failed to record revalidation", "hash", requestHash, "error", err)
+		}
+		timing.add("fetch", time.Since(phaseStart))
+		w.Header().Set("Server-Timing", timing.String())
+		w.Header().Set("X-Cache", "REVALIDATED")
+		if h.serveBundle(w, r, requestHash) {
+			return
+		}
+		// The entry was evicted since it was checked, fetch it in full
+		log.Info("cache entry disappeared, rebuilding", "hash", requestHash)
+		w.Header().Del("Server-Timing")
+		w.Header().Del("X-Cache")
+		conditional = nil
+		if resp, err = h.fetch(r, fullURL, nil); err != nil {
+			fetchFailed(w, err, "Failed to fetch URL: ")
+			return
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		status, reason := upstreamFailure(resp.StatusCode)
+		err := &buildError{
+			kind:   kindFetch,
+			status: status,
+			msg:    fmt.Sprintf("Failed to fetch URL: upstream returned %s for %s, %s", resp.Status, fullURL, reason),
+			err:    fmt.Errorf("upstream returned %d: %s", resp.StatusCode, truncate(string(b), 500)),
+		}
+		// Rate limits are transient, pass on when to retry instead of
+		// remembering the failure
+		if resp.StatusCode == http.StatusTooManyRequests {
+			if retry := resp.Header.Get("Retry-After"); retry != "" {
+				w.Header().Set("Retry-After", retry)
+			}
+			sendError(w, r, err)
+			return
+		}
+		// So are refusals, which depend on the credentials the request
+		// forwarded rather than on the URL
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			sendError(w, r, err)
+			return
+		}
+		fail(w, err)
+		return
+	}
+	if originalURL != fullURL {
+		// The URL resolves again, whatever failed for it before
+		h.negCache.clear(requestHash)
+		location := h.origin(r) + "/" + fullURL
+		if control := keepQueryParams(r.URL.RawQuery, controlParams...); control != "" {
+			if strings.Contains(location, "?") {
+				location += "&" + control
+			} else {
+				location += "?" + control
+			}
+		}
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	h.events.publish(r.Context(), "fetch_finished", "status", resp.StatusCode, "duration", time.Since(phaseStart))
+	timing.add("fetch", time.Since(phaseStart))
+	phaseStart = time.Now()
+
+	serveHit := func(hash string) bool {
+		h.logEvent(r.Context(), "cache_hit", "cache hit", "hash", hash, "duration", time.Since(start))
+		timing.add("cache", time.Since(phaseStart))
+		w.Header().Set("Server-Timing", timing.String())
+		w.Header().Set("X-Cache", "HIT")
+		if h.serveBundle(w, r, hash) {
+			return true
+		}
+		// The entry was evicted since it was checked, build it again
+		log.Info("cache entry disappeared, rebuilding", "hash", hash)
+		w.Header().Del("X-Cache")
+		return false
+	}
+
+	// Create hash of final URL. Hosts with mutable URLs are keyed by the
+	// source instead, once it is read.
+	hash := cacheKey(fullURL, params, salt)
+	contentKeyed := h.contentKeyed(fullURL)
+
+	// A revalidated entry that changed upstream is rebuilt, and in
+	// development every request is
+	if !contentKeyed && conditional == nil && !h.cfg.DevMode && !bypass && h.isCached(r, hash) && serveHit(hash) {
+		return
+	}
+
+	// Stream the response to disk and build it from there
+	sourcePath, info, err := h.spoolSource(resp.Body)
+	if err != nil {
+		var tooLarge *sourceTooLargeError
+		if errors.As(err, &tooLarge) {
+			fail(w, &buildError{kind: kindTooLarge, status: http.StatusBadGateway, msg: fmt.Sprintf("Upstream source is larger than the %d bytes this server builds", tooLarge.max), err: err})
+			return
+		}
+		fail(w, newBuildError(kindInternal, "Failed to read response: "+err.Error(), err))
+		return
+	}
+	// Building moves the file into its directory
+	defer os.Remove(sourcePath)
+	if contentKeyed {
+		hash = h.contentKey(fullURL, params, info, salt)
+		if !h.cfg.DevMode && !bypass && h.isCached(r, hash) && serveHit(hash) {
+			h.keepLastGood(r, buildJob{hash: hash, lastGood: requestHash})
+			return
+		}
+	}
+	h.logEvent(r.Context(), "cache_miss", "cache miss", "hash", hash, "duration", time.Since(start))
+
+	// Refuse to build things that obviously aren't source code
+	if r.URL.Query().Get("skip_type_check") != "true" {
+		if err := checkSourceType(resp.Header.Get("Content-Type"), info.head); err != nil {
+			fail(w, &buildError{kind: kindBadRequest, status: http.StatusUnsupportedMediaType,
+				msg: "Upstream content doesn't look like JavaScript or TypeScript, add ?skip_type_check=true to build it anyway", err: err})
+			return
+		}
+	}
+
+	h.build(w, r, buildJob{
+		hash:        hash,
+		url:         fullURL,
+		sourcePath:  sourcePath,
+		info:        info,
+		params:      params,
+		upstream:    resp.Header,
+		timing:      &timing,
+		start:       start,
+		fail:        fail,
+		lastGood:    requestHash,
+		bypassCache: bypass,
+	})
+}
+
+// readOnlyRetryAfter is the Retry-After sent when a build is refused in
+// read-only mode, in seconds.
+const readOnlyRetryAfter = "60"
+
+// buildJob is a source to build and serve as a cache entry.
+type buildJob struct {
+	hash string
+	// url is where the source was fetched from, if anywhere.
+	url string
+	// The source is either in memory or in the file at sourcePath, which
+	// building moves into the build directory.
+	source     []byte
+	sourcePath string
+	info       sourceInfo
+	params     buildParams
+	// upstream is the header the source was fetched with, kept to
+	// revalidate it later. It is nil for sources without an upstream.
+	upstream http.Header
+	timing   *serverTiming
+	start    time.Time
+	// fail reports a failure and records it in the negative cache.
+	fail func(w http.ResponseWriter, err *buildError)
+	// lastGood is the URL key the built entry is recorded as the last good
+	// build of with ServeLastGood, if any.
+	lastGood string
+	// bypassCache serves the build without caching anything, for
+	// ?cache=false.
+	bypassCache bool
+}
+
+// build installs the dependencies of a job's source, bundles it, caches the
+// result and serves it.
+func (h *handler) build(w http.ResponseWriter, r *http.Request, job buildJob) {
+	// Not negatively cached, so builds resume as soon as the mode is
+	// turned off
+	if h.readOnly.Load() {
+		logger(r.Context()).Info("refusing build in read-only mode", "hash", job.hash)
+		w.Header().Set("Retry-After", readOnlyRetryAfter)
+		sendError(w, r, newBuildError(kindUnavailable, "This bundle isn't cached and the service is read-only, so it can't be built right now", errors.New("read-only mode")))
+		return
+	}
+	if job.params.raw {
+		h.transform(w, r, job)
+		return
+	}
+	hash, info, params, timing, start := job.hash, job.info, job.params, job.timing, job.start
+	log := logger(r.Context())
+	fail := job.fail
+
+	h.builds.Add(1)
+	defer h.builds.Done()
+	h.metrics.buildsInFlight.Add(1)
+	defer h.metrics.buildsInFlight.Add(-1)
+
+	// Building can outlast the server's write timeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	// Create temp directory
+	tmpDir, cleanup, err := h.mkdirTemp()
+	if err != nil {
+		fail(w, newBuildError(kindInternal, "Failed to create temp dir: "+err.Error(), err))
+		return
+	}
+	// Outputs are read into memory, so nothing in the directory is needed
+	// once the build returns, and installs would fill the disk
+	defer cleanup()
+	// Create src directory
+	srcDir := tmpDir + "/src"
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		fail(w, newBuildError(kindInternal, "Failed to create src dir: "+err.Error(), err))
+		return
+	}
+
+	log.Debug("created build directory", "dir", tmpDir)
+
+	// Copy package files, from the template the request picks if any.
+	// Installs save into these copies, so concurrent builds never see each
+	// other's dependencies and the project's own files are only ever read.
+	for _, file := range projectFiles {
+		content, err := h.projectFile(params.template, file)
+		var be *buildError
+		if errors.As(err, &be) {
+			fail(w, be)
+			return
+		}
+		if err != nil {
+			fail(w, newBuildError(kindInternal, "Failed to read "+file+": "+err.Error(), err))
+			return
+		}
+		if content == nil {
+			continue
+		}
+		if err := os.WriteFile(tmpDir+"/"+file, content, 0644); err != nil {
+			fail(w, newBuildError(kindInternal, "Failed to write "+file+": "+err.Error(), err))
+			return
+		}
+	}
+	// Registry configuration for private packages
+	if h.npmrc != nil {
+		if err := os.WriteFile(tmpDir+"/.npmrc", h.npmrc, 0600); err != nil {
+			fail(w, newBuildError(kindInternal, "Failed to write .npmrc: "+err.Error(), err))
+			return
+		}
+	}
+
+	// TODO: this causes weird errors
+	// Copy node_modules directory
+	// cmd := exec.Command("cp", "-r", "node_modules", tmpDir+"/node_modules")
+	// if err := cmd.Run(); err != nil {
+	// 	sendError(w, r, "Failed to copy node_modules: "+err.Error(), err)
+	// 	return
+	// }
+
+	// The extension picks the loader esbuild parses the source with
+	entryFile := "index" + entryExtension(job.url, params)
+	if err := job.writeSource(srcDir + "/" + entryFile); err != nil {
+		fail(w, newBuildError(kindInternal, "Failed to write "+entryFile+": "+err.Error(), err))
+		return
+	}
+
+	var packages []string
+	// partial is set when a lenient install left some packages out
+	var partial *partialInstallError
+	if params.bundle != nil && !*params.bundle {
+		log.Info("bundling disabled, skipping dependency install", "duration", time.Since(start))
+	} else if info.bareImports && h.cfg.NoInstall {
+		fail(w, &buildError{kind: kindInstall, status: http.StatusNotImplemented,
+			msg: "This server can't install npm packages because bun isn't installed. Import dependencies by URL instead",
+			err: errors.New("bare imports without bun")})
+		return
+	} else if info.bareImports {
+		h.logEvent(r.Context(), "install_started", "running dependency check", "hash", hash, "duration", time.Since(start))
+		packages, err = h.installDependencies(r.Context(), tmpDir, "src/"+entryFile, params.alias, timing)
+		if errors.As(err, &partial) {
+			log.Warn("some dependencies failed to install, building anyway", "failed", partial.failed, "error", partial.err)
+			w.Header().Set("X-Install-Warning", partial.warning())
+			err = nil
+		}
+		if err != nil {
+			fail(w, asBuildError(err))
+			return
+		}
+		h.logEvent(r.Context(), "install_finished", "installed dependencies",
+			"hash", hash,
+			"missing_count", len(packages),
+			"duration", time.Since(start))
+	} else {
+		log.Info("no bare imports, skipping dependency install", "duration", time.Since(start))
+	}
+
+	// Type errors fail the build when asked to look for them
+	if params.typecheck {
+		phaseStart := time.Now()
+		msgs, err := h.typecheck(r.Context(), tmpDir, params)
+		timing.add("typecheck", time.Since(phaseStart))
+		if err != nil {
+			var be *buildError
+			if !errors.As(err, &be) {
+				be = newBuildError(kindBuild, "Type check failed: "+err.Error(), err)
+			}
+			fail(w, be)
+			return
+		}
+		if len(msgs) > 0 {
+			formatted := strings.Join(api.FormatMessages(msgs, api.FormatMessagesOptions{
+				Kind: api.ErrorMessage,
+			}), "")
+			be := newBuildError(kindBuild, "Type check failed:\n"+formatted, fmt.Errorf("type check failed with %d errors", len(msgs)))
+			be.messages = msgs
+			fail(w, be)
+			return
+		}
+		log.Info("type check passed", "duration", time.Since(phaseStart))
+	}
+
+	// Declarations are cached before the bundle, like its stylesheet
+	if params.types {
+		phaseStart := time.Now()
+		types, err := h.declarations(r.Context(), tmpDir, entryFile)
+		timing.add("types", time.Since(phaseStart))
+		if err != nil {
+			fail(w, asBuildError(err))
+			return
+		}
+		if err := h.writeCacheFile(hash+".d.ts", types); err != nil {
+			fail(w, newBuildError(kindInternal, "Failed to write declarations to cache: "+err.Error(), err))
+			return
+		}
+	}
+
+	opts := h.cfg.BuildOptions
+	// Report paths in messages relative to the build directory
+	opts.AbsWorkingDir = tmpDir
+	// Outputs are kept in memory and served from there
+	opts.Write = false
+	opts.Metafile = true
+	opts.EntryPoints = []string{filepath.Join(srcDir, entryFile)}
+	// Only bundle the requested exports
+	if len(params.entry) > 0 {
+		if err := os.WriteFile(srcDir+"/entry.ts", entryModule(params.entry, "./"+entryFile), 0644); err != nil {
+			fail(w, newBuildError(kindInternal, "Failed to write entry.ts: "+err.Error(), err))
+			return
+		}
+		opts.EntryPoints = []string{filepath.Join(srcDir, "entry.ts")}
+	}
+	// Emitted assets are served next to the bundle
+	opts.Outfile = filepath.Join(tmpDir, "dist", "bundle.js")
+	opts.PublicPath = h.assetPublicPath(hash)
+	params.apply(&opts)
+	// Nothing is cached to link to
+	if job.bypassCache && opts.Sourcemap == api.SourceMapLinked {
+		opts.Sourcemap = api.SourceMapInline
+	}
+	bundlePath := opts.Outfile
+	if opts.Splitting {
+		// Chunks are written next to the entry's output, which is named
+		// after it, and imported from /chunks/
+		if opts.Format != api.FormatESModule {
+			fail(w, newBuildError(kindBadRequest, "splitting needs format=esm", errors.New("splitting without esm")))
+			return
+		}
+		opts.Outdir, opts.Outfile = filepath.Dir(opts.Outfile), ""
+		bundlePath = filepath.Join(opts.Outdir, strings.TrimSuffix(filepath.Base(opts.EntryPoints[0]), filepath.Ext(opts.EntryPoints[0]))+".js")
+		opts.PublicPath = h.chunkPublicPath(hash)
+	}
+	if opts.Inject, err = h.writeShims(tmpDir, opts.Inject); err != nil {
+		fail(w, newBuildError(kindBadRequest, err.Error(), err))
+		return
+	}
+	opts.Plugins = append(slices.Clone(opts.Plugins), h.urlImportPlugin(r.Context(), filepath.Join(srcDir, entryFile), job.url, opts.Loader))
+	// Record exactly what was built, to reproduce it later
+	buildOptions := summarizeBuildOptions(opts)
+	if b, err := json.Marshal(buildOptions); err == nil {
+		log.Debug("build options", "hash", hash, "options", string(b))
+		if h.cfg.BuildOptionsHeader {
+			w.Header().Set("X-Build-Options", string(b))
+		}
+	}
+	phaseStart := time.Now()
+	_, span := tracer.Start(r.Context(), "esbuild", trace.WithAttributes(attribute.String("url.full", job.url)))
+	result := buildWithContext(r.Context(), opts)
+	timing.add("build", time.Since(phaseStart))
+	// Where the entry's output was written is recorded in the metafile,
+	// rather than assumed from the options
+	if path := entryOutputPath(result.Metafile, opts.AbsWorkingDir, opts.EntryPoints[0]); path != "" {
+		bundlePath = path
+	}
+	span.SetAttributes(attribute.Int("esbuild.errors", len(result.Errors)), attribute.Int("esbuild.warnings", len(result.Warnings)))
+	for _, out := range result.OutputFiles {
+		if out.Path == bundlePath {
+			span.SetAttributes(attribute.Int("bundle.size", len(out.Contents)))
+		}
+	}
+	span.End()
+
+	if len(result.Errors) > 0 {
+		for _, msg := range result.Errors {
+			attrs := []any{"text", msg.Text}
+			if msg.Location != nil {
+				attrs = append(attrs, "file", msg.Location.File, "line", msg.Location.Line, "column", msg.Location.Column)
+			}
+			log.Debug("build error", attrs...)
+		}
+		// Explained first for those who don't know esbuild's messages
+		formatted := explainMessages(result.Errors, result.Warnings) + strings.Join(api.FormatMessages(result.Errors, api.FormatMessagesOptions{
+			Kind: api.ErrorMessage,
+		}), "")
+		// Most likely it was missing one of the packages that failed to
+		// install
+		if partial != nil {
+			fail(w, &buildError{kind: kindInstall, status: partial.status, msg: partial.msg + "\nBuild failed:\n" + formatted, err: partial.err, messages: result.Errors})
+			return
+		}
+		be := newBuildError(kindBuild, "Build failed:\n"+formatted, fmt.Errorf("build failed with %d errors", len(result.Errors)))
+		be.messages = result.Errors
+		fail(w, be)
+		return
+	}
+
+	// Find the bundle among the outputs. The stylesheet of the entry is
+	// named after it, others come from split chunks.
+	cssPath := strings.TrimSuffix(bundlePath, ".js") + ".css"
+	var bundle []byte
+	var hasCSS bool
+	for _, out := range result.OutputFiles {
+		switch {
+		case out.Path == bundlePath:
+			bundle = out.Contents
+		case out.Path == cssPath:
+			hasCSS = true
+		}
+	}
+	if bundle == nil {
+		log.Warn("build produced no bundle", "hash", hash, "outputs", len(result.OutputFiles))
+		fail(w, missingOutputError(opts.AbsWorkingDir, bundlePath, result.OutputFiles))
+		return
+	}
+	switch opts.Sourcemap {
+	case api.SourceMapNone:
+		bundle = stripSourceMappingURL(bundle)
+	case api.SourceMapLinked:
+		bundle = h.linkSourceMap(bundle, hash, "js")
+	}
+
+	// An empty bundle from a non-empty source is more likely a glitch than
+	// the right answer, and would be cached for a year
+	if len(bytes.TrimSpace(stripSourceMappingURL(bundle))) == 0 && !info.blank {
+		log.Warn("build produced an empty bundle", "hash", hash, "source_bytes", info.size)
+		fail(w, newBuildError(kindBuild, "Build produced an empty bundle, refusing to cache it", errors.New("empty bundle from non-empty source")))
+		return
+	}
+
+	if h.cfg.VerifyBundles {
+		phaseStart := time.Now()
+		be := verifyBundle(bundle)
+		timing.add("verify", time.Since(phaseStart))
+		if be != nil {
+			log.Warn("build output doesn't parse", "hash", hash, "errors", len(be.messages))
+			fail(w, be)
+			return
+		}
+	}
+
+	// Refuse to cache bundles that are unreasonably large
+	if max := h.maxBundleBytes.Load(); max > 0 && int64(len(bundle)) > max {
+		fail(w, newBuildError(kindTooLarge,
+			fmt.Sprintf("Bundle is %d bytes, over the %d byte limit. Consider marking large dependencies with ?external=", len(bundle), max),
+			fmt.Errorf("bundle size %d exceeds limit %d", len(bundle), max)))
+		return
+	}
+
+	if job.bypassCache {
+		h.logEvent(r.Context(), "build_finished", "build completed", "hash", hash, "cache", "bypassed", "duration", time.Since(start))
+		h.stats.countBuild(time.Since(start))
+		h.serveUncached(w, r, timing, bundle)
+		return
+	}
+
+	// A full disk loses the cache entry but not the build, which is served
+	// from memory unless the answer has to come from the cache
+	writeFailed := func(msg string, err error) {
+		if !isDiskFull(err) {
+			fail(w, newBuildError(kindInternal, msg+err.Error(), err))
+			return
+		}
+		query := r.URL.Query()
+		if query.Get("meta") == "true" || query.Get("analyze") == "true" || query.Get("manifest") == "true" || query.Get("wrap") != "" {
+			be := &buildError{kind: kindUnavailable, status: http.StatusInsufficientStorage, msg: "The cache disk is full, so this can't be answered from the cache: " + err.Error(), err: err}
+			h.events.publish(r.Context(), "build_failed", "hash", hash, "kind", be.kind.String(), "status", be.statusCode(), "duration", time.Since(start))
+			sendError(w, r, be)
+			return
+		}
+		h.logEvent(r.Context(), "build_finished", "build completed", "hash", hash, "cache", "disk_full", "duration", time.Since(start))
+		h.stats.countBuild(time.Since(start))
+		if opts.Sourcemap == api.SourceMapLinked {
+			bundle = stripSourceMappingURL(bundle)
+		}
+		w.Header().Set("X-Cache-Warning", "cache disk is full, the bundle wasn't cached")
+		h.serveUncached(w, r, timing, bundle)
+	}
+
+	// The metafile describes the bundle's inputs and outputs, for ?meta=true,
+	// and ?analyze=true summarizes it
+	if err := h.writeCacheFile(hash+".meta.json", []byte(result.Metafile)); err != nil {
+		writeFailed("Failed to write metafile to cache: ", err)
+		return
+	}
+	analysis := api.AnalyzeMetafile(result.Metafile, api.AnalyzeMetafileOptions{})
+	if err := h.writeCacheFile(hash+".analysis.txt", []byte(analysis)); err != nil {
+		writeFailed("Failed to write analysis to cache: ", err)
+		return
+	}
+
+	// Stylesheets imported by the source are extracted next to the bundle.
+	// They are cached first so a cached bundle always has its CSS available.
+	// So are sourcemaps, legal comments with ?legal_comments=linked or
+	// external, and files emitted by the file and copy loaders.
+	for _, out := range result.OutputFiles {
+		var name, what string
+		contents := out.Contents
+		switch {
+		case out.Path == bundlePath:
+			continue
+		case out.Path == bundlePath+".map":
+			name, what = hash+".js.map", "sourcemap"
+		case out.Path == cssPath:
+			name, what = hash+".css", "stylesheet"
+			if opts.Sourcemap == api.SourceMapLinked {
+				contents = h.linkSourceMap(contents, hash, "css")
+			}
+		case out.Path == cssPath+".map":
+			name, what = hash+".css.map", "stylesheet sourcemap"
+		case strings.HasSuffix(out.Path, ".LEGAL.txt"):
+			name, what = hash+".legal.txt", "legal comments"
+		default:
+			var err error
+			if name, err = assetCacheName(hash, out.Path); err != nil {
+				fail(w, newBuildError(kindInternal, err.Error(), err))
+				return
+			}
+			what = "asset"
+		}
+		if err := h.writeCacheFile(name, contents); err != nil {
+			writeFailed("Failed to write "+what+" to cache: ", err)
+			return
+		}
+	}
+
+	// Describe where the entry came from, for debugging
+	var installWarning string
+	if partial != nil {
+		installWarning = partial.warning()
+	}
+	if err := h.writeEntryInfo(hash, entryInfo{
+		URL:            job.url,
+		RequestURI:     r.URL.RequestURI(),
+		Options:        keepQueryParams(r.URL.RawQuery, buildParamNames...),
+		SourceHash:     fmt.Sprintf("%x", info.sum),
+		ContentHash:    contentHash(bundle),
+		Integrity:      integrity(bundle),
+		Size:           len(bundle),
+		BuildOptions:   &buildOptions,
+		InstallWarning: installWarning,
+		Esbuild:        esbuildVersion(),
+		Version:        version,
+		BuiltAt:        time.Now().UTC(),
+	}); err != nil {
+		writeFailed("Failed to write to cache: ", err)
+		return
+	}
+
+	// Remember how to revalidate the source
+	if job.upstream != nil {
+		if err := h.writeValidators(hash, job.upstream); err != nil {
+			writeFailed("Failed to write to cache: ", err)
+			return
+		}
+	}
+
+	w.Header().Set("Server-Timing", timing.String())
+	w.Header().Set("X-Cache", "MISS")
+	if r.URL.Query().Get("meta") == "true" || r.URL.Query().Get("analyze") == "true" || r.URL.Query().Get("manifest") == "true" || r.URL.Query().Get("wrap") != "" || h.cfg.ContentAddressedRedirect || h.cfg.ETagHash == etagFile {
+		// These are answered from the cache, so the bundle has to be
+		// written before they can be served
+		if err := h.cacheBundle(job, bundle); err != nil {
+			writeFailed("Failed to write to cache: ", err)
+			return
+		}
+		h.keepLastGood(r, job)
+		if !h.serveBundle(w, r, hash) {
+			w.Header().Set("Retry-After", "1")
+			sendError(w, r, newBuildError(kindUnavailable, "Bundle was evicted from the cache before it could be served, please retry", errors.New("cache entry not found")))
+			return
+		}
+	} else {
+		// Serve the bundle from memory while it is written to the cache
+		h.builds.Add(1)
+		go func() {
+			defer h.builds.Done()
+			if err := h.cacheBundle(job, bundle); isDiskFull(err) {
+				log.Error("failed to write bundle to cache, the disk is full", "hash", hash, "error", err)
+				return
+			} else if err != nil {
+				log.Info("failed to write bundle to cache", "hash", hash, "error", err)
+				return
+			}
+			h.keepLastGood(r, job)
+		}()
+		if hasCSS {
+			w.Header().Set("Link", fmt.Sprintf("<%s/_css/%s.css>; rel=stylesheet", h.origin(r), hash))
+		}
+		if params.types {
+			w.Header().Set("X-TypeScript-Types", h.typesURL(r, hash))
+		}
+		if h.cfg.SRIHeader {
+			w.Header().Set("X-SRI", integrity(bundle))
+		}
+		// Later responses for this URL may be served compressed
+		if h.cfg.CompressCache || h.cfg.CompressResponses && len(bundle) >= minCompressSize {
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+		h.serveBytes(w, r, bundle, h.bundleSum(bundle), "", "application/javascript", h.bundleCacheControl())
+	}
+
+	// After dependency check
+	log.Info("installed dependencies",
+		"missing_count", len(packages),
+		"duration", time.Since(start))
+
+	// After build
+	h.logEvent(r.Context(), "build_finished", "build completed", "hash", hash, "duration", time.Since(start))
+	h.stats.countBuild(time.Since(start))
+
+	// After caching
+	log.Info("bundle cached and ready to serve",
+		"size", len(bundle),
+		"total_duration", time.Since(start))
+
+	// Flag builds slow enough to point at a pathological dependency graph
+	if d := time.Since(start); h.cfg.SlowBuildThreshold > 0 && d > h.cfg.SlowBuildThreshold {
+		h.metrics.slowBuilds.Add(1)
+		log.Warn("slow build",
+			"url", job.url,
+			"hash", hash,
+			"duration", d,
+			"timing", timing.String(),
+			"size", len(bundle),
+			"packages", packages)
+	}
+}
+
+var sourceMappingURLPattern = regexp.MustCompile(`(?m)^//[#@] sourceMappingURL=.*\n?`)
+
+// stripSourceMappingURL removes sourceMappingURL comments, which would
+// point at map files that aren't served.
+func stripSourceMappingURL(bundle []byte) []byte {
+	return sourceMappingURLPattern.ReplaceAll(bundle, nil)
+}
+
+var cssRoutePattern = regexp.MustCompile(`^/_css/([0-9a-f]{20})\.css$`)
+
+// serveCSS serves the stylesheet extracted from a cached bundle.
+func (h *handler) serveCSS(w http.ResponseWriter, r *http.Request) {
+	m := cssRoutePattern.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		http.Error(w, "Invalid stylesheet path", http.StatusBadRequest)
+		return
+	}
+	if !h.serveCached(w, r, m[1]+".css", "text/css; charset=utf-8", h.sidecarCacheControl()) {
+		http.NotFound(w, r)
+	}
+}
+
+var legalRoutePattern = regexp.MustCompile(`^/_legal/([0-9a-f]{20})\.txt$`)
+
+// serveLegal serves the legal comments extracted from a cached bundle.
+func (h *handler) serveLegal(w http.ResponseWriter, r *http.Request) {
+	m := legalRoutePattern.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		http.Error(w, "Invalid legal comments path", http.StatusBadRequest)
+		return
+	}
+	if !h.serveCached(w, r, m[1]+".legal.txt", "text/plain; charset=utf-8", h.sidecarCacheControl()) {
+		http.NotFound(w, r)
+	}
+}
+
+var contentRoutePattern = regexp.MustCompile(`^/_b/([0-9a-f]{32})$`)
+
+// serveContentAddressed serves a bundle by the hash of its contents. The
+// response can never change, so it is marked immutable.
+func (h *handler) serveContentAddressed(w http.ResponseWriter, r *http.Request) {
+	m := contentRoutePattern.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		http.Error(w, "Invalid content hash", http.StatusBadRequest)
+		return
+	}
+	hash, err := h.cache.Get(contentName(m[1]))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if h.cfg.SRIHeader {
+		if sri := h.cachedIntegrity(string(hash)); sri != "" {
+			w.Header().Set("X-SRI", sri)
+		}
+	}
+	if !h.serveCached(w, r, string(hash), "application/javascript", cacheControlImmutable) {
+		w.Header().Del("X-SRI")
+		http.NotFound(w, r)
+	}
+}
+
+// contentDir is the cache subdirectory mapping content hashes to cache
+// entries. Each file is named by a content hash and holds the cache key.
+// Other backends name the files as contentName does.
+const contentDir = "content"
+
+// contentHash returns the hash a bundle is content-addressed by, which is
+// also its ETag.
+func contentHash(bundle []byte) string {
+	sum := sha256.Sum256(bundle)
+	return fmt.Sprintf("%x", sum[:16])
+}
+
+// linkContentAddress records that bundle is the cache entry hash, so it
+// can be served from /_b/.
+func (h *handler) linkContentAddress(hash string, bundle []byte) (string, error) {
+	sha := contentHash(bundle)
+	return sha, h.putCacheFile(contentName(sha), []byte(hash))
+}
+
+// cacheBundle stores the bundle built by job as its cache entry. Its
+// sidecar files must already be written. Failures are remembered under the
+// key of the URL requested, which isn't the entry's for content keyed
+// URLs, so both are forgotten.
+func (h *handler) cacheBundle(job buildJob, bundle []byte) error {
+	if err := h.writeCacheFile(job.hash, bundle); err != nil {
+		return err
+	}
+	if _, err := h.linkContentAddress(job.hash, bundle); err != nil {
+		return fmt.Errorf("failed to link content address: %w", err)
+	}
+	h.negCache.clear(job.hash)
+	if job.lastGood != "" {
+		h.negCache.clear(job.lastGood)
+	}
+	return nil
+}
+
+const (
+	cacheControlLong      = "public, max-age=31536000" // Cache for 1 year
+	cacheControlImmutable = cacheControlLong + ", immutable"
+)
+
+// bundleCacheControl returns the Cache-Control header for bundles served
+// by URL. With StaleAfter set, clients and shared caches are told to
+// revalidate after that long, and may keep using their copy for a day
+// while they do.
+func (h *handler) bundleCacheControl() string {
+	if h.cfg.DevMode {
+		return "no-store"
+	}
+	if h.cfg.StaleAfter <= 0 {
+		return cacheControlLong
+	}
+	return fmt.Sprintf("public, max-age=%d, stale-while-revalidate=86400", int(h.cfg.StaleAfter.Seconds()))
+}
+
+// sidecarCacheControl returns the Cache-Control header for files served
+// next to a bundle, which change whenever it is rebuilt.
+func (h *handler) sidecarCacheControl() string {
+	if h.cfg.DevMode {
+		return "no-store"
+	}
+	return cacheControlLong
+}
+
+// isCached reports whether everything needed to answer r from the cache
+// entry hash exists.
+func (h *handler) isCached(r *http.Request, hash string) bool {
+	files := []string{hash}
+	// Entries cached before metafiles were kept need rebuilding
+	if r.URL.Query().Get("meta") == "true" {
+		files = append(files, hash+".meta.json")
+	}
+	if r.URL.Query().Get("analyze") == "true" {
+		files = append(files, hash+".analysis.txt")
+	}
+	if r.URL.Query().Get("manifest") == "true" {
+		files = append(files, hash+".manifest.json")
+	}
+	if r.URL.Query().Get("types") == "true" {
+		files = append(files, hash+".d.ts")
+	}
+	for _, f := range files {
+		if _, err := h.cache.Stat(f); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// serveBundle serves the cache entry hash. It returns false without writing
+// a response if the entry doesn't exist.
+func (h *handler) serveBundle(w http.ResponseWriter, r *http.Request, hash string) bool {
+	// Serve esbuild's metafile describing the bundle instead
+	if r.URL.Query().Get("meta") == "true" {
+		return h.serveCached(w, r, hash+".meta.json", "application/json", h.sidecarCacheControl())
+	}
+	// Or esbuild's readable analysis of it
+	if r.URL.Query().Get("analyze") == "true" {
+		return h.serveCached(w, r, hash+".analysis.txt", "text/plain; charset=utf-8", h.sidecarCacheControl())
+	}
+	// Or the manifest referencing it by content hash
+	if r.URL.Query().Get("manifest") == "true" {
+		return h.serveCached(w, r, hash+".manifest.json", "application/json", h.sidecarCacheControl())
+	}
+	// Or the bundle itself, wrapped as a data URL or JSON string
+	if r.URL.Query().Get("wrap") != "" {
+		return h.serveWrapped(w, r, hash)
+	}
+
+	// Send the client to the content-addressed URL instead
+	if h.cfg.ContentAddressedRedirect {
+		if err := checkCacheName(hash); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return true
+		}
+		bundle, err := h.readCacheFile(hash)
+		if os.IsNotExist(err) {
+			return false
+		}
+		if err != nil {
+			sendError(w, r, newBuildError(kindInternal, "Failed to read from cache: "+err.Error(), err))
+			return true
+		}
+		sha, err := h.linkContentAddress(hash, bundle)
+		if err != nil {
+			sendError(w, r, newBuildError(kindInternal, "Failed to link content address: "+err.Error(), err))
+			return true
+		}
+		w.Header().Set("Location", h.origin(r)+"/_b/"+sha)
+		w.WriteHeader(http.StatusFound)
+		return true
+	}
+
+	// Point the client at the extracted stylesheet, if there is one
+	if err := checkCacheName(hash + ".css"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	} else if _, err := h.cache.Stat(hash + ".css"); err == nil {
+		w.Header().Set("Link", fmt.Sprintf("<%s/_css/%s.css>; rel=stylesheet", h.origin(r), hash))
+	}
+	// And at its declarations, for Deno and other clients that look for
+	// them there
+	if r.URL.Query().Get("types") == "true" {
+		w.Header().Set("X-TypeScript-Types", h.typesURL(r, hash))
+	}
+	if h.cfg.SRIHeader {
+		if sri := h.cachedIntegrity(hash); sri != "" {
+			w.Header().Set("X-SRI", sri)
+		}
+	}
+	if !h.serveCached(w, r, hash, "application/javascript", h.bundleCacheControl()) {
+		w.Header().Del("Link")
+		w.Header().Del("X-TypeScript-Types")
+		w.Header().Del("X-SRI")
+		return false
+	}
+	return true
+}
+
+// cacheFileSum returns the content hash of a cache file's contents, which
+// is the hash of the uncompressed content for compressed files.
+func cacheFileSum(data []byte) (string, error) {
+	if isGzip(data) {
+		return gzipContentHash(data)
+	}
+	return contentHash(data), nil
+}
+
+// serveCached serves a file from the cache with long lived caching
+// headers. It returns false without writing a response if the file doesn't
+// exist.
+func (h *handler) serveCached(w http.ResponseWriter, r *http.Request, name, contentType, cacheControl string) bool {
+	// Extract hash from URL and read from cache
+	if err := checkCacheName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+	gen := h.hot.generation(name)
+	bundle, sum, ok := h.hot.get(name)
+	var err error
+	if !ok {
+		bundle, err = h.cache.Get(name)
+		if os.IsNotExist(err) {
+			return false
+		}
+		if err != nil {
+			sendError(w, r, newBuildError(kindInternal, "Failed to read from cache: "+err.Error(), err))
+			return true
+		}
+		if sum, err = h.fileSum(name, bundle); err != nil {
+			sendError(w, r, newBuildError(kindInternal, "Failed to decompress cache entry: "+err.Error(), err))
+			return true
+		}
+		h.hot.add(name, bundle, sum, gen)
+	}
+
+	// Compressible files are sent in the client's preferred encoding.
+	// Entries stored compressed were already worth compressing.
+	if h.cfg.CompressResponses && compressible(contentType) && (len(bundle) >= minCompressSize || isGzip(bundle)) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if enc := preferredEncoding(r); enc != nil && !(enc.name == "gzip" && isGzip(bundle)) {
+			variant, err := h.variant(name, bundle, sum, gen, enc)
+			if err == nil {
+				h.serveBytes(w, r, variant, sum, enc.name, contentType, cacheControl)
+				return true
+			}
+			logger(r.Context()).Info("failed to compress cache file", "name", name, "encoding", enc.name, "error", err)
+		}
+	} else if isGzip(bundle) {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	// Compressed entries are sent as is to clients that accept gzip, and
+	// decompressed for everyone else
+	var encoding string
+	if isGzip(bundle) {
+		if acceptsEncoding(r, "gzip") {
+			encoding = "gzip"
+		} else if bundle, err = gunzip(bundle); err != nil {
+			sendError(w, r, newBuildError(kindInternal, "Failed to decompress cache entry: "+err.Error(), err))
+			return true
+		}
+	}
+	h.serveBytes(w, r, bundle, sum, encoding, contentType, cacheControl)
+	return true
+}
+
+// etagMatches reports whether the If-None-Match header values list etag,
+// or are "*". As RFC 7232 requires for If-None-Match, tags are compared
+// weakly, ignoring any W/ prefix.
+func etagMatches(values []string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range values {
+		for {
+			v = strings.TrimLeft(v, ", \t")
+			if v == "" {
+				break
+			}
+			if v[0] == '*' {
+				return true
+			}
+			// Tags are quoted and can't contain quotes, but may contain
+			// commas
+			v = strings.TrimPrefix(v, "W/")
+			end := strings.IndexByte(v[min(1, len(v)):], '"')
+			if !strings.HasPrefix(v, `"`) || end < 0 {
+				break
+			}
+			if v[:end+2] == etag {
+				return true
+			}
+			v = v[end+2:]
+		}
+	}
+	return false
+}
+
+// serveBytes writes body with long lived caching headers, with an ETag
+// derived from sum, as returned by fileSum or bundleSum. encoding is the
+// Content-Encoding body is already compressed with, if any, so the
+// Content-Length is that of the compressed bytes and the ETag is the
+// encoding's own, which etag gives each representation. Build options
+// are all in the request URL, so shared caches key on them without a Vary
+// header. Responses to requests forwarding headers upstream are only ever
+// cached privately.
+func (h *handler) serveBytes(w http.ResponseWriter, r *http.Request, body []byte, sum, encoding, contentType, cacheControl string) {
+	etag := h.etag(sum, encoding)
+	if h.forwardsHeaders(r) {
+		cacheControl = strings.Replace(cacheControl, "public", "private", 1)
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+
+	// Check if client has matching ETag
+	if etagMatches(r.Header.Values("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	_, _ = w.Write(body)
+}
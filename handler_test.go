@@ -0,0 +1,619 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestUpstream serves files by path as JavaScript, and anything else as
+// a 404.
+func newTestUpstream(t *testing.T, files map[string]string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := files[r.URL.Path]
+		if !ok {
+			http.Error(w, "no such module", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/javascript")
+		_, _ = io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestHandler returns a handler with cfg, caching and building in
+// temporary directories from the repository's project files unless cfg
+// says otherwise. Background cache writes are waited for before the test
+// ends.
+func newTestHandler(t *testing.T, cfg Config) *handler {
+	t.Helper()
+	if cfg.CacheDir == "" {
+		cfg.CacheDir = t.TempDir()
+	}
+	if cfg.BuildTmpDir == "" {
+		cfg.BuildTmpDir = t.TempDir()
+	}
+	if cfg.ProjectRoot == "" {
+		cfg.ProjectRoot = "."
+	}
+	if !cfg.BuildOptions.Bundle {
+		cfg.BuildOptions = defaultBuildOptions()
+	}
+	h := newHandler(cfg)
+	t.Cleanup(func() { _ = h.waitForBuilds(context.Background()) })
+	return h
+}
+
+// writeScript writes an executable shell script to dir and returns its
+// path, to stand in for bun and bunx.
+func writeScript(t *testing.T, dir, name, script string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// get requests path from h, with headers given as name and value pairs.
+func get(t *testing.T, h http.Handler, path string, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeError decodes a JSON error response.
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder) map[string]any {
+	t.Helper()
+	var body map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("error response isn't JSON: %v\n%s", err, rec.Body)
+	}
+	return body
+}
+
+func TestUpstreamNotFound(t *testing.T) {
+	upstream := newTestUpstream(t, nil)
+	h := newTestHandler(t, Config{})
+
+	rec := get(t, h, "/"+upstream.URL+"/missing.ts", "Accept", "application/json")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404\n%s", rec.Code, rec.Body)
+	}
+	body := decodeError(t, rec)
+	wantMsg := "Failed to fetch URL: upstream returned 404 Not Found for " + upstream.URL + "/missing.ts, check the URL points at an existing file"
+	if body["error"] != wantMsg {
+		t.Errorf("error = %q, want %q", body["error"], wantMsg)
+	}
+	if want := "upstream returned 404: no such module\n"; body["detail"] != want {
+		t.Errorf("detail = %q, want %q", body["detail"], want)
+	}
+	if strings.Contains(rec.Body.String(), "%!") {
+		t.Errorf("error response has a formatting error: %s", rec.Body)
+	}
+}
+
+func TestForwardedHeadersKeepBundlesApart(t *testing.T) {
+	var fetches atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		var secret string
+		switch r.Header.Get("Authorization") {
+		case "Bearer alice":
+			secret = "alice-secret"
+		case "Bearer bob":
+			secret = "bob-secret"
+		case "":
+			http.Error(w, "sign in", http.StatusUnauthorized)
+			return
+		default:
+			http.Error(w, "not yours", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/javascript")
+		_, _ = io.WriteString(w, "export const secret = "+strconv.Quote(secret)+";\n")
+	}))
+	t.Cleanup(upstream.Close)
+	h := newTestHandler(t, Config{ForwardHeaders: []string{"Authorization"}, NegativeCacheTTL: time.Minute})
+	path := "/" + upstream.URL + "/private.ts"
+
+	alice := get(t, h, path, "Authorization", "Bearer alice")
+	if alice.Code != http.StatusOK || !strings.Contains(alice.Body.String(), "alice-secret") {
+		t.Fatalf("alice: status = %d\n%s", alice.Code, alice.Body)
+	}
+	if cc := alice.Header().Get("Cache-Control"); !strings.HasPrefix(cc, "private") {
+		t.Errorf("alice: Cache-Control = %q, want it private", cc)
+	}
+	_ = h.waitForBuilds(context.Background())
+
+	bob := get(t, h, path, "Authorization", "Bearer bob")
+	if bob.Code != http.StatusOK || !strings.Contains(bob.Body.String(), "bob-secret") {
+		t.Fatalf("bob was served someone else's bundle: status = %d\n%s", bob.Code, bob.Body)
+	}
+	if got := bob.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("bob: X-Cache = %q, want MISS", got)
+	}
+	_ = h.waitForBuilds(context.Background())
+
+	if again := get(t, h, path, "Authorization", "Bearer alice"); again.Header().Get("X-Cache") != "HIT" || !strings.Contains(again.Body.String(), "alice-secret") {
+		t.Errorf("alice again: X-Cache = %q\n%s", again.Header().Get("X-Cache"), again.Body)
+	}
+
+	// Refusals aren't remembered, the next request may carry credentials
+	// that work
+	for _, auth := range []string{"", "Bearer mallory"} {
+		before := fetches.Load()
+		for range 2 {
+			rec := get(t, h, path, "Authorization", auth)
+			if rec.Code != http.StatusBadGateway || strings.Contains(rec.Body.String(), "secret") {
+				t.Fatalf("%q: status = %d, want 502\n%s", auth, rec.Code, rec.Body)
+			}
+		}
+		if n := fetches.Load() - before; n != 2 {
+			t.Errorf("%q: upstream fetched %d times for 2 requests, the refusal was cached", auth, n)
+		}
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	var loopFetches atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirect := func(code int, location string) {
+			w.Header().Set("Location", location)
+			w.WriteHeader(code)
+		}
+		// /hops/<n>.ts takes n redirects to reach /mod.ts
+		if n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/hops/"), ".ts")); err == nil {
+			if n == 1 {
+				redirect(http.StatusFound, "/mod.ts")
+			} else {
+				redirect(http.StatusFound, "/hops/"+strconv.Itoa(n-1)+".ts")
+			}
+			return
+		}
+		switch r.URL.Path {
+		case "/old.ts":
+			redirect(http.StatusMovedPermanently, "http://"+r.Host+"/mod.ts")
+		case "/chain/1.ts":
+			redirect(http.StatusFound, "/chain/2.ts")
+		case "/chain/2.ts":
+			redirect(http.StatusTemporaryRedirect, "/chain/3.ts")
+		case "/chain/3.ts":
+			redirect(http.StatusPermanentRedirect, "/mod.ts")
+		case "/gone.ts":
+			redirect(http.StatusMovedPermanently, "/missing.ts")
+		case "/dir/relative.ts":
+			redirect(http.StatusSeeOther, "../mod.ts")
+		case "/nowhere.ts":
+			w.WriteHeader(http.StatusFound)
+		case "/loop.ts":
+			loopFetches.Add(1)
+			redirect(http.StatusFound, "/loop.ts")
+		case "/ping.ts":
+			redirect(http.StatusFound, "/pong.ts")
+		case "/pong.ts":
+			redirect(http.StatusFound, "/ping.ts")
+		case "/mod.ts":
+			w.Header().Set("Content-Type", "application/javascript")
+			_, _ = io.WriteString(w, testModule)
+		default:
+			http.Error(w, "no such module", http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	h := newTestHandler(t, Config{})
+	target := "//example.com/" + upstream.URL + "/mod.ts"
+
+	for _, tt := range []struct {
+		name, path string
+		status     int
+		location   string
+	}{
+		{"single", "/old.ts", http.StatusFound, target},
+		{"chain", "/chain/1.ts", http.StatusFound, target},
+		{"relative", "/dir/relative.ts", http.StatusFound, target},
+		{"control params kept", "/old.ts?minify=false", http.StatusFound, target + "?minify=false"},
+		{"to a missing file", "/gone.ts", http.StatusNotFound, ""},
+		{"without a Location", "/nowhere.ts", http.StatusBadGateway, ""},
+		{"as many as allowed", "/hops/" + strconv.Itoa(maxModuleRedirects) + ".ts", http.StatusFound, target},
+		{"one too many", "/hops/" + strconv.Itoa(maxModuleRedirects+1) + ".ts", http.StatusBadGateway, ""},
+		{"to itself", "/loop.ts", http.StatusBadGateway, ""},
+		{"in a cycle", "/ping.ts", http.StatusBadGateway, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(t, h, "/"+upstream.URL+tt.path)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d\n%s", rec.Code, tt.status, rec.Body)
+			}
+			if got := rec.Header().Get("Location"); got != tt.location {
+				t.Errorf("Location = %q, want %q", got, tt.location)
+			}
+		})
+	}
+
+	// Loops are given up on after the limit, not fetched until the
+	// request times out
+	if n := loopFetches.Load(); n != maxModuleRedirects+1 {
+		t.Errorf("redirect loop fetched %d times, want %d", n, maxModuleRedirects+1)
+	}
+	rec := get(t, h, "/"+upstream.URL+"/loop.ts?cache=false", "Accept", "application/json")
+	if msg := decodeError(t, rec)["error"]; msg != "Upstream redirected more than "+strconv.Itoa(maxModuleRedirects)+" times" {
+		t.Errorf("redirect loop: error = %q", msg)
+	}
+	for _, route := range []string{"/resolve/", "/check/"} {
+		if rec := get(t, h, route+upstream.URL+"/ping.ts"); rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "redirected more than") {
+			t.Errorf("%s of a redirect loop: status = %d\n%s", route, rec.Code, rec.Body)
+		}
+	}
+
+	// Following the redirect builds the target
+	if rec := get(t, h, "/"+upstream.URL+"/mod.ts"); rec.Code != http.StatusOK {
+		t.Errorf("redirect target: status = %d\n%s", rec.Code, rec.Body)
+	}
+}
+
+func TestBuildRemovesItsDirectory(t *testing.T) {
+	upstream := newTestUpstream(t, map[string]string{
+		"/mod.ts":    testModule,
+		"/broken.ts": "export const = ;\n",
+	})
+	h := newTestHandler(t, Config{})
+
+	for path, status := range map[string]int{"/mod.ts": http.StatusOK, "/broken.ts": http.StatusInternalServerError} {
+		if rec := get(t, h, "/"+upstream.URL+path); rec.Code != status {
+			t.Fatalf("%s: status = %d, want %d\n%s", path, rec.Code, status, rec.Body)
+		}
+		_ = h.waitForBuilds(context.Background())
+		entries, err := os.ReadDir(h.cfg.BuildTmpDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			t.Errorf("%s: %s left behind in the build directory", path, entry.Name())
+		}
+	}
+}
+
+func TestInvalidUpstreamURL(t *testing.T) {
+	h := newTestHandler(t, Config{})
+	for _, tt := range []struct {
+		name, path, want string
+	}{
+		{"not a URL", "/not%20a%20url", "has no scheme"},
+		{"no scheme", "/example.com/mod.ts", "has no scheme"},
+		{"no host", "/https:/mod.ts", "has no host"},
+		{"file URL", "/file:///etc/passwd", `unsupported URL scheme "file"`},
+		{"other scheme", "/ftp://example.com/mod.ts", `unsupported URL scheme "ftp"`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(t, h, tt.path)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400\n%s", rec.Code, rec.Body)
+			}
+			if body := rec.Body.String(); !strings.Contains(body, tt.want) || !strings.Contains(body, "expected a path of the form /https://") {
+				t.Errorf("body = %q, want it to explain %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheRoutesRejectTraversal(t *testing.T) {
+	h := newTestHandler(t, Config{})
+	// A file next to the cache directory that traversal would reach
+	if err := os.WriteFile(filepath.Join(h.cfg.CacheDir, "..", "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, prefix := range []string{"/_b/", "/_css/", "/_types/", "/_legal/", "/_map/", "/_a/"} {
+		for _, rest := range []string{"../../etc/passwd", "../secret", "..%2fsecret", "%2e%2e/secret", "0123456789abcdef0123/../../secret", "0123456789ABCDEF0123"} {
+			path := prefix + rest
+			rec := get(t, h, path)
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("%s: status = %d, want 400\n%s", path, rec.Code, rec.Body)
+			}
+			if strings.Contains(rec.Body.String(), "secret") || strings.Contains(rec.Body.String(), "root:") {
+				t.Errorf("%s: served a file outside the cache:\n%s", path, rec.Body)
+			}
+		}
+	}
+}
+
+func TestUpstreamQuery(t *testing.T) {
+	var mu sync.Mutex
+	var requested []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.RequestURI)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/javascript")
+		_, _ = io.WriteString(w, testModule)
+	}))
+	t.Cleanup(upstream.Close)
+
+	for _, tt := range []struct{ query, want string }{
+		{"", "/mod.ts"},
+		{"?", "/mod.ts"},
+		{"?minify=false", "/mod.ts"},
+		{"?v=2&minify=false&x=1", "/mod.ts?v=2&x=1"},
+	} {
+		// A handler each, so the bundle is never cached
+		h := newTestHandler(t, Config{})
+		mu.Lock()
+		requested = nil
+		mu.Unlock()
+		if rec := get(t, h, "/"+upstream.URL+"/mod.ts"+tt.query); rec.Code != http.StatusOK {
+			t.Fatalf("%q: status = %d\n%s", tt.query, rec.Code, rec.Body)
+		}
+		_ = h.waitForBuilds(context.Background())
+		mu.Lock()
+		if len(requested) != 1 || requested[0] != tt.want {
+			t.Errorf("%q: upstream was asked for %q, want %q", tt.query, requested, tt.want)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestURLTooLong(t *testing.T) {
+	var fetches atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "application/javascript")
+		_, _ = io.WriteString(w, testModule)
+	}))
+	t.Cleanup(upstream.Close)
+	h := newTestHandler(t, Config{MaxURLLength: 100})
+	path := "/" + upstream.URL + "/"
+
+	if rec := get(t, h, path+strings.Repeat("a", 100-len(path))); rec.Code != http.StatusOK {
+		t.Fatalf("URL at the limit: status = %d\n%s", rec.Code, rec.Body)
+	}
+	for _, long := range []string{path + strings.Repeat("a", 101-len(path)), path + "mod.ts?v=" + strings.Repeat("1", 100)} {
+		rec := get(t, h, long)
+		if rec.Code != http.StatusRequestURITooLong {
+			t.Errorf("%d byte URL: status = %d, want 414\n%s", len(long), rec.Code, rec.Body)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("upstream fetched %d times, want only for the URL at the limit", n)
+	}
+}
+
+func TestUpstreamStatuses(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/status/"))
+		http.Error(w, "upstream says "+strconv.Itoa(code), code)
+	}))
+	t.Cleanup(upstream.Close)
+	h := newTestHandler(t, Config{})
+
+	for upstreamCode, want := range map[int]int{
+		http.StatusNotFound:            http.StatusNotFound,
+		http.StatusGone:                http.StatusNotFound,
+		http.StatusUnauthorized:        http.StatusBadGateway,
+		http.StatusForbidden:           http.StatusBadGateway,
+		http.StatusTooManyRequests:     http.StatusServiceUnavailable,
+		http.StatusInternalServerError: http.StatusBadGateway,
+		http.StatusServiceUnavailable:  http.StatusBadGateway,
+		http.StatusTeapot:              http.StatusBadGateway,
+	} {
+		path := "/" + upstream.URL + "/status/" + strconv.Itoa(upstreamCode)
+		// Script imports get the error as a script, with the status all
+		// the same
+		if rec := get(t, h, path); rec.Code != want {
+			t.Errorf("upstream %d: status = %d, want %d\n%s", upstreamCode, rec.Code, want, rec.Body)
+		}
+		rec := get(t, h, path, "Accept", "application/json")
+		if rec.Code != want {
+			t.Errorf("upstream %d as JSON: status = %d, want %d\n%s", upstreamCode, rec.Code, want, rec.Body)
+		}
+		body := decodeError(t, rec)
+		status := strconv.Itoa(upstreamCode) + " " + http.StatusText(upstreamCode)
+		if msg, _ := body["error"].(string); !strings.Contains(msg, "upstream returned "+status) {
+			t.Errorf("upstream %d: error = %q, want it to name %s", upstreamCode, msg, status)
+		}
+		if detail, _ := body["detail"].(string); !strings.Contains(detail, "upstream says "+strconv.Itoa(upstreamCode)) {
+			t.Errorf("upstream %d: detail = %q, want the upstream's body", upstreamCode, detail)
+		}
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	const etag = `"abc123"`
+	for _, tt := range []struct {
+		name   string
+		values []string
+		want   bool
+	}{
+		{"exact", []string{`"abc123"`}, true},
+		{"other", []string{`"def456"`}, false},
+		{"list", []string{`"def456", "abc123"`}, true},
+		{"list without spaces", []string{`"def456","abc123"`}, true},
+		{"list without it", []string{`"def456", "ghi789"`}, false},
+		{"several headers", []string{`"def456"`, `"abc123"`}, true},
+		{"wildcard", []string{"*"}, true},
+		{"weak", []string{`W/"abc123"`}, true},
+		{"weak in a list", []string{`"def456", W/"abc123"`}, true},
+		{"comma in a tag", []string{`"a,b", "abc123"`}, true},
+		{"unquoted", []string{"abc123"}, false},
+		{"prefix", []string{`"abc"`}, false},
+		{"empty", nil, false},
+	} {
+		if got := etagMatches(tt.values, etag); got != tt.want {
+			t.Errorf("%s: etagMatches(%q) = %t, want %t", tt.name, tt.values, got, tt.want)
+		}
+	}
+	// Our own tags compare weakly too
+	if !etagMatches([]string{`"abc123"`}, `W/"abc123"`) {
+		t.Error("a strong tag doesn't match the weak tag served")
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	upstream := newTestUpstream(t, map[string]string{"/mod.ts": testModule})
+	h := newTestHandler(t, Config{})
+	path := "/" + upstream.URL + "/mod.ts"
+	etag := get(t, h, path).Header().Get("ETag")
+	_ = h.waitForBuilds(context.Background())
+
+	for _, ifNoneMatch := range []string{`"stale", ` + etag, "*", "W/" + etag} {
+		if rec := get(t, h, path, "If-None-Match", ifNoneMatch); rec.Code != http.StatusNotModified {
+			t.Errorf("If-None-Match: %s: status = %d, want 304", ifNoneMatch, rec.Code)
+		}
+	}
+}
+
+func TestForwardQuery(t *testing.T) {
+	var mu sync.Mutex
+	var requested []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.RequestURI)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/javascript")
+		_, _ = io.WriteString(w, testModule)
+	}))
+	t.Cleanup(upstream.Close)
+	query := "?v=2&token=abc&minify=false&utm_source=x"
+
+	for _, tt := range []struct {
+		cfg  Config
+		want string
+	}{
+		{Config{}, "/mod.ts?v=2&token=abc&utm_source=x"},
+		{Config{ForwardQuery: forwardAll}, "/mod.ts?v=2&token=abc&utm_source=x"},
+		{Config{ForwardQuery: forwardAll, IgnoredQueryParams: []string{"utm_source"}}, "/mod.ts?v=2&token=abc"},
+		{Config{ForwardQuery: forwardNone}, "/mod.ts"},
+		{Config{ForwardQuery: forwardAllowlist, ForwardQueryParams: []string{"v", "missing"}}, "/mod.ts?v=2"},
+	} {
+		h := newTestHandler(t, tt.cfg)
+		mu.Lock()
+		requested = nil
+		mu.Unlock()
+		if rec := get(t, h, "/"+upstream.URL+"/mod.ts"+query); rec.Code != http.StatusOK {
+			t.Fatalf("%q: status = %d\n%s", tt.cfg.ForwardQuery, rec.Code, rec.Body)
+		}
+		_ = h.waitForBuilds(context.Background())
+		mu.Lock()
+		if len(requested) != 1 || requested[0] != tt.want {
+			t.Errorf("%q %q: upstream was asked for %q, want %q", tt.cfg.ForwardQuery, tt.cfg.ForwardQueryParams, requested, tt.want)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestBuildDirectoryCanBeKept(t *testing.T) {
+	upstream := newTestUpstream(t, map[string]string{
+		"/mod.ts": "import name from \"pkg-alpha\";\nexport default name;\n",
+	})
+	h := fakeInstaller(t, Config{})
+	dir := t.TempDir()
+	h.mkdirTemp = func() (string, func(), error) { return dir, func() {}, nil }
+
+	if rec := get(t, h, "/"+upstream.URL+"/mod.ts"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d\n%s", rec.Code, rec.Body)
+	}
+	_ = h.waitForBuilds(context.Background())
+
+	for name, want := range map[string]string{
+		"src/index.ts":                    "from \"pkg-alpha\"",
+		"package.json":                    "\"pkg-alpha\": \"1.0.0\"",
+		"node_modules/pkg-alpha/index.js": "export default \"pkg-alpha\"",
+	} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("build didn't leave %s: %v", name, err)
+			continue
+		}
+		if !strings.Contains(string(b), want) {
+			t.Errorf("%s doesn't contain %q:\n%s", name, want, b)
+		}
+	}
+}
+
+func TestSuccessClearsNegativeCache(t *testing.T) {
+	t.Run("redirected", func(t *testing.T) {
+		var fetches atomic.Int64
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path != "/old.ts":
+				w.Header().Set("Content-Type", "application/javascript")
+				_, _ = io.WriteString(w, testModule)
+			case fetches.Add(1) == 1:
+				http.Error(w, "try again", http.StatusInternalServerError)
+			default:
+				w.Header().Set("Location", "/mod.ts")
+				w.WriteHeader(http.StatusFound)
+			}
+		}))
+		t.Cleanup(upstream.Close)
+		h := newTestHandler(t, Config{NegativeCacheTTL: time.Hour})
+		path := "/" + upstream.URL + "/old.ts"
+
+		if rec := get(t, h, path); rec.Code != http.StatusBadGateway {
+			t.Fatalf("first request: status = %d, want 502\n%s", rec.Code, rec.Body)
+		}
+		if rec := get(t, h, path); rec.Code != http.StatusBadGateway || fetches.Load() != 1 {
+			t.Fatalf("failure wasn't remembered: status = %d, %d fetches", rec.Code, fetches.Load())
+		}
+		if rec := get(t, h, path+"?cache=false"); rec.Code != http.StatusFound {
+			t.Fatalf("bypassing request: status = %d, want 302\n%s", rec.Code, rec.Body)
+		}
+		if rec := get(t, h, path); rec.Code != http.StatusFound {
+			t.Errorf("after the redirect succeeded: status = %d, want 302\n%s", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("content keyed", func(t *testing.T) {
+		var fetches atomic.Int64
+		slowFetched := make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch fetches.Add(1) {
+			case 1:
+				// Succeeds, but only after the second request failed
+				close(slowFetched)
+				time.Sleep(200 * time.Millisecond)
+			case 2:
+				http.Error(w, "try again", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/javascript")
+			_, _ = io.WriteString(w, testModule)
+		}))
+		t.Cleanup(upstream.Close)
+		// Keyed by content, so the entry's key isn't the one failures are
+		// remembered under
+		h := newTestHandler(t, Config{NegativeCacheTTL: time.Hour, ContentKeyHosts: []string{"127.0.0.1"}})
+		path := "/" + upstream.URL + "/mod.ts"
+
+		slow := make(chan int)
+		go func() { slow <- get(t, h, path).Code }()
+		<-slowFetched
+		if rec := get(t, h, path); rec.Code != http.StatusBadGateway {
+			t.Fatalf("failing request: status = %d, want 502\n%s", rec.Code, rec.Body)
+		}
+		if code := <-slow; code != http.StatusOK {
+			t.Fatalf("succeeding request: status = %d", code)
+		}
+		_ = h.waitForBuilds(context.Background())
+
+		if rec := get(t, h, path); rec.Code != http.StatusOK {
+			t.Errorf("after a build succeeded: status = %d, want 200\n%s", rec.Code, rec.Body)
+		}
+	})
+}
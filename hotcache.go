@@ -0,0 +1,131 @@
+package main
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+)
+
+// hotCache keeps the most recently served cache files in memory, along
+// with their content hashes, so hot bundles are served without reading the
+// disk. It is bounded by both entry count and total size; a zero bound
+// disables it. Files are invalidated when rewritten or flushed by this
+// process, so files removed from the cache directory by hand may still be
+// served until they are evicted.
+type hotCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	size       int64
+	// gens count invalidations, so a file read from disk before one isn't
+	// cached after it. Names are spread over a fixed set of counters so
+	// invalidating one file rarely affects others.
+	gens [64]uint64
+	// lru is ordered from most to least recently used.
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type hotEntry struct {
+	name string
+	data []byte
+	// sum is the content hash of data, uncompressed.
+	sum string
+}
+
+func newHotCache(maxEntries int, maxBytes int64) *hotCache {
+	return &hotCache{maxEntries: maxEntries, maxBytes: maxBytes, lru: list.New(), items: map[string]*list.Element{}}
+}
+
+func (c *hotCache) enabled() bool { return c.maxEntries > 0 && c.maxBytes > 0 }
+
+func (c *hotCache) get(name string) (data []byte, sum string, ok bool) {
+	if !c.enabled() {
+		return nil, "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[name]
+	if !ok {
+		return nil, "", false
+	}
+	c.lru.MoveToFront(el)
+	entry := el.Value.(*hotEntry)
+	return entry.data, entry.sum, true
+}
+
+// generation returns the invalidation count of name to pass to add, taken
+// before reading the file.
+func (c *hotCache) generation(name string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return *c.gen(name)
+}
+
+func (c *hotCache) gen(name string) *uint64 {
+	hasher := fnv.New32a()
+	hasher.Write([]byte(name))
+	return &c.gens[hasher.Sum32()%uint32(len(c.gens))]
+}
+
+// add caches the contents of the cache file name, evicting the least
+// recently used files to make room. It does nothing if name was
+// invalidated since gen, or if the file is over the byte budget on its
+// own.
+func (c *hotCache) add(name string, data []byte, sum string, gen uint64) {
+	if !c.enabled() || int64(len(data)) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != *c.gen(name) {
+		return
+	}
+	if el, ok := c.items[name]; ok {
+		c.remove(el)
+	}
+	c.items[name] = c.lru.PushFront(&hotEntry{name: name, data: data, sum: sum})
+	c.size += int64(len(data))
+	for c.lru.Len() > c.maxEntries || c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// names returns the names of the cached files, most recently used first.
+func (c *hotCache) names() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, c.lru.Len())
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		names = append(names, el.Value.(*hotEntry).name)
+	}
+	return names
+}
+
+// invalidate forgets the cache file name, after it is rewritten.
+func (c *hotCache) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*c.gen(name)++
+	if el, ok := c.items[name]; ok {
+		c.remove(el)
+	}
+}
+
+// clear forgets every file, after the cache is flushed.
+func (c *hotCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.gens {
+		c.gens[i]++
+	}
+	c.lru.Init()
+	c.items = map[string]*list.Element{}
+	c.size = 0
+}
+
+func (c *hotCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*hotEntry)
+	delete(c.items, entry.name)
+	c.size -= int64(len(entry.data))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// importMap returns a browser import map resolving each external package
+// to the URL ImportMapTemplate gives it. "{name}" in the template is
+// replaced by the package name and "{version}" by its pinned version, or
+// "latest". Wildcard externals can't be mapped and are left out.
+func (h *handler) importMap(external []string) map[string]map[string]string {
+	imports := map[string]string{}
+	for _, pkg := range external {
+		if strings.Contains(pkg, "*") {
+			continue
+		}
+		version := h.cfg.Pins[pkg]
+		if version == "" {
+			version = "latest"
+		}
+		target := strings.NewReplacer("{name}", pkg, "{version}", version).Replace(h.cfg.ImportMapTemplate)
+		imports[pkg] = target
+		// Also map deep imports like "react/jsx-runtime"
+		imports[pkg+"/"] = target + "/"
+	}
+	return map[string]map[string]string{"imports": imports}
+}
+
+// importMapURL returns where the import map for a bundle's external
+// packages is served, or "" if it has none.
+func (h *handler) importMapURL(r *http.Request, external []string) string {
+	if h.cfg.ImportMapTemplate == "" || len(external) == 0 {
+		return ""
+	}
+	return h.origin(r) + "/importmap.json?" + url.Values{"external": {strings.Join(external, ",")}}.Encode()
+}
+
+// serveImportMap serves the import map for /importmap.json?external=, to
+// be included in a page as <script type="importmap"> before loading a
+// bundle with external packages.
+func (h *handler) serveImportMap(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.ImportMapTemplate == "" {
+		http.NotFound(w, r)
+		return
+	}
+	params, err := parseBuildParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/importmap+json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	_ = json.NewEncoder(w).Encode(h.importMap(params.external))
+}
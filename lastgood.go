@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+)
+
+// With Config.ServeLastGood, a request whose build fails is answered with
+// the last bundle successfully built for its URL and options, if there is
+// one, instead of the error. URL keyed entries are only rebuilt when they
+// are revalidated, and a failed rebuild leaves them in place, so the entry
+// is its own last good build. Content keyed entries change with the
+// source, so each successful build records its key in a pointer file named
+// after the URL's key.
+
+// lastGoodSuffix names the pointer from a URL's cache key to the content
+// keyed entry last built for it.
+const lastGoodSuffix = ".lastgood"
+
+// recordLastGood points the URL key urlHash at the entry hash.
+func (h *handler) recordLastGood(urlHash, hash string) error {
+	if urlHash == hash {
+		return nil
+	}
+	if b, err := h.readCacheFile(urlHash + lastGoodSuffix); err == nil && bytes.Equal(b, []byte(hash)) {
+		return nil
+	}
+	return h.writeCacheFile(urlHash+lastGoodSuffix, []byte(hash))
+}
+
+// keepLastGood records the entry built by job as the last good build of
+// its URL, if ServeLastGood is set.
+func (h *handler) keepLastGood(r *http.Request, job buildJob) {
+	if !h.cfg.ServeLastGood || job.lastGood == "" {
+		return
+	}
+	if err := h.recordLastGood(job.lastGood, job.hash); err != nil {
+		logger(r.Context()).Info("failed to record last good build", "hash", job.hash, "error", err)
+	}
+}
+
+// lastGood returns the entry last built successfully for the URL key
+// urlHash, or false if there is none.
+func (h *handler) lastGood(r *http.Request, urlHash string) (string, bool) {
+	hash := urlHash
+	if b, err := h.readCacheFile(urlHash + lastGoodSuffix); err == nil && cacheEntryPattern.Match(b) {
+		hash = string(b)
+	} else if err != nil && !os.IsNotExist(err) {
+		return "", false
+	}
+	return hash, h.isCached(r, hash)
+}
+
+// serveLastGood answers r with the last good build for the URL key
+// urlHash in place of err, marked with X-Stale. It returns false without
+// writing a response if that isn't configured or there is none. Denied
+// packages are never served this way, as the denylist is there to keep
+// them out of bundles.
+func (h *handler) serveLastGood(w http.ResponseWriter, r *http.Request, urlHash string, err *buildError) bool {
+	if !h.cfg.ServeLastGood || h.cfg.DevMode || err.kind == kindForbidden {
+		return false
+	}
+	hash, ok := h.lastGood(r, urlHash)
+	if !ok {
+		return false
+	}
+	w.Header().Set("X-Cache", "STALE")
+	w.Header().Set("X-Stale", "true")
+	w.Header().Set("X-Stale-Reason", err.kind.String())
+	if !h.serveBundle(w, r, hash) {
+		for _, name := range []string{"X-Cache", "X-Stale", "X-Stale-Reason"} {
+			w.Header().Del(name)
+		}
+		return false
+	}
+	logger(r.Context()).Warn("served last good bundle after failure", "hash", hash, "kind", err.kind.String(), "error", err.msg)
+	h.metrics.lastGoodServed.Add(1)
+	return true
+}
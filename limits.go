@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Builds shell out to bun and bunx for depcheck, installs and tsc. A
+// pathological dependency graph can make those use enough memory or CPU to
+// take the whole service down with them, so they can be run under
+// per-process rlimits: BuildMemoryLimit caps their address space and
+// BuildCPULimit their CPU time. The limits are applied with prlimit(2)
+// right after the process starts, and are inherited by anything it spawns.
+// They are only supported on Linux. esbuild runs inside this process and
+// isn't covered by them. Runtimes reserve far more address space than they
+// touch, so the memory limit needs generous headroom over the resident
+// size of a typical install.
+
+// limitError is returned by run when a process was stopped by one of the
+// build resource limits.
+type limitError struct {
+	limit, value string
+	err          error
+}
+
+func (e *limitError) Error() string {
+	return "exceeded the build " + e.limit + " limit of " + e.value
+}
+func (e *limitError) Unwrap() error { return e.err }
+
+// outOfMemoryPattern matches what bun and node print when an allocation
+// fails.
+var outOfMemoryPattern = regexp.MustCompile(`(?i)(out of memory|OutOfMemory|Cannot allocate memory|ENOMEM|allocation failed)`)
+
+// run runs cmd under the configured resource limits, and as the sandbox
+// user if there is one. output is what cmd writes to, used to recognize a
+// failed allocation. Canceling cmd's context kills it and everything it
+// started.
+func (h *handler) run(cmd *exec.Cmd, output *bytes.Buffer) error {
+	if err := h.sandbox(cmd); err != nil {
+		return fmt.Errorf("sandboxing %s: %w", filepath.Base(cmd.Path), err)
+	}
+	// Anything left holding the output once cmd is killed is given up on
+	killTree(cmd)
+	cmd.WaitDelay = time.Second
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := setLimits(cmd.Process.Pid, h.cfg.BuildMemoryLimit, h.cfg.BuildCPULimit); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("setting resource limits: %w", err)
+	}
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	if h.cfg.BuildCPULimit > 0 && killedByCPULimit(exitErr) {
+		return &limitError{"CPU time", h.cfg.BuildCPULimit.String(), err}
+	}
+	if h.cfg.BuildMemoryLimit > 0 && outOfMemoryPattern.Match(output.Bytes()) {
+		return &limitError{"memory", fmt.Sprintf("%d bytes", h.cfg.BuildMemoryLimit), err}
+	}
+	return err
+}
+
+// cpuLimit converts a CPU time limit to the whole seconds RLIMIT_CPU is
+// counted in, rounding up.
+func cpuLimit(d time.Duration) uint64 {
+	return uint64((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const limitsSupported = true
+
+// setLimits applies the build resource limits to the process pid. Zero
+// leaves a limit unset.
+func setLimits(pid int, memory int64, cpu time.Duration) error {
+	if memory > 0 {
+		limit := unix.Rlimit{Cur: uint64(memory), Max: uint64(memory)}
+		if err := unix.Prlimit(pid, unix.RLIMIT_AS, &limit, nil); err != nil {
+			return err
+		}
+	}
+	if cpu > 0 {
+		// A second of slack lets SIGXCPU stop it before SIGKILL does
+		limit := unix.Rlimit{Cur: cpuLimit(cpu), Max: cpuLimit(cpu) + 1}
+		if err := unix.Prlimit(pid, unix.RLIMIT_CPU, &limit, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// killedByCPULimit reports whether the process exited from the signals
+// RLIMIT_CPU sends: SIGXCPU at the soft limit, SIGKILL at the hard one.
+func killedByCPULimit(exitErr *exec.ExitError) bool {
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && (status.Signal() == syscall.SIGXCPU || status.Signal() == syscall.SIGKILL)
+}
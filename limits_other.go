@@ -0,0 +1,22 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"time"
+)
+
+const limitsSupported = false
+
+// setLimits fails if any limit is set, since other platforms can't apply
+// rlimits to another process.
+func setLimits(pid int, memory int64, cpu time.Duration) error {
+	if memory > 0 || cpu > 0 {
+		return errors.New("build resource limits are only supported on Linux")
+	}
+	return nil
+}
+
+func killedByCPULimit(exitErr *exec.ExitError) bool { return false }
@@ -1,26 +1,27 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha256"
-	"encoding/json"
-	"errors"
-	"fmt"
-	"io"
+	"crypto/tls"
 	"log"
 	"log/slog"
+	"maps"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/evanw/esbuild/pkg/api"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type responseWriter struct {
@@ -40,16 +41,39 @@ func (rw *responseWriter) Write(b []byte) (int, error) {
 	return size, err
 }
 
-func loggingMiddleware(next http.Handler) http.Handler {
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// loggingMiddleware logs each request once it completes. Successful
+// requests to quietPaths, like health checks and metrics scrapes, aren't
+// logged at all, and only one in hitSample cache hits is. Misses and
+// errors are always logged.
+func loggingMiddleware(next http.Handler, quietPaths []string, hitSample int64) http.Handler {
+	var hits atomic.Int64
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		wrapped := &responseWriter{ResponseWriter: w, status: http.StatusOK}
 
+		// Tag the request so its build logs can be correlated
+		id := requestID(r)
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(withRequestID(r.Context(), id))
+
 		next.ServeHTTP(wrapped, r)
 
 		duration := time.Since(start)
 
-		slog.Info("request completed",
+		if wrapped.status < 400 {
+			if slices.Contains(quietPaths, r.URL.Path) {
+				return
+			}
+			if hitSample > 1 && w.Header().Get("X-Cache") == "HIT" && hits.Add(1)%hitSample != 1 {
+				return
+			}
+		}
+		logger(r.Context()).Info("request completed",
 			"method", r.Method,
 			"path", r.URL.Path,
 			"status", wrapped.status,
@@ -59,312 +83,509 @@ func loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func sendError(w http.ResponseWriter, msg string, err error) {
-	w.Header().Set("Content-Type", "application/javascript")
-	v, _ := json.Marshal(msg)
-	_, _ = w.Write([]byte(fmt.Sprintf(`console.error(%s);`, v)))
-	_, _ = w.Write([]byte(fmt.Sprintf(`console.error(%q)`, err.Error())))
-}
+func main() {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(envString("LOG_LEVEL", "info"))); err != nil {
+		log.Panicf("Invalid LOG_LEVEL: %v", err)
+	}
+	switch format := envString("LOG_FORMAT", "text"); format {
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+	case "text":
+		slog.SetLogLoggerLevel(logLevel)
+	default:
+		log.Panicf("Invalid LOG_FORMAT %q, expected text or json", format)
+	}
 
-var htmlPage = `
-<!DOCTYPE html>
-<html>
-<head>
-	<title>TypeScript Bundle Service</title>
-	<link rel="icon" href="https://fav.farm/💐">
-	<style>
-		body { font-family: system-ui; max-width: 800px; margin: 40px auto; padding: 0 20px; line-height: 1.6; }
-		pre { background: #f4f4f4; padding: 15px; border-radius: 5px; }
-	</style>
-</head>
-<body>
-	<h1>TypeScript Bundle Service</h1>
-	<p>This service bundles TypeScript files into JavaScript. To use it, append a URL to a TypeScript file to this domain.</p>
-	<p>Example usage:</p>
-	<pre>import "<a href="%s/https://esm.town/v/maxm/blitheJadeBee">%s/https://esm.town/v/maxm/blitheJadeBee</a>"</pre>
-</body>
-</html>`
-
-func serveBundle(w http.ResponseWriter, r *http.Request, hash string) {
-	// Extract hash from URL and read from cache
-	cachePath := ".cache/" + hash
-	bundle, err := os.ReadFile(cachePath)
-	if err != nil {
-		sendError(w, "Failed to read from cache: "+err.Error(), err)
+	port := envString("PORT", "8000")
+	cacheDir := envString("CACHE_DIR", ".cache")
+
+	// Check cache. The directory also keeps the saved state, whatever the
+	// backend.
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		log.Panicln(err)
 		return
 	}
+	cacheBackend := envString("CACHE_BACKEND", "disk")
+	if !slices.Contains(cacheBackends, cacheBackend) {
+		log.Panicf("Invalid CACHE_BACKEND %q, expected one of %s", cacheBackend, strings.Join(cacheBackends, ", "))
+	}
+	cacheShardDepth := int(envInt64("CACHE_SHARD_DEPTH", 1))
+	if cacheShardDepth < 0 || cacheShardDepth > maxShardDepth {
+		log.Panicf("Invalid CACHE_SHARD_DEPTH %d, expected 0 to %d", cacheShardDepth, maxShardDepth)
+	}
+	// Bundles are kept in the cache directory, or in memory for throwaway
+	// instances
+	var cache Cache
+	switch cacheBackend {
+	case "disk":
+		if n, err := removeStaleTempFiles(cacheDir); err != nil {
+			log.Panicln(err)
+		} else if n > 0 {
+			log.Printf("Removed %d incomplete cache writes", n)
+		}
+		// Files are spread over subdirectories, moved there from any
+		// earlier layout
+		if n, err := migrateCacheLayout(cacheDir, cacheShardDepth); err != nil {
+			log.Panicf("Failed to migrate the cache to a shard depth of %d: %v", cacheShardDepth, err)
+		} else if n > 0 {
+			log.Printf("Moved %d cache files to a shard depth of %d", n, cacheShardDepth)
+		}
+		cache = newDiskCache(cacheDir, cacheShardDepth)
+	case "memory":
+		cache = newMemoryCache()
+	}
 
-	// Calculate ETag using SHA-256 hash of bundle
-	shaHash := sha256.Sum256(bundle)
-	etag := fmt.Sprintf(`"%x"`, shaHash[:16]) // Use first 16 bytes for shorter ETag
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	// Builds run in directories created here
+	buildTmpDir := envString("BUILD_TMP_DIR", os.TempDir())
+	if err := os.MkdirAll(buildTmpDir, 0755); err != nil {
+		log.Panicf("Failed to create BUILD_TMP_DIR: %v", err)
+	}
+	log.Printf("Building in %s", buildTmpDir)
 
-	// Check if client has matching ETag
-	if match := r.Header.Get("If-None-Match"); match == etag {
-		w.WriteHeader(http.StatusNotModified)
-		return
+	// Resolve the project files every build starts from
+	projectRoot, err := filepath.Abs(envString("PROJECT_ROOT", "."))
+	if err != nil {
+		log.Panicf("Invalid PROJECT_ROOT: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(projectRoot, "package.json")); err != nil {
+		log.Panicf("PROJECT_ROOT %s must contain a package.json: %v", projectRoot, err)
 	}
+	log.Printf("Using project root %s", projectRoot)
 
-	w.Header().Set("Content-Type", "application/javascript")
-	w.Header().Set("ETag", etag)
-	w.Header().Set("ETag", etag)
-	w.Header().Set("Cache-Control", "public, max-age=31536000") // Cache for 1 year
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(bundle)))
-	_, _ = w.Write(bundle)
-}
+	// Version pins are optional unless a file is explicitly configured
+	pinsFile := envString("PINS_FILE", filepath.Join(projectRoot, "pins.json"))
+	pins, err := loadPins(pinsFile, os.Getenv("PINS_FILE") != "")
+	if err != nil {
+		log.Panicf("Failed to load version pins: %v", err)
+	}
+	if len(pins) > 0 {
+		log.Printf("Loaded %d version pins from %s", len(pins), pinsFile)
+	}
 
-func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8000"
+	// So are rewrites of URLs on Git hosts other than the built-in ones
+	rewritesFile := envString("URL_REWRITES_FILE", filepath.Join(projectRoot, "rewrites.json"))
+	urlRewrites, err := loadURLRewrites(rewritesFile, os.Getenv("URL_REWRITES_FILE") != "")
+	if err != nil {
+		log.Panicf("Failed to load URL rewrites: %v", err)
 	}
 
-	// Check cache
-	if err := os.MkdirAll(".cache", 0755); err != nil {
-		log.Panicln(err)
-		return
+	// Registry auth for private packages is optional unless explicitly
+	// configured
+	npmrcFile := envString("NPMRC_FILE", filepath.Join(projectRoot, ".npmrc"))
+	npmrc, err := os.ReadFile(npmrcFile)
+	if err != nil && (os.Getenv("NPMRC_FILE") != "" || !os.IsNotExist(err)) {
+		log.Panicf("Failed to read .npmrc: %v", err)
+	}
+	if len(npmrc) > 0 {
+		log.Printf("Using registry configuration from %s", npmrcFile)
+		if literalNpmrcToken.Match(npmrc) {
+			log.Printf("Warning: %s contains a literal auth token, reference an environment variable like ${NPM_TOKEN} instead", npmrcFile)
+		}
 	}
 
-	log.Printf("Starting server on http://localhost:%s", port)
+	// Default build options can be overridden by a config file
+	buildOptions := defaultBuildOptions()
+	configFile := envString("CONFIG_FILE", filepath.Join(projectRoot, "config.json"))
+	configFingerprint, err := loadBuildConfig(configFile, os.Getenv("CONFIG_FILE") != "", &buildOptions)
+	if err != nil {
+		log.Panicf("Failed to load build config: %v", err)
+	}
+	if configFingerprint != "" {
+		log.Printf("Loaded build options from %s", configFile)
+	}
 
-	// Create TCP listener
-	listener, err := net.Listen("tcp", "0.0.0.0:"+port)
+	// Bundles can read selected environment variables as process.env.NAME
+	defineEnv := envList("DEFINE_ENV")
+	envDefs, missingEnv, err := envDefines(defineEnv)
 	if err != nil {
-		log.Panicf("Failed to create listener: %v", err)
+		log.Panicf("Invalid DEFINE_ENV: %v", err)
+	}
+	if len(missingEnv) > 0 {
+		log.Printf("Warning: DEFINE_ENV lists unset environment variables, leaving them undefined: %s", strings.Join(missingEnv, ", "))
 	}
 
-	// Create server
-	server := &http.Server{
-		Handler: loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	// Dependencies are installed with bun. Without it only sources that
+	// import by URL can be built, which has to be asked for explicitly.
+	bunBin, bunxBin := envString("BUN_BIN", "bun"), envString("BUNX_BIN", "bunx")
+	noInstall := false
+	for _, bin := range []*string{&bunBin, &bunxBin} {
+		path, err := exec.LookPath(*bin)
+		if err == nil {
+			*bin = path
+			continue
+		}
+		if !envBool("ALLOW_MISSING_BUN", false) {
+			log.Panicf("%s not found, install bun (https://bun.sh), point BUN_BIN and BUNX_BIN at it, or set ALLOW_MISSING_BUN=true to only build sources that import by URL: %v", *bin, err)
+		}
+		log.Printf("Warning: %s not found, sources with bare imports will be refused: %v", *bin, err)
+		noInstall = true
+	}
 
-			// Return helpful HTML page if path is empty
-			if r.URL.Path == "/" {
-				w.Header().Set("Content-Type", "text/html; charset=utf-8")
-				_, _ = w.Write([]byte(fmt.Sprintf(htmlPage, "//"+r.Host, r.URL.Scheme+"https://"+r.Host)))
-				return
-			}
+	// The landing page can be replaced with a custom page or a redirect
+	var rootPage []byte
+	rootRedirect := os.Getenv("ROOT_REDIRECT")
+	if rootFile := os.Getenv("ROOT_HTML_FILE"); rootFile != "" {
+		if rootRedirect != "" {
+			log.Panicf("ROOT_HTML_FILE and ROOT_REDIRECT can't both be set")
+		}
+		if rootPage, err = os.ReadFile(rootFile); err != nil {
+			log.Panicf("Failed to read ROOT_HTML_FILE: %v", err)
+		}
+	}
+	if u, err := url.Parse(rootRedirect); rootRedirect != "" && (err != nil || u.Scheme == "" && !strings.HasPrefix(rootRedirect, "/")) {
+		log.Panicf("Invalid ROOT_REDIRECT %q, expected an absolute URL or path", rootRedirect)
+	}
 
-			path := strings.TrimPrefix(r.URL.Path, "/")
-			fullURL := path + "?" + r.URL.RawQuery
-			originalURL := fullURL
-			start := time.Now()
-			slog.Info("starting bundle process", "url", fullURL)
-
-			// Get final redirect location
-			client := &http.Client{
-				CheckRedirect: func(req *http.Request, via []*http.Request) error {
-					return http.ErrUseLastResponse
-				},
-			}
+	// Installs run package code, which can be contained a little
+	var sandbox *sandboxUser
+	if spec := os.Getenv("BUILD_USER"); spec != "" {
+		if sandbox, err = parseSandboxUser(spec); err != nil {
+			log.Panicf("Invalid BUILD_USER: %v", err)
+		}
+		if os.Geteuid() != 0 {
+			log.Panicf("BUILD_USER needs the service to run as root to switch users")
+		}
+	}
+	installScripts := envBool("INSTALL_SCRIPTS", false)
+	if installScripts && sandbox == nil {
+		log.Printf("Warning: INSTALL_SCRIPTS runs packages' lifecycle scripts with the service's privileges, consider setting BUILD_USER")
+	}
+	denyPackages := envList("DENY_PACKAGES")
+	if err := validDenyPatterns(denyPackages); err != nil {
+		log.Panicf("Invalid DENY_PACKAGES: %v", err)
+	}
 
-			resp, err := client.Get(fullURL)
-			if err != nil {
-				sendError(w, "Failed to fetch URL: "+err.Error(), err)
-				return
-			}
+	// Optional rlimits on the bun and bunx processes of each build
+	buildMemoryLimit := envInt64("BUILD_MEMORY_LIMIT_BYTES", 0)
+	buildCPULimit := envDuration("BUILD_CPU_LIMIT", 0)
+	if (buildMemoryLimit > 0 || buildCPULimit > 0) && !limitsSupported {
+		log.Panicf("BUILD_MEMORY_LIMIT_BYTES and BUILD_CPU_LIMIT are only supported on Linux")
+	}
 
-			// Follow redirects manually to get final URL
-			for resp.StatusCode == http.StatusMovedPermanently ||
-				resp.StatusCode == http.StatusFound ||
-				resp.StatusCode == http.StatusSeeOther ||
-				resp.StatusCode == http.StatusTemporaryRedirect {
-
-				u, _ := resp.Location()
-				fullURL = u.String()
-				resp, err = client.Get(fullURL)
-				if err != nil {
-					sendError(w, "Failed to follow redirect: "+err.Error(), err)
-					return
-				}
-			}
+	// Shims builds can inject are optional unless a directory is
+	// explicitly configured
+	shimsDir := envString("SHIMS_DIR", filepath.Join(projectRoot, "shims"))
+	shims, err := loadShims(shimsDir, os.Getenv("SHIMS_DIR") != "")
+	if err != nil {
+		log.Panicf("Failed to load shims: %v", err)
+	}
+	for _, name := range buildOptions.Inject {
+		if _, ok := shims[name]; !ok {
+			log.Panicf("Build config injects %q, which isn't in %s", name, shimsDir)
+		}
+	}
+	if len(shims) > 0 {
+		log.Printf("Loaded %d shims from %s", len(shims), shimsDir)
+	}
 
-			if resp.StatusCode != http.StatusOK {
-				b, _ := io.ReadAll(resp.Body)
-				sendError(w, "Failed to fetch URL: "+resp.Status, fmt.Errorf("status %d", errors.New(string(b))))
-				return
-			}
-			if originalURL != fullURL {
-				w.Header().Set("Location", "/"+fullURL)
-				w.WriteHeader(http.StatusFound)
-				return
+	// Project templates are optional too
+	templatesDir := envString("TEMPLATES_DIR", filepath.Join(projectRoot, "templates"))
+	templates, err := loadTemplates(templatesDir, os.Getenv("TEMPLATES_DIR") != "")
+	if err != nil {
+		log.Panicf("Failed to load templates: %v", err)
+	}
+	if len(templates) > 0 {
+		log.Printf("Loaded templates %s from %s", strings.Join(slices.Sorted(maps.Keys(templates)), ", "), templatesDir)
+	}
+
+	bindAddr := envString("BIND_ADDR", "0.0.0.0")
+
+	// Validate the listen address before trying to bind to it. A Unix
+	// socket replaces the TCP listener, so the address is ignored with one,
+	// as platforms setting PORT for every service would have it.
+	addr := net.JoinHostPort(bindAddr, port)
+	socketPath := os.Getenv("LISTEN_SOCKET")
+	socketMode := os.FileMode(defaultSocketMode)
+	if socketPath != "" {
+		for _, name := range []string{"BIND_ADDR", "PORT"} {
+			if v := os.Getenv(name); v != "" {
+				log.Printf("Ignoring %s=%q, listening on LISTEN_SOCKET %s instead", name, v, socketPath)
 			}
-			// Create hash of final URL
-			hasher := sha256.New()
-			hasher.Write([]byte(fullURL))
-			hash := fmt.Sprintf("%x", hasher.Sum(nil))[:20]
-
-			cachePath := ".cache/" + hash
-			if _, err := os.Stat(cachePath); err == nil {
-				slog.Info("cache hit", "hash", hash, "duration", time.Since(start))
-				serveBundle(w, r, hash)
-				return
+		}
+		if v := os.Getenv("LISTEN_SOCKET_MODE"); v != "" {
+			mode, err := strconv.ParseUint(v, 8, 32)
+			if err != nil || mode > 0777 {
+				log.Panicf("Invalid LISTEN_SOCKET_MODE %q, expected octal permissions like 0660", v)
 			}
-			slog.Info("cache miss", "hash", hash, "duration", time.Since(start))
+			socketMode = os.FileMode(mode)
+		}
+	} else if _, err := net.ResolveTCPAddr("tcp", addr); err != nil {
+		log.Panicf("Invalid listen address %q (BIND_ADDR=%q, PORT=%q): %v", addr, bindAddr, port, err)
+	}
 
-			// Cache miss - read response and build
-			content, err := io.ReadAll(resp.Body)
-			if err != nil {
-				sendError(w, "Failed to read response: "+err.Error(), err)
-				return
-			}
-			resp.Body.Close()
+	// Serve HTTPS directly when given a certificate. Requests then carry
+	// their TLS state, so URLs pointing back at the service use https
+	// without needing TRUST_PROXY.
+	certFile, keyFile := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	var tlsConfig *tls.Config
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			log.Panicf("TLS_CERT and TLS_KEY must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Panicf("Failed to load TLS certificate %s and key %s: %v", certFile, keyFile, err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
 
-			// Create temp directory
-			tmpDir, err := os.MkdirTemp("", "vite-build-*")
-			if err != nil {
-				sendError(w, "Failed to create temp dir: "+err.Error(), err)
-				return
-			}
-			// Create src directory
-			srcDir := tmpDir + "/src"
-			if err := os.MkdirAll(srcDir, 0755); err != nil {
-				sendError(w, "Failed to create src dir: "+err.Error(), err)
-				return
-			}
+	// Export traces if an OTLP endpoint is configured
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Panicf("Failed to set up tracing: %v", err)
+	}
 
-			fmt.Println(tmpDir)
-
-			// Copy package files
-			for _, file := range []string{"package.json", "bun.lock", "tsconfig.json"} {
-				content, err := os.ReadFile(file)
-				if err != nil {
-					sendError(w, "Failed to read "+file+": "+err.Error(), err)
-					return
-				}
-				if err := os.WriteFile(tmpDir+"/"+file, content, 0644); err != nil {
-					sendError(w, "Failed to write "+file+": "+err.Error(), err)
-					return
-				}
-			}
+	// Create TCP or Unix socket listener
+	var listener net.Listener
+	if socketPath != "" {
+		listener, err = listenUnix(socketPath, socketMode)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		log.Panicf("Failed to create listener: %v", err)
+	}
 
-			// TODO: this causes weird errors
-			// Copy node_modules directory
-			// cmd := exec.Command("cp", "-r", "node_modules", tmpDir+"/node_modules")
-			// if err := cmd.Run(); err != nil {
-			// 	sendError(w, "Failed to copy node_modules: "+err.Error(), err)
-			// 	return
-			// }
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+	if socketPath != "" {
+		log.Printf("Starting server on %s over unix socket %s", scheme, socketPath)
+	} else {
+		log.Printf("Starting server on %s://%s", scheme, listener.Addr())
+	}
 
-			if err := os.WriteFile(srcDir+"/index.ts", content, 0644); err != nil {
-				sendError(w, "Failed to write index.ts: "+err.Error(), err)
-				return
-			}
+	// Timeouts guard against slow clients. The write timeout is lifted for
+	// requests that have to build, since a cold build can take far longer
+	// than serving from the cache. TIMEOUT_PROFILE picks the defaults.
+	timeoutProfile := os.Getenv("TIMEOUT_PROFILE")
+	defaults := defaultTimeouts
+	if timeoutProfile != "" {
+		var ok bool
+		if defaults, ok = timeoutProfiles[timeoutProfile]; !ok {
+			log.Panicf("Invalid TIMEOUT_PROFILE %q, expected one of %s", timeoutProfile, strings.Join(slices.Sorted(maps.Keys(timeoutProfiles)), ", "))
+		}
+	}
+	readHeaderTimeout := envDuration("READ_HEADER_TIMEOUT", defaults.readHeader)
+	readTimeout := envDuration("READ_TIMEOUT", defaults.read)
+	writeTimeout := envDuration("WRITE_TIMEOUT", defaults.write)
+	idleTimeout := envDuration("IDLE_TIMEOUT", defaults.idle)
+	// Requests with larger headers are refused with a 431
+	maxHeaderBytes := int(envInt64("MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes))
+	if maxHeaderBytes <= 0 {
+		log.Panicf("Invalid MAX_HEADER_BYTES %d, expected a positive size", maxHeaderBytes)
+	}
+	// REQUEST_TIMEOUT bounds the whole of each request, builds included
+	requestTimeout := envDuration("REQUEST_TIMEOUT", defaults.request)
+	// FETCH_TIMEOUT bounds each upstream fetch, body included
+	fetchTimeout := envDuration("FETCH_TIMEOUT", defaults.fetch)
+	log.Printf("Timeouts: profile=%q read_header=%s read=%s write=%s idle=%s request=%s fetch=%s",
+		timeoutProfile, readHeaderTimeout, readTimeout, writeTimeout, idleTimeout, requestTimeout, fetchTimeout)
+
+	forwardQuery := envString("FORWARD_QUERY", forwardAll)
+	if !slices.Contains(forwardQueryModes, forwardQuery) {
+		log.Panicf("Invalid FORWARD_QUERY %q, expected one of %s", forwardQuery, strings.Join(forwardQueryModes, ", "))
+	}
+	forwardQueryParams := envList("FORWARD_QUERY_PARAMS")
+	if (forwardQuery == forwardAllowlist) != (len(forwardQueryParams) > 0) {
+		log.Panicf("FORWARD_QUERY_PARAMS must be set exactly when FORWARD_QUERY is %s", forwardAllowlist)
+	}
 
-			slog.Info("running dependency check", "duration", time.Since(start))
+	// COMPRESSION_LEVEL trades CPU for size for cache and response
+	// compression alike, and GZIP_LEVEL and BROTLI_LEVEL tune either
+	compressionLevel := envString("COMPRESSION_LEVEL", defaultCompression)
+	compression, ok := compressionPresets[compressionLevel]
+	if !ok {
+		log.Panicf("Invalid COMPRESSION_LEVEL %q, expected one of %s", compressionLevel, strings.Join(slices.Sorted(maps.Keys(compressionPresets)), ", "))
+	}
+	compression.gzip = int(envInt64("GZIP_LEVEL", int64(compression.gzip)))
+	compression.brotli = int(envInt64("BROTLI_LEVEL", int64(compression.brotli)))
+	if err := compression.validate(); err != nil {
+		log.Panicf("Invalid compression levels: %v", err)
+	}
+	log.Printf("Compression: level=%q gzip=%d brotli=%d", compressionLevel, compression.gzip, compression.brotli)
 
-			// Run depcheck
-			var stdout, stderr bytes.Buffer
-			cmd := exec.Command("bunx", "depcheck", "--json", "src/index.ts")
-			cmd.Dir = tmpDir
-			cmd.Stdout = &stdout
-			cmd.Stderr = &stderr
-			err = cmd.Run()
-			if err != nil {
-				if exitErr, ok := err.(*exec.ExitError); ok {
-					if exitErr.ExitCode() != 255 {
-						sendError(w, "Depcheck failed: "+stdout.String()+"\n"+stderr.String(), exitErr)
-						return
-					}
-				} else {
-					sendError(w, "Depcheck failed "+err.Error(), err)
-					return
-				}
-			}
-			output := stdout.Bytes()
+	installMode := envString("INSTALL_MODE", installSave)
+	if !slices.Contains(installModes, installMode) {
+		log.Panicf("Invalid INSTALL_MODE %q, expected one of %s", installMode, strings.Join(installModes, ", "))
+	}
 
-			var depcheck struct {
-				Missing map[string][]string `json:"missing"`
-			}
-			if err := json.Unmarshal(output, &depcheck); err != nil {
-				sendError(w, "Failed to parse depcheck output: "+err.Error(), err)
-				return
-			}
+	etagHash := envString("ETAG_HASH", etagShort)
+	if !slices.Contains(etagHashes, etagHash) {
+		log.Panicf("Invalid ETAG_HASH %q, expected one of %s", etagHash, strings.Join(etagHashes, ", "))
+	}
 
-			slog.Info("installed dependencies",
-				"missing_count", len(depcheck.Missing),
-				"duration", time.Since(start))
+	// Create server
+	h := newHandler(Config{
+		CacheDir:        cacheDir,
+		Cache:           cache,
+		CacheShardDepth: cacheShardDepth,
+		BuildTmpDir:     buildTmpDir,
+		ProjectRoot:     projectRoot,
+		// Negative caching of failed builds is opt-in
+		NegativeCacheTTL:         envDuration("NEGATIVE_CACHE_TTL", 0),
+		TrustProxy:               envBool("TRUST_PROXY", false),
+		UserAgent:                envString("FETCH_USER_AGENT", "esbuild-proxy"),
+		ForwardHeaders:           envList("FORWARD_HEADERS"),
+		IgnoredQueryParams:       envList("IGNORE_QUERY_PARAMS"),
+		ForwardQuery:             forwardQuery,
+		ForwardQueryParams:       forwardQueryParams,
+		Pins:                     pins,
+		URLRewrites:              urlRewrites,
+		Shims:                    shims,
+		Templates:                templates,
+		ContentAddressedRedirect: envBool("CONTENT_ADDRESSED_REDIRECT", false),
+		CompressCache:            envBool("CACHE_COMPRESSION", false),
+		CompressResponses:        envBool("RESPONSE_COMPRESSION", true),
+		CompressionLevels:        compression,
+		BuildOptions:             buildOptions,
+		BuildConfigFingerprint:   configFingerprint,
+		EnvDefines:               envDefs,
+		CacheSalt:                os.Getenv("CACHE_SALT"),
+		RevalidateAfter:          envDuration("REVALIDATE_AFTER", 0),
+		MaxBundleBytes:           envInt64("MAX_BUNDLE_BYTES", 0),
+		MaxSourceBytes:           envInt64("MAX_SOURCE_BYTES", 0),
+		ContentKeyHosts:          envList("CONTENT_KEY_HOSTS"),
+		ETagHash:                 etagHash,
+		WeakCompressedETags:      envBool("ETAG_WEAK_COMPRESSED", false),
+		HotCacheEntries:          int(envInt64("HOT_CACHE_ENTRIES", 1000)),
+		HotCacheBytes:            envInt64("HOT_CACHE_BYTES", 64<<20),
+		AllowedSchemes:           envList("ALLOWED_SCHEMES"),
+		DevMode:                  envBool("DEV_MODE", false),
+		SelfTest:                 envBool("SELF_TEST", true),
+		WarmupURLs:               envList("WARMUP_URLS"),
+		StaleAfter:               envDuration("STALE_WHILE_REVALIDATE", 0),
+		SlowBuildThreshold:       envDuration("SLOW_BUILD_THRESHOLD", 10*time.Second),
+		InstallScripts:           installScripts,
+		InstallMode:              installMode,
+		LenientInstall:           envBool("LENIENT_INSTALL", false),
+		DenyPackages:             denyPackages,
+		ServeLastGood:            envBool("SERVE_LAST_GOOD", false),
+		SandboxUser:              sandbox,
+		BuildMemoryLimit:         buildMemoryLimit,
+		BuildCPULimit:            buildCPULimit,
+		RefreshTop:               int(envInt64("REFRESH_TOP", 0)),
+		RefreshInterval:          envDuration("REFRESH_INTERVAL", 5*time.Minute),
+		RefreshMaxAge:            envDuration("REFRESH_MAX_AGE", time.Hour),
+		DepcheckExitCodes:        envIntList("DEPCHECK_OK_EXIT_CODES"),
+		BunBin:                   bunBin,
+		BunxBin:                  bunxBin,
+		NoInstall:                noInstall,
+		Npmrc:                    npmrc,
+		RootPage:                 rootPage,
+		RootRedirect:             rootRedirect,
+		ImportMapTemplate:        os.Getenv("IMPORT_MAP_TEMPLATE"),
+		MaxURLLength:             int(envInt64("MAX_URL_LENGTH", 4096)),
+		MaxBodyBytes:             envInt64("MAX_BODY_BYTES", 10<<20),
+		HostFallbacks:            envMap("FALLBACK_HOSTS"),
+		BreakerThreshold:         int(envInt64("BREAKER_THRESHOLD", 5)),
+		MaxConcurrentFetches:     int(envInt64("MAX_CONCURRENT_FETCHES", 0)),
+		BreakerCooldown:          envDuration("BREAKER_COOLDOWN", 30*time.Second),
+		AdminToken:               os.Getenv("ADMIN_TOKEN"),
+		ReadOnly:                 envBool("READ_ONLY", false),
+		BuildOptionsHeader:       envBool("BUILD_OPTIONS_HEADER", false),
+		SRIHeader:                envBool("SRI_HEADER", false),
+		VerifyBundles:            envBool("VERIFY_BUNDLES", false),
+		FetchTimeout:             fetchTimeout,
+		WatchInterval:            envDuration("WATCH_INTERVAL", 2*time.Second),
+		WatchTimeout:             envDuration("WATCH_TIMEOUT", 30*time.Second),
+		ServerSettings: map[string]string{
+			"listenAddr":        listener.Addr().String(),
+			"tls":               strconv.FormatBool(tlsConfig != nil),
+			"readHeaderTimeout": readHeaderTimeout.String(),
+			"readTimeout":       readTimeout.String(),
+			"writeTimeout":      writeTimeout.String(),
+			"idleTimeout":       idleTimeout.String(),
+			"maxHeaderBytes":    strconv.Itoa(maxHeaderBytes),
+			"requestTimeout":    requestTimeout.String(),
+			"timeoutProfile":    timeoutProfile,
+		},
+	})
+	quietPaths := envList("LOG_QUIET_PATHS")
+	if _, ok := os.LookupEnv("LOG_QUIET_PATHS"); !ok {
+		quietPaths = []string{"/healthz", "/readyz", "/metrics"}
+	}
+	hitSample := envInt64("LOG_HIT_SAMPLE", 1)
+	if hitSample < 1 {
+		log.Panicf("Invalid LOG_HIT_SAMPLE %d, expected at least 1", hitSample)
+	}
+	var root http.Handler = loggingMiddleware(tracingMiddleware(timeoutMiddleware(h, requestTimeout)), quietPaths, hitSample)
+	// HTTP/2 is negotiated automatically over TLS. H2C additionally accepts
+	// cleartext HTTP/2, for use behind proxies that speak it to backends.
+	if envBool("H2C", false) {
+		root = h2c.NewHandler(root, &http2.Server{})
+	}
 
-			// Install missing dependencies
-			args := []string{"install"}
-			if len(depcheck.Missing) > 0 {
-				args = append(args, "--save")
-			}
-			for pkg := range depcheck.Missing {
-				args = append(args, pkg)
-			}
-			cmd = exec.Command("bun", args...)
-			cmd.Dir = tmpDir
-			stdout.Reset()
-			stderr.Reset()
-			cmd.Stdout = &stdout
-			cmd.Stderr = &stdout
-			err = cmd.Run()
-			if err != nil {
-				if exitErr, ok := err.(*exec.ExitError); ok {
-					sendError(w, "bun install failed: "+stdout.String(), exitErr)
-				} else {
-					sendError(w, "bun install failed: "+err.Error(), err)
-				}
-				return
-			}
+	server := &http.Server{
+		Handler:           root,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+		TLSConfig:         tlsConfig,
+	}
 
-			result := api.Build(api.BuildOptions{
-				EntryPoints:       []string{filepath.Join(srcDir, "index.ts")},
-				Bundle:            true,
-				Write:             true,
-				Outfile:           filepath.Join(tmpDir, "dist", "bundle.js"),
-				Target:            api.ES2015,
-				Format:            api.FormatESModule,
-				Sourcemap:         api.SourceMapLinked,
-				MinifyWhitespace:  true,
-				MinifyIdentifiers: true,
-				MinifySyntax:      true,
-			})
-
-			if len(result.Errors) > 0 {
-				sendError(w, "Build failed", fmt.Errorf("build failed: %v errors", result.Errors))
-				return
-			}
+	// Channel to listen for shutdown signals
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
-			// Read and return bundle.js
-			bundle, err := os.ReadFile(tmpDir + "/dist/bundle.js")
+	// SIGHUP flushes the cache without a restart
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("Flushing cache...")
+			entries, size, err := h.cache.Flush()
+			h.hot.clear()
 			if err != nil {
-				sendError(w, "Failed to read bundle.js: "+err.Error(), err)
-				return
-			}
-
-			// Write bundle to cache
-			if err := os.WriteFile(cachePath, bundle, 0644); err != nil {
-				sendError(w, "Failed to write to cache: "+err.Error(), err)
-				return
+				log.Printf("Failed to flush cache: %v", err)
+				continue
 			}
-			// TODO: don't write and read the same file
-
-			// Redirect to URL with hash
-			serveBundle(w, r, hash)
-
-			// After dependency check
-			slog.Info("installed dependencies",
-				"missing_count", len(depcheck.Missing),
-				"duration", time.Since(start))
+			slog.Info("cache flushed", "entries", entries, "bytes", size)
+		}
+	}()
 
-			// After build
-			slog.Info("build completed", "duration", time.Since(start))
+	if h.readOnly.Load() {
+		log.Println("Read-only, serving cached bundles without building")
+	}
 
-			// After caching
-			slog.Info("bundle cached and ready to serve",
-				"size", len(bundle),
-				"total_duration", time.Since(start))
-		})),
+	// Pick up the hit counts, stats and hot files of the last run
+	if pruned, err := h.loadState(); err != nil {
+		log.Printf("Failed to load saved state, starting fresh: %v", err)
+	} else if pruned > 0 {
+		log.Printf("Dropped %d saved hot cache files that no longer exist", pruned)
+	}
+	stateCtx, stopSaving := context.WithCancel(context.Background())
+	defer stopSaving()
+	go h.saveStateLoop(stateCtx)
+
+	// Check the build pipeline works and prebuild popular URLs before
+	// reporting ready, while the listener already answers probes. An
+	// instance failing the self-test stays up, not ready, so /readyz can
+	// say why.
+	if h.cfg.SelfTest || len(h.cfg.WarmupURLs) > 0 {
+		go func() {
+			if err := h.warmup(withRequestID(context.Background(), "warmup")); err != nil {
+				log.Printf("Self-test failed, not ready until restarted, set SELF_TEST=false to skip it: %v", err)
+			}
+		}()
 	}
 
-	// Channel to listen for shutdown signals
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	// Keep popular bundles fresh in the background
+	refreshCtx, stopRefresh := context.WithCancel(withRequestID(context.Background(), "refresh"))
+	defer stopRefresh()
+	go h.refreshLoop(refreshCtx)
 
 	// Start server in goroutine
 	go func() {
-		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		serve := server.Serve
+		if tlsConfig != nil {
+			serve = func(l net.Listener) error { return server.ServeTLS(l, "", "") }
+		}
+		if err := serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server error: %v", err)
 		}
 	}()
@@ -381,6 +602,26 @@ func main() {
 	if err := server.Shutdown(ctx); err != nil {
 		log.Printf("Server forced to shutdown: %v", err)
 	}
+	// Closing the listener normally removes its socket already, make sure
+	// nothing is left in the way of the next start
+	if socketPath != "" {
+		if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove socket %s: %v", socketPath, err)
+		}
+	}
+
+	// Let in-flight builds finish writing to the cache
+	stopRefresh()
+	if err := h.waitForBuilds(ctx); err != nil {
+		log.Printf("Timed out waiting for in-flight builds: %v", err)
+	}
+	stopSaving()
+	if err := h.saveState(); err != nil {
+		log.Printf("Failed to save state: %v", err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("Failed to flush traces: %v", err)
+	}
 
 	log.Println("Server exited")
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// serviceMetrics counts events worth tracking for capacity planning.
+type serviceMetrics struct {
+	// coalesced counts requests that joined work already in flight for
+	// the same cache entry instead of starting their own.
+	coalesced atomic.Int64
+	// slowBuilds counts builds that took longer than SlowBuildThreshold.
+	slowBuilds atomic.Int64
+	// buildsInFlight is how many builds are running.
+	buildsInFlight atomic.Int64
+	// lastGoodServed counts failed builds answered with the last good
+	// bundle instead, with ServeLastGood.
+	lastGoodServed atomic.Int64
+	// emergencyEvictions counts evictions forced by cache writes finding
+	// the disk full.
+	emergencyEvictions atomic.Int64
+}
+
+func (m *serviceMetrics) writeMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP requests_coalesced_total Requests that joined an in-flight build or revalidation of the same bundle.")
+	fmt.Fprintln(w, "# TYPE requests_coalesced_total counter")
+	fmt.Fprintf(w, "requests_coalesced_total %d\n", m.coalesced.Load())
+	fmt.Fprintln(w, "# HELP slow_builds_total Builds that took longer than SLOW_BUILD_THRESHOLD.")
+	fmt.Fprintln(w, "# TYPE slow_builds_total counter")
+	fmt.Fprintf(w, "slow_builds_total %d\n", m.slowBuilds.Load())
+	fmt.Fprintln(w, "# HELP builds_in_flight Builds currently running.")
+	fmt.Fprintln(w, "# TYPE builds_in_flight gauge")
+	fmt.Fprintf(w, "builds_in_flight %d\n", m.buildsInFlight.Load())
+	fmt.Fprintln(w, "# HELP last_good_served_total Failed builds answered with the last good bundle instead, with SERVE_LAST_GOOD.")
+	fmt.Fprintln(w, "# TYPE last_good_served_total counter")
+	fmt.Fprintf(w, "last_good_served_total %d\n", m.lastGoodServed.Load())
+	fmt.Fprintln(w, "# HELP cache_emergency_evictions_total Evictions of the oldest cache entries after a cache write found the disk full.")
+	fmt.Fprintln(w, "# TYPE cache_emergency_evictions_total counter")
+	fmt.Fprintf(w, "cache_emergency_evictions_total %d\n", m.emergencyEvictions.Load())
+}
+
+// serveMetrics serves metrics in the Prometheus text format.
+func (h *handler) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	h.metrics.writeMetrics(w)
+	h.breaker.writeMetrics(w)
+	h.fetches.writeMetrics(w)
+}
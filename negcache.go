@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// negativeCache remembers recent failures so that persistently broken URLs
+// aren't rebuilt from scratch on every request. A zero ttl disables it.
+type negativeCache struct {
+	mu sync.Mutex
+	// ttl is a time.Duration, atomic so it can be changed at runtime.
+	ttl     atomic.Int64
+	entries map[string]negativeEntry
+}
+
+type negativeEntry struct {
+	err     *buildError
+	expires time.Time
+}
+
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	c := &negativeCache{entries: map[string]negativeEntry{}}
+	c.setTTL(ttl)
+	return c
+}
+
+func (c *negativeCache) getTTL() time.Duration { return time.Duration(c.ttl.Load()) }
+
+// setTTL changes how long new failures are remembered. Existing entries
+// keep their expiry.
+func (c *negativeCache) setTTL(ttl time.Duration) { c.ttl.Store(int64(ttl)) }
+
+func (c *negativeCache) get(hash string) (negativeEntry, bool) {
+	if c.getTTL() <= 0 {
+		return negativeEntry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[hash]
+	if !ok {
+		return negativeEntry{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, hash)
+		return negativeEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *negativeCache) add(hash string, err *buildError) {
+	ttl := c.getTTL()
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[hash] = negativeEntry{err: err, expires: time.Now().Add(ttl)}
+}
+
+func (c *negativeCache) clear(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, hash)
+}
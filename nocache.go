@@ -0,0 +1,24 @@
+package main
+
+import "net/http"
+
+// bypassCache reports whether r asks with ?cache=false for a fresh build
+// that neither reads nor writes the cache. It is for checking that an
+// upstream change builds, or that a cached bundle is still what the source
+// builds to, without disturbing the entry clients are served.
+func bypassCache(r *http.Request) bool {
+	return r.URL.Query().Get("cache") == "false"
+}
+
+// serveUncached serves a bundle built with ?cache=false, or one that
+// couldn't be cached because the disk is full. Sourcemaps are inlined
+// since there is no cache entry to link them from, and stylesheets and
+// assets the build emitted aren't served at all.
+func (h *handler) serveUncached(w http.ResponseWriter, r *http.Request, timing *serverTiming, bundle []byte) {
+	w.Header().Set("Server-Timing", timing.String())
+	w.Header().Set("X-Cache", "BYPASS")
+	if h.cfg.SRIHeader {
+		w.Header().Set("X-SRI", integrity(bundle))
+	}
+	h.serveBytes(w, r, bundle, h.bundleSum(bundle), "", "application/javascript", "no-store")
+}
@@ -0,0 +1,808 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// buildParams holds the per-request build options parsed from the query
+// string. These are consumed by the service and not forwarded upstream.
+type buildParams struct {
+	define map[string]string
+	// sourcemap is one of the sourceMapModes keys, or empty for the
+	// default: inline in dev mode, linked otherwise.
+	sourcemap string
+	// tsconfig is a canonicalized tsconfig.json that replaces the project's
+	// own for this build.
+	tsconfig string
+	// loader maps file extensions (".png") to esbuild loaders for imported
+	// assets.
+	loader map[string]api.Loader
+	// entryLoader is the loader of the entry source itself, one of js,
+	// jsx, ts or tsx, given as a bare ?loader=jsx. Without it the loader
+	// follows the source URL's extension.
+	entryLoader string
+	// banner and footer are prepended and appended to the JS output.
+	banner, footer string
+	// target, format and platform are keys of the esTargets, formats and
+	// platforms maps, or empty for the configured default.
+	target, format, platform string
+	// engines are the browsers and runtimes to lower syntax for, by
+	// engineNames key and version, in name order. They replace the
+	// configured target, but an explicit target still applies, and output
+	// then only uses syntax both support.
+	engines []api.Engine
+	// minify, when set, turns all of esbuild's minification on or off.
+	// Without whitespace minification esbuild prints the bundle indented,
+	// one statement per line.
+	minify *bool
+	// minifySyntax, when set, turns syntax minification on or off on its
+	// own, after minify, so constant folding and dead code removal can be
+	// left out of an otherwise minified or unminified bundle.
+	minifySyntax *bool
+	// legalComments and charset are keys of the legalCommentModes and
+	// charsets maps, or empty for the configured default. Legal comments
+	// collected into a separate file with linked or external are served
+	// from /_legal/<hash>.txt.
+	legalComments, charset string
+	// drop removes console calls and debugger statements, as keys of
+	// dropModes in sorted order.
+	drop []string
+	// pure lists functions, like console.log, whose calls esbuild may drop
+	// when their result is unused, in sorted order. Unlike drop=console,
+	// which removes every console call, a pure call whose result is used
+	// stays, and its arguments are still evaluated if they have side
+	// effects.
+	pure []string
+	// keepNames preserves function and class names through minification,
+	// for code relying on Function.prototype.name. It makes bundles
+	// slightly larger.
+	keepNames bool
+	// external lists packages left as imports instead of being bundled.
+	external []string
+	// alias maps packages imported by the source to the packages imported
+	// instead, like lodash to lodash-es, and the replacements are what get
+	// installed. Aliasing happens before external is applied, so external
+	// has to name the replacement to keep it as an import. Only package
+	// names are accepted: paths would let a request bundle files from the
+	// server.
+	alias map[string]string
+	// conditions lists the custom conditions matched in package.json
+	// exports maps, in sorted order, e.g. worker or production. esbuild
+	// always matches default, import or require, and browser or node
+	// depending on platform, so those needn't be listed. Setting any
+	// replaces its default custom condition, module, which has to be
+	// listed too if still wanted.
+	conditions []string
+	// bundle, when false, only transpiles the fetched file. Every import is
+	// left untouched, so dependencies aren't installed and external has no
+	// effect.
+	bundle *bool
+	// entry lists the exports of the fetched module to bundle, in sorted
+	// order. When set, the bundle is built from a generated module
+	// re-exporting only these, so everything else is tree-shaken away.
+	entry []string
+	// inject lists shims, by file name in the shims directory, imported
+	// into every module on top of the configured ones, in sorted order.
+	inject []string
+	// template names the project template the build directory starts
+	// from, with its own package.json and tsconfig.json, or is empty for
+	// the project root's.
+	template string
+	// splitting splits code shared by dynamic imports into chunks, served
+	// from /chunks/<hash>/.
+	splitting bool
+	// iifeGlobal builds a classic script assigning the module's default
+	// export, or its namespace if it has none, to this global. Classic
+	// scripts work without type=module and in old browsers, but loading
+	// two of them duplicates their shared dependencies, top-level await
+	// isn't supported, and external imports become require calls that
+	// fail in browsers.
+	iifeGlobal string
+	// raw transpiles the fetched file on its own with esbuild's transform
+	// API, without a build directory, installs or bundling.
+	raw bool
+	// typecheck runs tsc over the source before bundling, failing the
+	// build on type errors.
+	typecheck bool
+	// types generates TypeScript declarations for the source next to the
+	// bundle, served from /_types/.
+	types bool
+}
+
+// maxBannerLength limits the size of the banner and footer params.
+const maxBannerLength = 4096
+
+// The query string of a request is split three ways:
+//
+//   - control params (controlParams) configure the build. They are consumed
+//     by the service, never forwarded upstream, and folded into the cache
+//     key in sorted order so equivalent requests share an entry.
+//   - ignored params (Config.IgnoredQueryParams), such as cache-busting
+//     nonces, are dropped entirely: not forwarded and not part of the key.
+//   - everything else belongs to the upstream URL. It is forwarded verbatim
+//     and, as part of that URL, keys the cache in its original order.
+//     Config.ForwardQuery can forward none of it, or only the params in
+//     Config.ForwardQueryParams, for upstreams that reject or misread
+//     params they don't expect. What isn't forwarded isn't part of the key
+//     either.
+//
+// Names are matched in that order, so an upstream parameter that shares a
+// name with a control param can't be forwarded.
+
+// Which upstream params are forwarded, set by Config.ForwardQuery.
+const (
+	forwardAll       = "all"
+	forwardNone      = "none"
+	forwardAllowlist = "allowlist"
+)
+
+var forwardQueryModes = []string{forwardAll, forwardNone, forwardAllowlist}
+
+// buildParamNames lists the query parameters that change the built
+// bundle. Each is parsed into buildParams and must be written by cacheKey,
+// otherwise requests differing only in it would share a cache entry.
+var buildParamNames = []string{"define", "sourcemap", "tsconfig", "loader", "banner", "footer", "target", "engines", "format", "platform", "minify", "minify_syntax", "keep_names", "legal_comments", "charset", "drop", "external", "alias", "conditions", "bundle", "typecheck", "types", "entry", "inject", "template", "splitting", "pure", "iife_global", "raw"}
+
+// responseParamNames lists the query parameters that change how a request
+// is answered but not what is built, so they aren't part of the cache key.
+var responseParamNames = []string{"meta", "analyze", "manifest", "download", "skip_type_check", "revalidate", "wrap", "cache", "watch"}
+
+// controlParams lists the query parameters consumed by the service. They
+// are stripped before the URL is fetched.
+var controlParams = slices.Concat(buildParamNames, responseParamNames)
+
+var sourceMapModes = map[string]api.SourceMap{
+	"none":     api.SourceMapNone,
+	"inline":   api.SourceMapInline,
+	"external": api.SourceMapExternal,
+	"linked":   api.SourceMapLinked,
+}
+
+var loaders = map[string]api.Loader{
+	"base64":  api.LoaderBase64,
+	"binary":  api.LoaderBinary,
+	"copy":    api.LoaderCopy,
+	"css":     api.LoaderCSS,
+	"dataurl": api.LoaderDataURL,
+	"empty":   api.LoaderEmpty,
+	"file":    api.LoaderFile,
+	"js":      api.LoaderJS,
+	"json":    api.LoaderJSON,
+	"jsx":     api.LoaderJSX,
+	"text":    api.LoaderText,
+	"ts":      api.LoaderTS,
+	"tsx":     api.LoaderTSX,
+}
+
+var esTargets = map[string]api.Target{
+	"esnext": api.ESNext,
+	"es5":    api.ES5,
+	"es2015": api.ES2015,
+	"es2016": api.ES2016,
+	"es2017": api.ES2017,
+	"es2018": api.ES2018,
+	"es2019": api.ES2019,
+	"es2020": api.ES2020,
+	"es2021": api.ES2021,
+	"es2022": api.ES2022,
+	"es2023": api.ES2023,
+	"es2024": api.ES2024,
+}
+
+// engineNames are the engines ?engines= can name, as in engines=chrome100,safari15.
+var engineNames = map[string]api.EngineName{
+	"chrome":  api.EngineChrome,
+	"deno":    api.EngineDeno,
+	"edge":    api.EngineEdge,
+	"firefox": api.EngineFirefox,
+	"hermes":  api.EngineHermes,
+	"ie":      api.EngineIE,
+	"ios":     api.EngineIOS,
+	"node":    api.EngineNode,
+	"opera":   api.EngineOpera,
+	"rhino":   api.EngineRhino,
+	"safari":  api.EngineSafari,
+}
+
+// enginePattern matches an engine and the version esbuild accepts for it,
+// X, X.Y or X.Y.Z.
+var enginePattern = regexp.MustCompile(`^([a-z]+)(\d+(?:\.\d+){0,2})$`)
+
+var legalCommentModes = map[string]api.LegalComments{
+	"none":     api.LegalCommentsNone,
+	"inline":   api.LegalCommentsInline,
+	"eof":      api.LegalCommentsEndOfFile,
+	"linked":   api.LegalCommentsLinked,
+	"external": api.LegalCommentsExternal,
+}
+
+var charsets = map[string]api.Charset{
+	"ascii": api.CharsetASCII,
+	"utf8":  api.CharsetUTF8,
+}
+
+var dropModes = map[string]api.Drop{
+	"console":  api.DropConsole,
+	"debugger": api.DropDebugger,
+}
+
+var formats = map[string]api.Format{
+	"esm":  api.FormatESModule,
+	"cjs":  api.FormatCommonJS,
+	"iife": api.FormatIIFE,
+}
+
+var platforms = map[string]api.Platform{
+	"browser": api.PlatformBrowser,
+	"node":    api.PlatformNode,
+	"neutral": api.PlatformNeutral,
+}
+
+// parseEnum validates value against the keys of values, naming param in
+// the error.
+func parseEnum[T any](param, value string, values map[string]T) (string, error) {
+	if _, ok := values[value]; value != "" && !ok {
+		return "", fmt.Errorf("invalid %s %q, expected one of %s", param, value, strings.Join(slices.Sorted(maps.Keys(values)), ", "))
+	}
+	return value, nil
+}
+
+func parseBuildParams(query url.Values) (buildParams, error) {
+	params := buildParams{define: map[string]string{}, loader: map[string]api.Loader{}, alias: map[string]string{}}
+	for _, d := range query["define"] {
+		key, value, ok := strings.Cut(d, "=")
+		if !ok || key == "" {
+			return params, fmt.Errorf("invalid define %q, expected key=value", d)
+		}
+		params.define[key] = value
+	}
+	for _, a := range query["alias"] {
+		from, to, ok := strings.Cut(a, "=")
+		if !ok || !packageNamePattern.MatchString(from) || !packagePathPattern.MatchString(to) {
+			return params, fmt.Errorf("invalid alias %q, expected package=replacement like alias=lodash=lodash-es", a)
+		}
+		params.alias[from] = to
+	}
+	if mode := query.Get("sourcemap"); mode != "" {
+		if _, ok := sourceMapModes[mode]; !ok {
+			return params, fmt.Errorf("invalid sourcemap %q, expected none, inline, external or linked", mode)
+		}
+		params.sourcemap = mode
+	}
+	if raw := query.Get("tsconfig"); raw != "" {
+		tsconfig, err := parseTsconfig(raw)
+		if err != nil {
+			return params, err
+		}
+		params.tsconfig = tsconfig
+	}
+	for _, l := range query["loader"] {
+		switch l {
+		case "js", "jsx", "ts", "tsx":
+			params.entryLoader = l
+			continue
+		}
+		ext, name, ok := strings.Cut(l, "=")
+		loader, known := loaders[name]
+		if !ok || !strings.HasPrefix(ext, ".") || !known {
+			return params, fmt.Errorf("invalid loader %q, expected .ext=loader, or js, jsx, ts or tsx for the entry", l)
+		}
+		params.loader[ext] = loader
+	}
+	params.banner, params.footer = query.Get("banner"), query.Get("footer")
+	if len(params.banner) > maxBannerLength || len(params.footer) > maxBannerLength {
+		return params, fmt.Errorf("banner and footer are limited to %d bytes", maxBannerLength)
+	}
+	var err error
+	if params.target, err = parseEnum("target", query.Get("target"), esTargets); err != nil {
+		return params, err
+	}
+	for _, v := range query["engines"] {
+		for _, spec := range strings.Split(v, ",") {
+			if spec = strings.TrimSpace(spec); spec == "" {
+				continue
+			}
+			m := enginePattern.FindStringSubmatch(spec)
+			if m == nil {
+				return params, fmt.Errorf("invalid engine %q, expected a name and version like engines=chrome100,safari15", spec)
+			}
+			name, ok := engineNames[m[1]]
+			if !ok {
+				return params, fmt.Errorf("invalid engine %q, expected one of %s", m[1], strings.Join(slices.Sorted(maps.Keys(engineNames)), ", "))
+			}
+			if slices.ContainsFunc(params.engines, func(e api.Engine) bool { return e.Name == name }) {
+				return params, fmt.Errorf("engine %s is given more than one version", m[1])
+			}
+			params.engines = append(params.engines, api.Engine{Name: name, Version: m[2]})
+		}
+	}
+	slices.SortFunc(params.engines, func(a, b api.Engine) int { return int(a.Name) - int(b.Name) })
+	if params.format, err = parseEnum("format", query.Get("format"), formats); err != nil {
+		return params, err
+	}
+	if params.platform, err = parseEnum("platform", query.Get("platform"), platforms); err != nil {
+		return params, err
+	}
+	if params.legalComments, err = parseEnum("legal_comments", query.Get("legal_comments"), legalCommentModes); err != nil {
+		return params, err
+	}
+	if params.charset, err = parseEnum("charset", query.Get("charset"), charsets); err != nil {
+		return params, err
+	}
+	if v := query.Get("minify"); v != "" {
+		minify, err := strconv.ParseBool(v)
+		if err != nil {
+			return params, fmt.Errorf("invalid minify %q, expected true or false", v)
+		}
+		params.minify = &minify
+	}
+	if v := query.Get("minify_syntax"); v != "" {
+		minifySyntax, err := strconv.ParseBool(v)
+		if err != nil {
+			return params, fmt.Errorf("invalid minify_syntax %q, expected true or false", v)
+		}
+		params.minifySyntax = &minifySyntax
+	}
+	if v := query.Get("keep_names"); v != "" {
+		if params.keepNames, err = strconv.ParseBool(v); err != nil {
+			return params, fmt.Errorf("invalid keep_names %q, expected true or false", v)
+		}
+	}
+	if v := query.Get("typecheck"); v != "" {
+		if params.typecheck, err = strconv.ParseBool(v); err != nil {
+			return params, fmt.Errorf("invalid typecheck %q, expected true or false", v)
+		}
+	}
+	if v := query.Get("types"); v != "" {
+		if params.types, err = strconv.ParseBool(v); err != nil {
+			return params, fmt.Errorf("invalid types %q, expected true or false", v)
+		}
+	}
+	if v := query.Get("splitting"); v != "" {
+		if params.splitting, err = strconv.ParseBool(v); err != nil {
+			return params, fmt.Errorf("invalid splitting %q, expected true or false", v)
+		}
+	}
+	if v := query.Get("bundle"); v != "" {
+		bundle, err := strconv.ParseBool(v)
+		if err != nil {
+			return params, fmt.Errorf("invalid bundle %q, expected true or false", v)
+		}
+		params.bundle = &bundle
+	}
+	for _, v := range query["drop"] {
+		for _, mode := range strings.Split(v, ",") {
+			if mode = strings.TrimSpace(mode); mode == "" || slices.Contains(params.drop, mode) {
+				continue
+			}
+			if _, err := parseEnum("drop", mode, dropModes); err != nil {
+				return params, err
+			}
+			params.drop = append(params.drop, mode)
+		}
+	}
+	slices.Sort(params.drop)
+	for _, v := range query["pure"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name == "" || slices.Contains(params.pure, name) {
+				continue
+			}
+			if !dottedNamePattern.MatchString(name) {
+				return params, fmt.Errorf("invalid pure %q, expected function names like pure=console.log,assert", name)
+			}
+			params.pure = append(params.pure, name)
+		}
+	}
+	slices.Sort(params.pure)
+	for _, v := range query["external"] {
+		for _, pkg := range strings.Split(v, ",") {
+			if pkg = strings.TrimSpace(pkg); pkg != "" && !slices.Contains(params.external, pkg) {
+				params.external = append(params.external, pkg)
+			}
+		}
+	}
+	slices.Sort(params.external)
+	for _, v := range query["conditions"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name == "" || slices.Contains(params.conditions, name) {
+				continue
+			}
+			if !conditionNamePattern.MatchString(name) {
+				return params, fmt.Errorf("invalid condition %q, expected names like conditions=worker,production", name)
+			}
+			params.conditions = append(params.conditions, name)
+		}
+	}
+	slices.Sort(params.conditions)
+	for _, v := range query["entry"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name == "" || slices.Contains(params.entry, name) {
+				continue
+			}
+			if !exportNamePattern.MatchString(name) {
+				return params, fmt.Errorf("invalid entry %q, expected export names like entry=format,parse", name)
+			}
+			params.entry = append(params.entry, name)
+		}
+	}
+	slices.Sort(params.entry)
+	for _, v := range query["inject"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name == "" || slices.Contains(params.inject, name) {
+				continue
+			}
+			if !shimNamePattern.MatchString(name) {
+				return params, fmt.Errorf("invalid inject %q, expected the file name of a shim", name)
+			}
+			params.inject = append(params.inject, name)
+		}
+	}
+	slices.Sort(params.inject)
+	if params.template = query.Get("template"); params.template != "" && !templateNamePattern.MatchString(params.template) {
+		return params, fmt.Errorf("invalid template %q, expected the name of a template directory", params.template)
+	}
+	if len(params.entry) > 0 && params.bundle != nil && !*params.bundle {
+		return params, fmt.Errorf("entry needs bundling, it can't be combined with bundle=false")
+	}
+	if params.iifeGlobal = query.Get("iife_global"); params.iifeGlobal != "" {
+		if !dottedNamePattern.MatchString(params.iifeGlobal) {
+			return params, fmt.Errorf("invalid iife_global %q, expected a global name like iife_global=MyLib", params.iifeGlobal)
+		}
+		if params.format != "" && params.format != "iife" {
+			return params, fmt.Errorf("iife_global builds an iife, it can't be combined with format=%s", params.format)
+		}
+		if params.splitting {
+			return params, fmt.Errorf("iife_global can't be combined with splitting, which needs esm")
+		}
+	}
+	if v := query.Get("raw"); v != "" {
+		if params.raw, err = strconv.ParseBool(v); err != nil {
+			return params, fmt.Errorf("invalid raw %q, expected true or false", v)
+		}
+	}
+	if v := query.Get("wrap"); v != "" {
+		if _, ok := wrapContentTypes[v]; !ok {
+			return params, fmt.Errorf("invalid wrap %q, expected dataurl or json", v)
+		}
+	}
+	if v := query.Get("watch"); v != "" && v != "true" {
+		return params, fmt.Errorf("invalid watch %q, expected true", v)
+	}
+	if v := query.Get("cache"); v != "" {
+		if v != "true" && v != "false" {
+			return params, fmt.Errorf("invalid cache %q, expected true or false", v)
+		}
+		if v == "false" {
+			for _, conflict := range []struct {
+				name string
+				set  bool
+			}{
+				{"meta", query.Get("meta") == "true"},
+				{"analyze", query.Get("analyze") == "true"},
+				{"manifest", query.Get("manifest") == "true"},
+				{"wrap", query.Get("wrap") != ""},
+				{"types", params.types},
+				{"splitting", params.splitting},
+			} {
+				if conflict.set {
+					return params, fmt.Errorf("%s is served from the cache, it can't be combined with cache=false", conflict.name)
+				}
+			}
+		}
+	}
+	if params.raw {
+		for _, conflict := range []struct {
+			name string
+			set  bool
+		}{
+			{"splitting", params.splitting},
+			{"entry", len(params.entry) > 0},
+			{"alias", len(params.alias) > 0},
+			{"inject", len(params.inject) > 0},
+			{"template", params.template != ""},
+			{"typecheck", params.typecheck},
+			{"types", params.types},
+			{"meta", query.Get("meta") == "true"},
+			{"analyze", query.Get("analyze") == "true"},
+		} {
+			if conflict.set {
+				return params, fmt.Errorf("raw only transpiles the file, it can't be combined with %s", conflict.name)
+			}
+		}
+	}
+	if params.splitting && params.bundle != nil && !*params.bundle {
+		return params, fmt.Errorf("splitting needs bundling, it can't be combined with bundle=false")
+	}
+	return params, nil
+}
+
+// dottedNamePattern matches possibly dotted identifiers, like the function
+// names accepted by the pure param.
+var dottedNamePattern = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*(\.[A-Za-z_$][A-Za-z0-9_$]*)*$`)
+
+// packageNamePattern matches npm package names, scoped or not, and
+// packagePathPattern those followed by an optional subpath, as accepted by
+// the alias param.
+var (
+	packageNamePattern = regexp.MustCompile(`^(@[a-z0-9][a-z0-9._~-]*/)?[a-z0-9][a-z0-9._~-]*$`)
+	packagePathPattern = regexp.MustCompile(`^(@[a-z0-9][a-z0-9._~-]*/)?[a-z0-9][a-z0-9._~-]*(/[A-Za-z0-9_~-][A-Za-z0-9._~-]*)*$`)
+)
+
+// conditionNamePattern matches the package.json exports conditions
+// accepted by the conditions param.
+var conditionNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+
+// exportNamePattern matches the export names accepted by the entry param.
+var exportNamePattern = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// entryModule returns the source of a module re-exporting names from the
+// module at path.
+func entryModule(names []string, path string) []byte {
+	return []byte(fmt.Sprintf("export { %s } from %q;\n", strings.Join(names, ", "), path))
+}
+
+// parseTsconfig decodes a base64 encoded tsconfig.json, returning it
+// re-encoded with sorted keys so equivalent configs share a cache key.
+func parseTsconfig(raw string) (string, error) {
+	// An unescaped "+" arrives as a space
+	raw = strings.ReplaceAll(raw, " ", "+")
+	var decoded []byte
+	var err error
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if decoded, err = enc.DecodeString(raw); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid tsconfig, expected base64 encoded JSON: %w", err)
+	}
+	var config map[string]any
+	if err := json.Unmarshal(decoded, &config); err != nil {
+		return "", fmt.Errorf("invalid tsconfig JSON: %w", err)
+	}
+	canonical, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return string(canonical), nil
+}
+
+// apply sets the request's options on top of the base build options.
+func (p buildParams) apply(opts *api.BuildOptions) {
+	if len(p.define) > 0 {
+		define := maps.Clone(opts.Define)
+		if define == nil {
+			define = map[string]string{}
+		}
+		maps.Copy(define, p.define)
+		opts.Define = define
+	}
+	if p.sourcemap != "" {
+		opts.Sourcemap = sourceMapModes[p.sourcemap]
+	}
+	if p.tsconfig != "" {
+		opts.TsconfigRaw = p.tsconfig
+	}
+	if len(p.loader) > 0 {
+		loader := maps.Clone(opts.Loader)
+		if loader == nil {
+			loader = map[string]api.Loader{}
+		}
+		maps.Copy(loader, p.loader)
+		opts.Loader = loader
+	}
+	if p.banner != "" {
+		opts.Banner = map[string]string{"js": p.banner}
+	}
+	if p.footer != "" {
+		opts.Footer = map[string]string{"js": p.footer}
+	}
+	if p.target != "" {
+		opts.Target = esTargets[p.target]
+	}
+	if len(p.engines) > 0 {
+		opts.Engines = p.engines
+		if p.target == "" {
+			opts.Target = api.ESNext
+		}
+	}
+	if p.format != "" {
+		opts.Format = formats[p.format]
+	}
+	if p.platform != "" {
+		opts.Platform = platforms[p.platform]
+	}
+	if p.minify != nil {
+		opts.MinifyWhitespace = *p.minify
+		opts.MinifyIdentifiers = *p.minify
+		opts.MinifySyntax = *p.minify
+	}
+	if p.minifySyntax != nil {
+		opts.MinifySyntax = *p.minifySyntax
+	}
+	if p.legalComments != "" {
+		opts.LegalComments = legalCommentModes[p.legalComments]
+	}
+	if p.charset != "" {
+		opts.Charset = charsets[p.charset]
+	}
+	for _, mode := range p.drop {
+		opts.Drop |= dropModes[mode]
+	}
+	if len(p.pure) > 0 {
+		opts.Pure = append(slices.Clone(opts.Pure), p.pure...)
+	}
+	if p.keepNames {
+		opts.KeepNames = true
+	}
+	if p.bundle != nil {
+		opts.Bundle = *p.bundle
+	}
+	if p.splitting {
+		opts.Splitting = true
+	}
+	if p.iifeGlobal != "" {
+		// esbuild assigns the namespace object, unwrap its default export
+		opts.Format = api.FormatIIFE
+		opts.GlobalName = p.iifeGlobal
+		unwrap := fmt.Sprintf("%[1]s=%[1]s&&%[1]s.default!==void 0?%[1]s.default:%[1]s;", p.iifeGlobal)
+		if p.footer != "" {
+			unwrap += "\n" + p.footer
+		}
+		opts.Footer = map[string]string{"js": unwrap}
+	}
+	if len(p.external) > 0 {
+		opts.External = append(slices.Clone(opts.External), p.external...)
+	}
+	if len(p.alias) > 0 {
+		alias := maps.Clone(opts.Alias)
+		if alias == nil {
+			alias = map[string]string{}
+		}
+		maps.Copy(alias, p.alias)
+		opts.Alias = alias
+	}
+	if len(p.conditions) > 0 {
+		opts.Conditions = p.conditions
+	}
+	// Injected shims are named here, and written to the build directory
+	// by the handler
+	for _, name := range p.inject {
+		if !slices.Contains(opts.Inject, name) {
+			opts.Inject = append(slices.Clone(opts.Inject), name)
+		}
+	}
+}
+
+// stripQueryParams removes the named parameters from a raw query string,
+// preserving the order and encoding of everything else.
+func stripQueryParams(rawQuery string, names ...string) string {
+	var kept []string
+	for _, part := range strings.Split(rawQuery, "&") {
+		if part == "" {
+			continue
+		}
+		key, _, _ := strings.Cut(part, "=")
+		if k, err := url.QueryUnescape(key); err == nil && slices.Contains(names, k) {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, "&")
+}
+
+// keepQueryParams is the inverse of stripQueryParams.
+func keepQueryParams(rawQuery string, names ...string) string {
+	var kept []string
+	for _, part := range strings.Split(rawQuery, "&") {
+		key, _, _ := strings.Cut(part, "=")
+		if k, err := url.QueryUnescape(key); err == nil && slices.Contains(names, k) {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// cacheKey returns the cache file name for a URL built with params. salt
+// identifies deployment wide settings that affect the output.
+func cacheKey(url string, params buildParams, salt string) string {
+	hasher := sha256.New()
+	hasher.Write([]byte(url))
+	if salt != "" {
+		fmt.Fprintf(hasher, "\x00salt:%s", salt)
+	}
+	for _, k := range slices.Sorted(maps.Keys(params.define)) {
+		fmt.Fprintf(hasher, "\x00define:%s=%s", k, params.define[k])
+	}
+	if params.sourcemap != "" {
+		fmt.Fprintf(hasher, "\x00sourcemap:%s", params.sourcemap)
+	}
+	if params.tsconfig != "" {
+		fmt.Fprintf(hasher, "\x00tsconfig:%s", params.tsconfig)
+	}
+	for _, ext := range slices.Sorted(maps.Keys(params.loader)) {
+		fmt.Fprintf(hasher, "\x00loader:%s=%d", ext, params.loader[ext])
+	}
+	// Entries were always built as TypeScript, so only other extensions
+	// change keys
+	if ext := entryExtension(url, params); ext != ".ts" {
+		fmt.Fprintf(hasher, "\x00entry_ext:%s", ext)
+	}
+	if params.banner != "" {
+		fmt.Fprintf(hasher, "\x00banner:%s", params.banner)
+	}
+	if params.footer != "" {
+		fmt.Fprintf(hasher, "\x00footer:%s", params.footer)
+	}
+	for _, kv := range [][2]string{{"target", params.target}, {"format", params.format}, {"platform", params.platform}, {"legal_comments", params.legalComments}, {"charset", params.charset}} {
+		if kv[1] != "" {
+			fmt.Fprintf(hasher, "\x00%s:%s", kv[0], kv[1])
+		}
+	}
+	for _, spec := range engineSpecs(params.engines) {
+		fmt.Fprintf(hasher, "\x00engine:%s", spec)
+	}
+	if params.minify != nil {
+		fmt.Fprintf(hasher, "\x00minify:%t", *params.minify)
+	}
+	if params.minifySyntax != nil {
+		fmt.Fprintf(hasher, "\x00minify_syntax:%t", *params.minifySyntax)
+	}
+	for _, mode := range params.drop {
+		fmt.Fprintf(hasher, "\x00drop:%s", mode)
+	}
+	for _, name := range params.pure {
+		fmt.Fprintf(hasher, "\x00pure:%s", name)
+	}
+	if params.keepNames {
+		fmt.Fprintf(hasher, "\x00keep_names")
+	}
+	if params.bundle != nil {
+		fmt.Fprintf(hasher, "\x00bundle:%t", *params.bundle)
+	}
+	if params.typecheck {
+		fmt.Fprintf(hasher, "\x00typecheck")
+	}
+	if params.types {
+		fmt.Fprintf(hasher, "\x00types")
+	}
+	if params.splitting {
+		fmt.Fprintf(hasher, "\x00splitting")
+	}
+	if params.iifeGlobal != "" {
+		fmt.Fprintf(hasher, "\x00iife_global:%s", params.iifeGlobal)
+	}
+	if params.raw {
+		fmt.Fprintf(hasher, "\x00raw")
+	}
+	for _, name := range params.entry {
+		fmt.Fprintf(hasher, "\x00entry:%s", name)
+	}
+	for _, name := range params.inject {
+		fmt.Fprintf(hasher, "\x00inject:%s", name)
+	}
+	if params.template != "" {
+		fmt.Fprintf(hasher, "\x00template:%s", params.template)
+	}
+	for _, pkg := range params.external {
+		fmt.Fprintf(hasher, "\x00external:%s", pkg)
+	}
+	for _, from := range slices.Sorted(maps.Keys(params.alias)) {
+		fmt.Fprintf(hasher, "\x00alias:%s=%s", from, params.alias[from])
+	}
+	for _, name := range params.conditions {
+		fmt.Fprintf(hasher, "\x00condition:%s", name)
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil))[:20]
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnminifiedBundle(t *testing.T) {
+	upstream := newTestUpstream(t, map[string]string{"/mod.ts": `export function shout(message: string): string {
+  const suffix = "!";
+  if (1 + 1 === 3) {
+    return "unreachable";
+  }
+  return message.toUpperCase() + suffix;
+}
+`})
+	h := newTestHandler(t, Config{})
+	path := "/" + upstream.URL + "/mod.ts"
+
+	minified := get(t, h, path)
+	if minified.Code != http.StatusOK {
+		t.Fatalf("minified: status = %d\n%s", minified.Code, minified.Body)
+	}
+	if strings.Contains(minified.Body.String(), "suffix") {
+		t.Fatalf("bundle wasn't minified to begin with:\n%s", minified.Body)
+	}
+
+	rec := get(t, h, path+"?minify=false")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("minify=false: status = %d\n%s", rec.Code, rec.Body)
+	}
+	bundle := rec.Body.String()
+	for _, want := range []string{"function shout(message) {\n", "\n  const suffix = \"!\";\n", "message.toUpperCase() + suffix", "unreachable"} {
+		if !strings.Contains(bundle, want) {
+			t.Errorf("minify=false bundle doesn't contain %q:\n%s", want, bundle)
+		}
+	}
+	if lines := strings.Count(bundle, "\n"); lines < 6 {
+		t.Errorf("minify=false bundle has %d lines, it was collapsed:\n%s", lines, bundle)
+	}
+
+	// Syntax minification drops the dead branch on its own, and leaves the
+	// names and layout
+	rec = get(t, h, path+"?minify=false&minify_syntax=true")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("minify_syntax=true: status = %d\n%s", rec.Code, rec.Body)
+	}
+	if bundle := rec.Body.String(); strings.Contains(bundle, "unreachable") || !strings.Contains(bundle, "function shout(message) {\n") {
+		t.Errorf("minify_syntax=true bundle:\n%s", bundle)
+	}
+}
+
+func TestBuildParamsKeyTheCache(t *testing.T) {
+	upstream := newTestUpstream(t, map[string]string{"/mod.ts": "export const shout = async (s: string) => s?.toUpperCase() ?? \"\";\n"})
+	h := newTestHandler(t, Config{})
+	path := "/" + upstream.URL + "/mod.ts"
+
+	bundles := map[string]string{}
+	for _, target := range []string{"es2015", "esnext"} {
+		rec := get(t, h, path+"?target="+target)
+		if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "MISS" {
+			t.Fatalf("target=%s: status = %d, X-Cache = %q\n%s", target, rec.Code, rec.Header().Get("X-Cache"), rec.Body)
+		}
+		// Caches key on the URL, which holds every build param
+		if vary := rec.Header().Get("Vary"); strings.Contains(vary, "*") {
+			t.Errorf("target=%s: Vary = %q", target, vary)
+		}
+		bundles[target] = rec.Body.String()
+		_ = h.waitForBuilds(context.Background())
+	}
+	if bundles["es2015"] == bundles["esnext"] {
+		t.Errorf("targets built the same bundle:\n%s", bundles["esnext"])
+	}
+
+	for target, bundle := range bundles {
+		params, err := parseBuildParams(url.Values{"target": {target}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cached, err := os.ReadFile(filepath.Join(h.cfg.CacheDir, cacheKey(upstream.URL+"/mod.ts", params, h.keySalt)))
+		if err != nil || string(cached) != bundle {
+			t.Errorf("target=%s: not cached under its own key: %v", target, err)
+		}
+		if rec := get(t, h, path+"?target="+target); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != bundle {
+			t.Errorf("target=%s: X-Cache = %q, or served another target's bundle", target, rec.Header().Get("X-Cache"))
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// serveBuild bundles TypeScript posted to /build, for sources that aren't
+// hosted anywhere. Build options are taken from the query string as for
+// URLs, and the result is cached by the hash of the source and options.
+func (h *handler) serveBuild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Use POST to build a source", http.StatusMethodNotAllowed)
+		return
+	}
+	params, err := parseBuildParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The body is limited to Config.MaxBodyBytes by ServeHTTP
+	source, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, fmt.Sprintf("Source is limited to %d bytes", maxErr.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to read source: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(source) == 0 {
+		http.Error(w, "Missing source, expected TypeScript in the request body", http.StatusBadRequest)
+		return
+	}
+
+	start := time.Now()
+	log := logger(r.Context())
+	hash := cacheKey(fmt.Sprintf("post:%x", sha256.Sum256(source)), params, h.keySalt)
+	log.Info("starting bundle process", "source_bytes", len(source), "hash", hash)
+	if u := h.importMapURL(r, params.external); u != "" {
+		w.Header().Set("X-Import-Map", u)
+	}
+	setDownload(w, r, "")
+	bypass := bypassCache(r)
+	if bypass {
+		log.Info("cache bypassed", "hash", hash)
+	}
+	if entry, ok := h.negCache.get(hash); ok && !bypass {
+		h.logEvent(r.Context(), "negative_cache_hit", "negative cache hit", "hash", hash)
+		sendError(w, r, entry.err)
+		return
+	}
+	fail := func(w http.ResponseWriter, err *buildError) {
+		if abandoned(r) {
+			h.logEvent(r.Context(), "build_abandoned", "client went away, build abandoned", "hash", hash, "duration", time.Since(start))
+			return
+		}
+		h.events.publish(r.Context(), "build_failed", "hash", hash, "kind", err.kind.String(), "status", err.statusCode(), "duration", time.Since(start))
+		if deadlineExceeded(w, r) {
+			return
+		}
+		if !bypass {
+			h.negCache.add(hash, err)
+		}
+		sendError(w, r, err)
+	}
+
+	var timing serverTiming
+	if !bypass && h.isCached(r, hash) {
+		h.logEvent(r.Context(), "cache_hit", "cache hit", "hash", hash, "duration", time.Since(start))
+		timing.add("cache", time.Since(start))
+		w.Header().Set("Server-Timing", timing.String())
+		w.Header().Set("X-Cache", "HIT")
+		if h.serveBundle(w, r, hash) {
+			return
+		}
+		log.Info("cache entry disappeared, rebuilding", "hash", hash)
+	}
+	h.logEvent(r.Context(), "cache_miss", "cache miss", "hash", hash, "duration", time.Since(start))
+
+	if r.URL.Query().Get("skip_type_check") != "true" {
+		if err := checkSourceType(r.Header.Get("Content-Type"), source); err != nil {
+			fail(w, &buildError{kind: kindBadRequest, status: http.StatusUnsupportedMediaType,
+				msg: "Source doesn't look like JavaScript or TypeScript, add ?skip_type_check=true to build it anyway", err: err})
+			return
+		}
+	}
+
+	h.build(w, r, buildJob{
+		hash:        hash,
+		source:      source,
+		info:        scanSource(source),
+		params:      params,
+		timing:      &timing,
+		start:       start,
+		fail:        fail,
+		bypassCache: bypass,
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestSizeLimits(t *testing.T) {
+	h := newTestHandler(t, Config{MaxBodyBytes: 1024})
+	// As main configures its server with MAX_HEADER_BYTES
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config.MaxHeaderBytes = 1024
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	post := func(body io.Reader, contentLength int64) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/build", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ContentLength = contentLength
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if code, body := post(strings.NewReader(testModule), int64(len(testModule))); code != http.StatusOK {
+		t.Errorf("small source: status = %d\n%s", code, body)
+	}
+	big := strings.Repeat("// padding\n", 100) + testModule
+	// Refused up front when the length is declared, and once the limit is
+	// read past when it isn't
+	if code, body := post(strings.NewReader(big), int64(len(big))); code != http.StatusRequestEntityTooLarge || !strings.Contains(body, "over the 1024 byte limit") {
+		t.Errorf("oversized body: status = %d, want 413\n%s", code, body)
+	}
+	if code, body := post(io.MultiReader(strings.NewReader(big)), -1); code != http.StatusRequestEntityTooLarge || !strings.Contains(body, "limited to 1024 bytes") {
+		t.Errorf("oversized chunked body: status = %d, want 413\n%s", code, body)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/readyz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Padding", strings.Repeat("a", 64<<10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("oversized headers: status = %d, want 431\n%s", resp.StatusCode, b)
+	}
+}
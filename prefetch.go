@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPrefetchTargets bounds how many URLs a single POST /prefetch builds.
+const maxPrefetchTargets = 100
+
+// prefetchConcurrency is how many URLs of a POST /prefetch are built at
+// once.
+const prefetchConcurrency = 4
+
+// maxPrefetchBodyBytes limits the size of POST /prefetch request bodies.
+const maxPrefetchBodyBytes = 1 << 20
+
+// prefetchTarget is a URL to build for POST /prefetch, with the query
+// params it would be requested with, like {"url":
+// "https://example.com/mod.ts", "options": {"minify": "true"}}. A bare
+// string is a URL without options.
+type prefetchTarget struct {
+	URL     string            `json:"url"`
+	Options map[string]string `json:"options,omitempty"`
+}
+
+func (t *prefetchTarget) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &t.URL)
+	}
+	type target prefetchTarget
+	return json.Unmarshal(b, (*target)(t))
+}
+
+// requestURI returns the path and query t is requested with.
+func (t prefetchTarget) requestURI() string {
+	uri := "/" + strings.TrimPrefix(t.URL, "/")
+	if len(t.Options) == 0 {
+		return uri
+	}
+	query := url.Values{}
+	for name, v := range t.Options {
+		query.Set(name, v)
+	}
+	if strings.Contains(uri, "?") {
+		return uri + "&" + query.Encode()
+	}
+	return uri + "?" + query.Encode()
+}
+
+// prefetchResult is the outcome of building one prefetchTarget.
+type prefetchResult struct {
+	URL   string `json:"url"`
+	OK    bool   `json:"ok"`
+	Cache string `json:"cache,omitempty"`
+	// Status is the status a GET of the URL was answered with.
+	Status int `json:"status"`
+	// Hash is the cache entry the bundle is stored under.
+	Hash       string `json:"hash,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+}
+
+// servePrefetch builds the URLs posted to /prefetch as a JSON array of
+// prefetchTargets, for warming the cache from CI, and answers with how each
+// went instead of the bundles. Each is requested as a GET of the URL
+// would be, a few at a time. The response is 502 if any of them failed.
+func (h *handler) servePrefetch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Use POST with a JSON array of URLs to prefetch", http.StatusMethodNotAllowed)
+		return
+	}
+	var targets []prefetchTarget
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPrefetchBodyBytes)).Decode(&targets); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, fmt.Sprintf("Request body is limited to %d bytes", maxPrefetchBodyBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, `Invalid request body, expected a JSON array like ["https://example.com/mod.ts", {"url": "https://example.com/app.ts", "options": {"minify": "true"}}]: `+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(targets) == 0 {
+		http.Error(w, "No URLs to prefetch", http.StatusBadRequest)
+		return
+	}
+	if len(targets) > maxPrefetchTargets {
+		http.Error(w, fmt.Sprintf("At most %d URLs can be prefetched at once", maxPrefetchTargets), http.StatusBadRequest)
+		return
+	}
+	for _, t := range targets {
+		if t.URL == "" {
+			http.Error(w, "Every prefetch entry needs a url", http.StatusBadRequest)
+			return
+		}
+	}
+
+	start := time.Now()
+	results := make([]prefetchResult, len(targets))
+	sem := make(chan struct{}, prefetchConcurrency)
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = h.prefetch(r, t)
+		}()
+	}
+	wg.Wait()
+
+	status, failed := http.StatusOK, 0
+	for _, res := range results {
+		if !res.OK {
+			failed++
+		}
+	}
+	if failed > 0 {
+		status = http.StatusBadGateway
+	}
+	logger(r.Context()).Info("prefetched", "urls", len(targets), "failed", failed, "duration", time.Since(start))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ok":         failed == 0,
+		"failed":     failed,
+		"durationMs": time.Since(start).Milliseconds(),
+		"results":    results,
+	})
+}
+
+// prefetch builds t on behalf of the POST /prefetch request r.
+func (h *handler) prefetch(r *http.Request, t prefetchTarget) prefetchResult {
+	start := time.Now()
+	res := prefetchResult{URL: t.URL}
+	uri := t.requestURI()
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, uri, nil)
+	if err != nil {
+		res.Status = http.StatusBadRequest
+		res.Error = err.Error()
+		return res
+	}
+	// Errors are asked for as JSON, so their message can be reported
+	req.Header.Set("Accept", "application/json")
+	for _, name := range h.cfg.ForwardHeaders {
+		if v := r.Header.Values(name); len(v) > 0 {
+			req.Header[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	w := &prefetchResponseWriter{header: http.Header{}}
+	h.bundle(w, req)
+
+	res.Status = w.status
+	if res.Status == 0 {
+		res.Status = http.StatusOK
+	}
+	res.OK = res.Status < 400
+	res.Cache = w.header.Get("X-Cache")
+	res.DurationMs = time.Since(start).Milliseconds()
+	if !res.OK {
+		res.Error = w.errorMessage()
+		return res
+	}
+	res.Size = w.size
+	// Content keyed bundles are stored by their source, which only the
+	// build knew
+	path, rawQuery, _ := strings.Cut(uri, "?")
+	if fullURL, err := h.upstreamURL(path, rawQuery); err == nil && !h.contentKeyed(fullURL) {
+		res.Hash, _ = h.entryHash(path, rawQuery, req.Header)
+	}
+	return res
+}
+
+// maxPrefetchErrorBytes is how much of a failed response is kept to
+// report its error.
+const maxPrefetchErrorBytes = 4 << 10
+
+// prefetchResponseWriter is a ResponseWriter for prefetched URLs, which
+// counts the bytes of successful responses and keeps the start of failed
+// ones.
+type prefetchResponseWriter struct {
+	header http.Header
+	status int
+	size   int64
+	body   bytes.Buffer
+}
+
+func (w *prefetchResponseWriter) Header() http.Header { return w.header }
+
+func (w *prefetchResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.size += int64(len(b))
+	if w.status >= 400 && w.body.Len() < maxPrefetchErrorBytes {
+		w.body.Write(b[:min(len(b), maxPrefetchErrorBytes-w.body.Len())])
+	}
+	return io.Discard.Write(b)
+}
+
+func (w *prefetchResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// errorMessage returns the error a failed response explained itself with.
+func (w *prefetchResponseWriter) errorMessage() string {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(w.body.Bytes(), &body) == nil && body.Error != "" {
+		return body.Error
+	}
+	if msg := strings.TrimSpace(w.body.String()); msg != "" {
+		return msg
+	}
+	return http.StatusText(w.status)
+}
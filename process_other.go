@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// killTree leaves cmd to be killed on its own, since other platforms have
+// no process groups to kill.
+func killTree(cmd *exec.Cmd) {}
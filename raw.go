@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// transform serves job's source transpiled on its own with ?raw=true. It
+// skips the build directory, dependency install and bundling entirely, so
+// imports are left as they are. Only inline sourcemaps are produced, since
+// there is no output file for a linked one to sit next to.
+func (h *handler) transform(w http.ResponseWriter, r *http.Request, job buildJob) {
+	hash, params, timing, start := job.hash, job.params, job.timing, job.start
+	source, err := job.readSource()
+	if err != nil {
+		job.fail(w, newBuildError(kindInternal, "Failed to read source: "+err.Error(), err))
+		return
+	}
+	fail := job.fail
+
+	opts := h.cfg.BuildOptions
+	params.apply(&opts)
+	loader := moduleLoader(job.url, job.upstream.Get("Content-Type"))
+	if loader == api.LoaderJS || params.entryLoader != "" {
+		// Use the loader builds would pick for the entry
+		loader = extensionLoaders[entryExtension(job.url, params)]
+	}
+	sourcemap := api.SourceMapNone
+	if opts.Sourcemap == api.SourceMapInline {
+		sourcemap = api.SourceMapInline
+	}
+	legalComments := opts.LegalComments
+	if legalComments == api.LegalCommentsLinked || legalComments == api.LegalCommentsExternal {
+		legalComments = api.LegalCommentsEndOfFile
+	}
+
+	phaseStart := time.Now()
+	result := api.Transform(string(source), api.TransformOptions{
+		Sourcemap:         sourcemap,
+		Target:            opts.Target,
+		Engines:           opts.Engines,
+		Platform:          opts.Platform,
+		Format:            opts.Format,
+		GlobalName:        opts.GlobalName,
+		Drop:              opts.Drop,
+		MinifyWhitespace:  opts.MinifyWhitespace,
+		MinifyIdentifiers: opts.MinifyIdentifiers,
+		MinifySyntax:      opts.MinifySyntax,
+		Charset:           opts.Charset,
+		LegalComments:     legalComments,
+		TsconfigRaw:       opts.TsconfigRaw,
+		Banner:            opts.Banner["js"],
+		Footer:            opts.Footer["js"],
+		Define:            opts.Define,
+		Pure:              opts.Pure,
+		KeepNames:         opts.KeepNames,
+		Sourcefile:        job.url,
+		Loader:            loader,
+	})
+	timing.add("transform", time.Since(phaseStart))
+	if len(result.Errors) > 0 {
+		formatted := explainMessages(result.Errors, result.Warnings) + strings.Join(api.FormatMessages(result.Errors, api.FormatMessagesOptions{
+			Kind: api.ErrorMessage,
+		}), "")
+		be := newBuildError(kindBuild, "Transform failed:\n"+formatted, fmt.Errorf("transform failed with %d errors", len(result.Errors)))
+		be.messages = result.Errors
+		fail(w, be)
+		return
+	}
+	code := result.Code
+	if len(code) == 0 && !job.info.blank {
+		fail(w, newBuildError(kindBuild, "Transform produced no output, refusing to cache it", errors.New("empty output from non-empty source")))
+		return
+	}
+	if h.cfg.VerifyBundles {
+		phaseStart := time.Now()
+		be := verifyBundle(code)
+		timing.add("verify", time.Since(phaseStart))
+		if be != nil {
+			fail(w, be)
+			return
+		}
+	}
+	if job.bypassCache {
+		h.logEvent(r.Context(), "build_finished", "transformed source", "hash", hash, "size", len(code), "cache", "bypassed", "total_duration", time.Since(start))
+		h.stats.countBuild(time.Since(start))
+		h.serveUncached(w, r, timing, code)
+		return
+	}
+
+	if err := h.writeEntryInfo(hash, entryInfo{
+		URL:         job.url,
+		RequestURI:  r.URL.RequestURI(),
+		Options:     keepQueryParams(r.URL.RawQuery, buildParamNames...),
+		SourceHash:  fmt.Sprintf("%x", job.info.sum),
+		ContentHash: contentHash(code),
+		Integrity:   integrity(code),
+		Size:        len(code),
+		Esbuild:     esbuildVersion(),
+		Version:     version,
+		BuiltAt:     time.Now().UTC(),
+	}); err != nil {
+		fail(w, newBuildError(kindInternal, "Failed to write to cache: "+err.Error(), err))
+		return
+	}
+	if job.upstream != nil {
+		if err := h.writeValidators(hash, job.upstream); err != nil {
+			fail(w, newBuildError(kindInternal, "Failed to write to cache: "+err.Error(), err))
+			return
+		}
+	}
+	if err := h.cacheBundle(job, code); err != nil {
+		fail(w, newBuildError(kindInternal, "Failed to write to cache: "+err.Error(), err))
+		return
+	}
+
+	h.logEvent(r.Context(), "build_finished", "transformed source", "hash", hash, "size", len(code), "total_duration", time.Since(start))
+	h.stats.countBuild(time.Since(start))
+	w.Header().Set("Server-Timing", timing.String())
+	w.Header().Set("X-Cache", "MISS")
+	if !h.serveBundle(w, r, hash) {
+		w.Header().Set("Retry-After", "1")
+		sendError(w, r, newBuildError(kindUnavailable, "Bundle was evicted from the cache before it could be served, please retry", errors.New("cache entry not found")))
+	}
+}
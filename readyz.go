@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+)
+
+// serveReady answers readiness probes. The service is ready once its
+// startup self-test passed and warmup URLs were built, as long as builds
+// can create their directories. A failed self-test is reported with its
+// error, and the service never becomes ready. It reports whether it can install npm
+// packages so a degraded instance can be told apart. A read-only instance
+// still serves its cache, so it stays ready.
+func (h *handler) serveReady(w http.ResponseWriter, r *http.Request) {
+	status := "ok"
+	if h.cfg.NoInstall {
+		status = "degraded"
+	}
+	readOnly := h.readOnly.Load()
+	if readOnly {
+		status = "read-only"
+	}
+	tmpErr := checkWritable(h.cfg.BuildTmpDir)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	selfTestErr := h.selfTestErr.Load()
+	switch {
+	case selfTestErr != nil:
+		status = "self-test failed"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case !h.ready.Load():
+		status = "starting"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case tmpErr != nil:
+		status = "unwritable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	body := map[string]any{
+		"status":   status,
+		"install":  !h.cfg.NoInstall,
+		"readOnly": readOnly,
+		"bun":      h.cfg.BunBin,
+		"bunx":     h.cfg.BunxBin,
+	}
+	if selfTestErr != nil {
+		body["selfTestError"] = (*selfTestErr).Error()
+	}
+	if tmpErr != nil {
+		body["tmpError"] = tmpErr.Error()
+	}
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// checkWritable checks that files can be created in dir, the OS temp
+// directory if empty.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTrackedURLs bounds how many distinct request URLs are counted.
+const maxTrackedURLs = 10000
+
+// hitCounter counts requests per request URL so the most popular bundles
+// can be refreshed in the background.
+type hitCounter struct {
+	mu   sync.Mutex
+	hits map[string]int64
+}
+
+func newHitCounter() *hitCounter {
+	return &hitCounter{hits: map[string]int64{}}
+}
+
+// record counts a request for uri. Once maxTrackedURLs are tracked, new
+// URLs are ignored until the counts decay.
+func (c *hitCounter) record(uri string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.hits[uri]; ok || len(c.hits) < maxTrackedURLs {
+		c.hits[uri]++
+	}
+}
+
+// top returns the n most requested URLs and halves every count, so that
+// popularity reflects recent traffic.
+func (c *hitCounter) top(n int) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	uris := make([]string, 0, len(c.hits))
+	for uri := range c.hits {
+		uris = append(uris, uri)
+	}
+	slices.SortFunc(uris, func(a, b string) int {
+		if n := cmp.Compare(c.hits[b], c.hits[a]); n != 0 {
+			return n
+		}
+		return strings.Compare(a, b)
+	})
+	for uri, n := range c.hits {
+		if n/2 == 0 {
+			delete(c.hits, uri)
+		} else {
+			c.hits[uri] = n / 2
+		}
+	}
+	return uris[:min(n, len(uris))]
+}
+
+type refreshKey struct{}
+
+// recordHit counts r towards its URL's popularity. Background refreshes
+// and requests relying on forwarded headers, which can't be replayed, are
+// not counted.
+func (h *handler) recordHit(r *http.Request) {
+	if h.cfg.RefreshTop <= 0 || r.Context().Value(refreshKey{}) != nil || h.forwardsHeaders(r) {
+		return
+	}
+	h.hits.record(r.URL.RequestURI())
+}
+
+// refreshLoop periodically revalidates the RefreshTop most requested
+// bundles that were last validated more than RefreshMaxAge ago, rebuilding
+// those that changed upstream. It returns when ctx is done.
+func (h *handler) refreshLoop(ctx context.Context) {
+	if h.cfg.RefreshTop <= 0 || h.cfg.RefreshInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(h.cfg.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, uri := range h.hits.top(h.cfg.RefreshTop) {
+			if ctx.Err() != nil {
+				return
+			}
+			h.refresh(ctx, uri)
+		}
+	}
+}
+
+// refresh revalidates the cached bundle for the request URL uri if it is
+// older than RefreshMaxAge. Cache writes are atomic, so concurrent readers
+// see either the old or the new bundle.
+func (h *handler) refresh(ctx context.Context, uri string) {
+	log := logger(ctx)
+	path, rawQuery, _ := strings.Cut(uri, "?")
+	hash, err := h.entryHash(path, rawQuery, nil)
+	if err != nil {
+		return
+	}
+	if _, validated, err := h.readValidators(hash); err != nil || time.Since(validated) < h.cfg.RefreshMaxAge {
+		return
+	}
+	status := h.revalidate(ctx, uri)
+	log.Info("refreshed bundle", "url", uri, "hash", hash, "status", status)
+}
+
+// revalidate replays the request URL uri with ?revalidate=true, rebuilding
+// its bundle if the source changed upstream. It returns the response
+// status. A failed rebuild leaves the cached entry in place.
+func (h *handler) revalidate(ctx context.Context, uri string) int {
+	path, rawQuery, _ := strings.Cut(uri, "?")
+	if rawQuery != "" {
+		rawQuery += "&"
+	}
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, refreshKey{}, true),
+		http.MethodGet, path+"?"+rawQuery+"revalidate=true", nil)
+	if err != nil {
+		return http.StatusBadRequest
+	}
+	w := &discardResponseWriter{header: http.Header{}}
+	h.bundle(w, req)
+	return w.status
+}
+
+// serveStale serves the cached entry hash for r without contacting the
+// upstream if it is past StaleAfter, revalidating it in the background so
+// a later request gets fresh bytes. It returns false if r has to be
+// handled normally.
+func (h *handler) serveStale(w http.ResponseWriter, r *http.Request, hash string) bool {
+	if h.cfg.StaleAfter <= 0 || h.cfg.DevMode || r.Context().Value(refreshKey{}) != nil ||
+		r.URL.Query().Get("revalidate") == "true" || !h.isCached(r, hash) {
+		return false
+	}
+	_, validated, err := h.readValidators(hash)
+	if err != nil || time.Since(validated) < h.cfg.StaleAfter {
+		return false
+	}
+	w.Header().Set("X-Cache", "STALE")
+	if !h.serveBundle(w, r, hash) {
+		w.Header().Del("X-Cache")
+		return false
+	}
+	logger(r.Context()).Info("served stale bundle", "hash", hash, "age", time.Since(validated))
+
+	// Only one revalidation per entry at a time
+	if _, running := h.revalidating.LoadOrStore(hash, true); running {
+		h.metrics.coalesced.Add(1)
+		return true
+	}
+	uri := r.URL.RequestURI()
+	ctx := context.WithoutCancel(r.Context())
+	h.builds.Add(1)
+	go func() {
+		defer h.builds.Done()
+		defer h.revalidating.Delete(hash)
+		status := h.revalidate(ctx, uri)
+		logger(ctx).Info("revalidated stale bundle", "hash", hash, "status", status)
+	}()
+	return true
+}
+
+// entryHash returns the cache key a request path and query are built
+// under with header, assuming the URL doesn't redirect.
+func (h *handler) entryHash(path, rawQuery string, header http.Header) (string, error) {
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", err
+	}
+	params, err := parseBuildParams(query)
+	if err != nil {
+		return "", err
+	}
+	fullURL, err := h.upstreamURL(path, rawQuery)
+	if err != nil {
+		return "", err
+	}
+	return cacheKey(fullURL, params, h.keySalt+h.forwardedSalt(header)), nil
+}
+
+// discardResponseWriter is a ResponseWriter for background requests whose
+// responses nobody reads.
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponseWriter) Header() http.Header { return w.header }
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return io.Discard.Write(b)
+}
+
+func (w *discardResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
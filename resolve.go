@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// resolution is the answer to /resolve/<url>.
+type resolution struct {
+	URL string `json:"url"`
+	// Resolved is where the redirects from URL lead, and Status what the
+	// upstream answered there.
+	Resolved string `json:"resolved"`
+	Status   int    `json:"status"`
+	// Redirects are the URLs redirected through, URL first.
+	Redirects []string `json:"redirects"`
+}
+
+// serveResolve answers /resolve/<url> with where the URL redirects to, for
+// clients that want the canonical URL of a module without building it,
+// like a version range resolved to an exact version. Redirects are
+// followed as a build would follow them, and a redirect to a disallowed
+// URL or to this service fails the same way. Only headers are waited for,
+// the final response's body is never read.
+func (h *handler) serveResolve(w http.ResponseWriter, r *http.Request) {
+	fullURL, err := h.upstreamURL(strings.TrimPrefix(r.URL.Path, "/resolve"), r.URL.RawQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.isSelfURL(r, fullURL) {
+		http.Error(w, fmt.Sprintf("URL %q points at this service, resolve the URL it proxies instead", fullURL), http.StatusBadRequest)
+		return
+	}
+	resp, err := h.fetch(r, fullURL, nil)
+	var redirects []string
+	if err == nil {
+		resp, redirects, err = h.followRedirects(r, fullURL, resp)
+	}
+	if err != nil {
+		var be *buildError
+		if errors.As(err, &be) {
+			http.Error(w, be.msg, http.StatusBadGateway)
+			return
+		}
+		http.Error(w, "Failed to fetch URL: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	resp.Body.Close()
+	res := resolution{URL: fullURL, Resolved: redirects[len(redirects)-1], Status: resp.StatusCode, Redirects: redirects}
+	logger(r.Context()).Info("resolved URL", "url", res.URL, "resolved", res.Resolved, "status", res.Status, "redirects", len(res.Redirects)-1)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// followRedirects follows the redirects resp starts, fetched from rawURL on
+// behalf of r, and returns the response they end at with the URLs
+// redirected through, rawURL first. Builds, /resolve and /check all follow
+// redirects this way: up to maxModuleRedirects of them, and never to a
+// disallowed URL or back to this service, which fail with a buildError.
+// Other errors are from fetching. Every response but the one returned is
+// closed.
+func (h *handler) followRedirects(r *http.Request, rawURL string, resp *http.Response) (*http.Response, []string, error) {
+	redirects := []string{rawURL}
+	for isRedirect(resp.StatusCode) {
+		from := redirects[len(redirects)-1]
+		u, err := resp.Location()
+		closeBody(resp)
+		if err != nil {
+			return nil, redirects, newBuildError(kindFetch, fmt.Sprintf("Upstream redirected from %s without a valid Location: %v", from, err), err)
+		}
+		next := u.String()
+		if err := h.validateUpstreamURL(next); err != nil {
+			return nil, redirects, newBuildError(kindFetch, "Upstream redirected to a disallowed URL: "+err.Error(), err)
+		}
+		if h.isSelfURL(r, next) {
+			err := fmt.Errorf("redirect to %q points at this service", next)
+			return nil, redirects, newBuildError(kindFetch, "Upstream redirected back to this service", err)
+		}
+		// Loops, like a URL redirecting to itself, end here too
+		if len(redirects) > maxModuleRedirects {
+			err := fmt.Errorf("redirected through %s", strings.Join(redirects, ", "))
+			return nil, redirects, newBuildError(kindFetch, fmt.Sprintf("Upstream redirected more than %d times", maxModuleRedirects), err)
+		}
+		redirects = append(redirects, next)
+		if resp, err = h.fetch(r, next, nil); err != nil {
+			return nil, redirects, err
+		}
+	}
+	return resp, redirects, nil
+}
+
+// isRedirect reports whether an upstream status redirects elsewhere.
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
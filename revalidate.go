@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// upstreamValidators are the upstream's cache validators for the source a
+// bundle was built from. They are stored next to the bundle, and the file's
+// modification time records when the source was last validated.
+type upstreamValidators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// validatorsSuffix names the cache sidecar holding upstreamValidators.
+const validatorsSuffix = ".upstream.json"
+
+// writeValidators records the validators from an upstream response.
+func (h *handler) writeValidators(hash string, header http.Header) error {
+	b, err := json.Marshal(upstreamValidators{
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+	})
+	if err != nil {
+		return err
+	}
+	return h.writeCacheFile(hash+validatorsSuffix, b)
+}
+
+// readValidators returns the stored validators for the cache entry hash and
+// when they were last confirmed.
+func (h *handler) readValidators(hash string) (upstreamValidators, time.Time, error) {
+	var v upstreamValidators
+	info, err := h.cache.Stat(hash + validatorsSuffix)
+	if err != nil {
+		return v, time.Time{}, err
+	}
+	b, err := h.readCacheFile(hash + validatorsSuffix)
+	if err != nil {
+		return v, time.Time{}, err
+	}
+	return v, info.ModTime, json.Unmarshal(b, &v)
+}
+
+// touchValidators marks the cache entry hash as just validated, by putting
+// its validators again.
+func (h *handler) touchValidators(hash string) error {
+	b, err := h.cache.Get(hash + validatorsSuffix)
+	if err != nil {
+		return err
+	}
+	return h.putCacheFile(hash+validatorsSuffix, b)
+}
+
+// revalidation returns the conditional request headers to check the cached
+// entry hash against the upstream with, or nil if r can be served from the
+// cache without asking. Entries are revalidated when the request asks for
+// it with ?revalidate=true, or once they are older than RevalidateAfter.
+func (h *handler) revalidation(r *http.Request, hash string) http.Header {
+	if h.cfg.DevMode || !h.isCached(r, hash) {
+		return nil
+	}
+	v, validated, err := h.readValidators(hash)
+	after := time.Duration(h.revalidateAfter.Load())
+	if r.URL.Query().Get("revalidate") != "true" &&
+		(after <= 0 || (err == nil && time.Since(validated) < after)) {
+		return nil
+	}
+	// Entries without validators can only be rebuilt
+	header := http.Header{}
+	if v.ETag != "" {
+		header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		header.Set("If-Modified-Since", v.LastModified)
+	}
+	return header
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// urlRewrite turns URLs matching a pattern into the URL to fetch instead,
+// like the page of a file on a Git host into its raw contents. Replace is
+// a regexp.Expand template.
+type urlRewrite struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+	pattern *regexp.Regexp
+}
+
+// defaultURLRewrites point the browser URLs of files on common Git hosts
+// at their raw contents, so the URL can be pasted from the address bar.
+var defaultURLRewrites = mustCompileRewrites([]urlRewrite{
+	{Match: `^https://github\.com/([^/]+)/([^/]+)/blob/(.+)$`, Replace: "https://raw.githubusercontent.com/$1/$2/$3"},
+	{Match: `^https://gitlab\.com/(.+?)/-/blob/(.+)$`, Replace: "https://gitlab.com/$1/-/raw/$2"},
+	{Match: `^https://bitbucket\.org/([^/]+)/([^/]+)/src/(.+)$`, Replace: "https://bitbucket.org/$1/$2/raw/$3"},
+})
+
+func compileRewrites(rewrites []urlRewrite) ([]urlRewrite, error) {
+	for i, rw := range rewrites {
+		pattern, err := regexp.Compile(rw.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite pattern %q: %w", rw.Match, err)
+		}
+		rewrites[i].pattern = pattern
+	}
+	return rewrites, nil
+}
+
+func mustCompileRewrites(rewrites []urlRewrite) []urlRewrite {
+	rewrites, err := compileRewrites(rewrites)
+	if err != nil {
+		panic(err)
+	}
+	return rewrites
+}
+
+// loadURLRewrites reads a JSON array of rewrites, tried in order before
+// the default ones, e.g. for a self-hosted Git server. A missing file is
+// only an error if required.
+func loadURLRewrites(path string, required bool) ([]urlRewrite, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return defaultURLRewrites, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rewrites []urlRewrite
+	if err := json.Unmarshal(b, &rewrites); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if rewrites, err = compileRewrites(rewrites); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return append(rewrites, defaultURLRewrites...), nil
+}
+
+// rewriteURL applies the first matching rewrite to rawURL. Requests for
+// either form share a cache entry, keyed by the rewritten URL.
+func (h *handler) rewriteURL(rawURL string) string {
+	for _, rw := range h.cfg.URLRewrites {
+		if m := rw.pattern.FindStringSubmatchIndex(rawURL); m != nil {
+			return string(rw.pattern.ExpandString(nil, rw.Replace, rawURL, m))
+		}
+	}
+	return rawURL
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Installing packages runs code from the registry: lifecycle scripts like
+// postinstall execute with the service's privileges. Two defenses are
+// available, both applied to every bun and bunx process a build runs:
+//
+//   - bun install is passed --ignore-scripts unless INSTALL_SCRIPTS is
+//     set. esbuild runs inside this process, so bundling doesn't need
+//     packages' native binaries, but packages that generate their code in
+//     a script will be missing files.
+//   - BUILD_USER runs the processes as an unprivileged user, which owns
+//     the build directory and nothing else. This needs the service to run
+//     as root. depcheck and tsc still execute package code, and with the
+//     network access installs need, so it limits what a malicious package
+//     can reach on the host rather than preventing it from running.
+//
+// Stronger isolation, like an ephemeral container per build, is best had
+// by running the whole service in a disposable, unprivileged container.
+
+// sandboxUser is the user and group bun and bunx are run as.
+type sandboxUser struct {
+	uid, gid uint32
+}
+
+// parseSandboxUser resolves a user name, uid, or uid:gid. A uid without a
+// group runs with the user's primary group if it has an account, and the
+// gid of the same number otherwise.
+func parseSandboxUser(spec string) (*sandboxUser, error) {
+	name, group, hasGroup := strings.Cut(spec, ":")
+	var u sandboxUser
+	if uid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		u.uid, u.gid = uint32(uid), uint32(uid)
+		if account, err := user.LookupId(name); err == nil {
+			gid, _ := strconv.ParseUint(account.Gid, 10, 32)
+			u.gid = uint32(gid)
+		}
+	} else {
+		account, err := user.Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		uid, _ := strconv.ParseUint(account.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(account.Gid, 10, 32)
+		u.uid, u.gid = uint32(uid), uint32(gid)
+	}
+	if hasGroup {
+		gid, err := strconv.ParseUint(group, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group %q, expected a gid", group)
+		}
+		u.gid = uint32(gid)
+	}
+	if u.uid == 0 {
+		return nil, fmt.Errorf("user %q is root, builds would run unsandboxed", spec)
+	}
+	return &u, nil
+}
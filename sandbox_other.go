@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// sandbox fails if a sandbox user is configured, since other platforms
+// can't start processes as another user.
+func (h *handler) sandbox(cmd *exec.Cmd) error {
+	if h.cfg.SandboxUser != nil {
+		return errors.New("BUILD_USER is only supported on Unix")
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// sandbox makes cmd run as the configured sandbox user, giving it the
+// build directory it runs in. Its home is the build directory too, since
+// the service's own isn't writable by it; point BUN_INSTALL_CACHE_DIR at a
+// directory it owns to share bun's cache between builds.
+func (h *handler) sandbox(cmd *exec.Cmd) error {
+	u := h.cfg.SandboxUser
+	if u == nil {
+		return nil
+	}
+	err := filepath.WalkDir(cmd.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, int(u.uid), int(u.gid))
+	})
+	if err != nil {
+		return err
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: u.uid, Gid: u.gid}}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, "HOME="+cmd.Dir)
+	return nil
+}
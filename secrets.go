@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// secretPatterns match credentials that registry tools may echo back in
+// their output. The first group, if any, is kept.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(_authToken\s*=\s*)\S+`),
+	regexp.MustCompile(`(?i)(_auth\s*=\s*)\S+`),
+	regexp.MustCompile(`(?i)(_password\s*=\s*)\S+`),
+	regexp.MustCompile(`(?i)(authorization:\s*(?:bearer|basic)\s+)\S+`),
+	regexp.MustCompile(`\bnpm_[A-Za-z0-9]{36}\b`),
+	regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`),
+	regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+(@)`),
+}
+
+// literalNpmrcToken matches .npmrc credentials that are written out rather
+// than taken from the environment.
+var literalNpmrcToken = regexp.MustCompile(`(?m)_(authToken|auth|password)\s*=\s*[^$\s]`)
+
+// npmrcEnvPattern matches ${VAR} references in an .npmrc.
+var npmrcEnvPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// npmrcSecrets returns the values of the environment variables an .npmrc
+// references, which bun substitutes in when it reads the file.
+func npmrcSecrets(npmrc []byte) []string {
+	var secrets []string
+	for _, m := range npmrcEnvPattern.FindAllSubmatch(npmrc, -1) {
+		if v := os.Getenv(string(m[1])); len(v) >= 4 {
+			secrets = append(secrets, v)
+		}
+	}
+	return secrets
+}
+
+// redactSecrets masks credentials in s before it is logged or returned to
+// a client: known token formats, and the given secret values wherever they
+// appear.
+func (h *handler) redactSecrets(s string) string {
+	for _, secret := range h.secrets {
+		s = strings.ReplaceAll(s, secret, "[REDACTED]")
+	}
+	for _, p := range secretPatterns {
+		if p.NumSubexp() > 0 {
+			s = p.ReplaceAllString(s, "${1}[REDACTED]${2}")
+		} else {
+			s = p.ReplaceAllString(s, "[REDACTED]")
+		}
+	}
+	return s
+}
+
+// sensitiveHeaders are upstream response headers whose values are never
+// logged.
+var sensitiveHeaders = []string{"Set-Cookie", "Authorization", "Proxy-Authorization", "Cookie", "Proxy-Authenticate", "WWW-Authenticate"}
+
+// redactHeaders returns header for logging, with the values of
+// sensitiveHeaders replaced.
+func redactHeaders(header http.Header) map[string]string {
+	out := make(map[string]string, len(header))
+	for name, values := range header {
+		if slices.Contains(sensitiveHeaders, http.CanonicalHeaderKey(name)) {
+			out[name] = "[REDACTED]"
+			continue
+		}
+		out[name] = strings.Join(values, ", ")
+	}
+	return out
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// isSelfURL reports whether rawURL points back at this service, as reached
+// by r: at the Host it was sent to, the external host forwarded by a
+// trusted proxy, or the address it was accepted on. Fetching such a URL
+// would make the service request itself, recursively if the URL nests
+// another one.
+func (h *handler) isSelfURL(r *http.Request, rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "80"
+		if strings.EqualFold(u.Scheme, "https") {
+			port = "443"
+		}
+	}
+
+	selfHosts := []string{r.Host}
+	if h.cfg.TrustProxy {
+		selfHosts = append(selfHosts, firstHeaderValue(r, "X-Forwarded-Host"))
+	}
+	for _, self := range selfHosts {
+		selfHost, selfPort, err := net.SplitHostPort(self)
+		if err != nil {
+			// Hosts without a port are on the default port of whichever
+			// scheme the client used
+			selfHost, selfPort = strings.Trim(self, "[]"), ""
+		}
+		if selfHost != "" && strings.EqualFold(host, selfHost) &&
+			(port == selfPort || selfPort == "" && (port == "80" || port == "443")) {
+			return true
+		}
+	}
+
+	// Other names for the listening address, like localhost
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	localHost, localPort, err := net.SplitHostPort(local.String())
+	if err != nil || port != localPort {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if strings.EqualFold(host, "localhost") {
+		ip = net.IPv6loopback
+	}
+	localIP := net.ParseIP(localHost)
+	return ip != nil && localIP != nil && (ip.Equal(localIP) || ip.IsLoopback() && (localIP.IsLoopback() || localIP.IsUnspecified()))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsSelfURL(t *testing.T) {
+	h := newTestHandler(t, Config{TrustProxy: true})
+	for _, tt := range []struct {
+		name, host, forwardedHost, url string
+		want                           bool
+	}{
+		{"same host", "proxy.example", "", "https://proxy.example/https://esm.sh/react", true},
+		{"same host and port", "proxy.example:8080", "", "http://proxy.example:8080/mod.ts", true},
+		{"case differs", "proxy.example", "", "https://PROXY.example/mod.ts", true},
+		{"other port", "proxy.example:8080", "", "http://proxy.example:9090/mod.ts", false},
+		{"forwarded host", "10.0.0.5:8080", "cdn.example", "https://cdn.example/https://esm.sh/react", true},
+		{"other host", "proxy.example", "cdn.example", "https://esm.sh/react", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Host = tt.host
+			if tt.forwardedHost != "" {
+				r.Header.Set("X-Forwarded-Host", tt.forwardedHost)
+			}
+			if got := h.isSelfURL(r, tt.url); got != tt.want {
+				t.Errorf("isSelfURL(%q) = %t, want %t", tt.url, got, tt.want)
+			}
+		})
+	}
+
+	// Forwarded hosts are only believed from a trusted proxy
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Forwarded-Host", "cdn.example")
+	if newTestHandler(t, Config{}).isSelfURL(r, "https://cdn.example/mod.ts") {
+		t.Error("X-Forwarded-Host was believed without TRUST_PROXY")
+	}
+}
+
+func TestSelfReferentialURL(t *testing.T) {
+	h := newTestHandler(t, Config{})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	// The service's own address, by another name the listener answers to
+	self := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	for _, u := range []string{srv.URL + "/" + srv.URL + "/mod.ts", srv.URL + "/" + self + "/" + self + "/mod.ts"} {
+		resp, err := http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "points at this service") {
+			t.Errorf("%s: status = %d, want 400\n%s", u, resp.StatusCode, body)
+		}
+	}
+}
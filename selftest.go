@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// selfTestSource is built at startup. It needs the TypeScript loader and
+// the project's build options but no network, so it works air-gapped.
+const selfTestSource = `const greeting: string = "esbuild-proxy self-test";
+export default greeting;
+`
+
+// selfTest checks that bun runs, unless installs are disabled, and builds
+// selfTestSource through the same pipeline as POST /build. The build
+// bypasses the cache, so it isn't answered by an earlier run.
+func (h *handler) selfTest(ctx context.Context) error {
+	start := time.Now()
+	// The snippet has nothing to install, so bun is checked on its own
+	if !h.cfg.NoInstall {
+		var out bytes.Buffer
+		cmd := exec.CommandContext(ctx, h.cfg.BunBin, "--version")
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		if err := h.run(cmd, &out); err != nil {
+			return fmt.Errorf("%s --version failed: %w: %s", h.cfg.BunBin, err, strings.TrimSpace(out.String()))
+		}
+		logger(ctx).Info("self-test found bun", "bun", h.cfg.BunBin, "version", strings.TrimSpace(out.String()))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/build?cache=false", strings.NewReader(selfTestSource))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/typescript")
+	w := httptest.NewRecorder()
+	h.serveBuild(w, req)
+	if w.Code != http.StatusOK {
+		return fmt.Errorf("self-test build failed with status %d: %s", w.Code, strings.TrimSpace(w.Body.String()))
+	}
+	if !strings.Contains(w.Body.String(), "esbuild-proxy self-test") {
+		return fmt.Errorf("self-test build produced an unexpected bundle: %q", w.Body.String())
+	}
+	logger(ctx).Info("self-test build passed", "duration", time.Since(start), "size", w.Body.Len())
+	return nil
+}
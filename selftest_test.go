@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readiness returns the status /readyz answers with, and its body.
+func readiness(t *testing.T, h *handler) (int, map[string]any) {
+	t.Helper()
+	rec := get(t, h, "/readyz")
+	var body map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("/readyz isn't JSON: %v\n%s", err, rec.Body)
+	}
+	return rec.Code, body
+}
+
+func TestSelfTest(t *testing.T) {
+	bun := writeScript(t, t.TempDir(), "bun", "echo 1.2.3\n")
+	h := newTestHandler(t, Config{SelfTest: true, BunBin: bun})
+
+	if code, body := readiness(t, h); code != http.StatusServiceUnavailable || body["status"] != "starting" {
+		t.Errorf("before the self-test: /readyz = %d %v, want 503 starting", code, body)
+	}
+	// Every run builds, rather than finding the last one's bundle
+	for range 2 {
+		if err := h.warmup(context.Background()); err != nil {
+			t.Fatalf("self-test failed: %v", err)
+		}
+	}
+	if code, body := readiness(t, h); code != http.StatusOK || body["status"] != "ok" {
+		t.Errorf("after the self-test: /readyz = %d %v, want 200 ok", code, body)
+	}
+	_ = h.waitForBuilds(context.Background())
+	_ = filepath.WalkDir(h.cfg.CacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			t.Errorf("self-test cached %s", d.Name())
+		}
+		return err
+	})
+}
+
+func TestSelfTestFailure(t *testing.T) {
+	bun := writeScript(t, t.TempDir(), "bun", "echo 'bun: cannot run here' >&2\nexit 1\n")
+	h := newTestHandler(t, Config{SelfTest: true, BunBin: bun})
+
+	if err := h.warmup(context.Background()); err == nil || !strings.Contains(err.Error(), "cannot run here") {
+		t.Fatalf("warmup error = %v, want bun's output", err)
+	}
+	code, body := readiness(t, h)
+	if code != http.StatusServiceUnavailable || body["status"] != "self-test failed" {
+		t.Errorf("/readyz = %d %v, want 503 self-test failed", code, body)
+	}
+	if msg, _ := body["selfTestError"].(string); !strings.Contains(msg, "cannot run here") {
+		t.Errorf("/readyz selfTestError = %q, want bun's output", msg)
+	}
+	// Builds are still refused, with the reason
+	rec := get(t, h, "/https://example.com/mod.ts", "Accept", "application/json")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "self-test") {
+		t.Errorf("build after a failed self-test: %d\n%s", rec.Code, rec.Body)
+	}
+}
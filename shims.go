@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+)
+
+// shimNamePattern matches the names of shim files that can be injected.
+var shimNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+
+// loadShims reads the files in dir that builds can inject, keyed by file
+// name. A missing directory is only an error if required.
+func loadShims(dir string, required bool) (map[string][]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) && !required {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	shims := map[string][]byte{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !shimNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		shims[entry.Name()] = b
+	}
+	return shims, nil
+}
+
+// shimsFingerprint returns a stable string identifying the contents of
+// shims, so that editing one invalidates bundles it was injected into.
+func shimsFingerprint(shims map[string][]byte) string {
+	if len(shims) == 0 {
+		return ""
+	}
+	hasher := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(shims)) {
+		fmt.Fprintf(hasher, "%s\x00%x\x00", name, sha256.Sum256(shims[name]))
+	}
+	return fmt.Sprintf("shims:%x", hasher.Sum(nil))
+}
+
+// writeShims copies the shims named in inject into dir/shims and returns
+// their paths, for api.BuildOptions.Inject.
+func (h *handler) writeShims(dir string, inject []string) ([]string, error) {
+	if len(inject) == 0 {
+		return nil, nil
+	}
+	shimDir := filepath.Join(dir, "shims")
+	if err := os.MkdirAll(shimDir, 0755); err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, name := range inject {
+		content, ok := h.cfg.Shims[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown shim %q, expected one of the files in the shims directory", name)
+		}
+		path := filepath.Join(shimDir, name)
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// defaultSocketMode lets the socket's owner and group connect, so a
+// sidecar's client only needs to share a group with the service.
+const defaultSocketMode = 0660
+
+// listenUnix listens on a Unix domain socket at path, for sidecar
+// deployments whose only client runs on the same host. A socket left at
+// path by a process that died without removing it is replaced, but one
+// that is still answering is not, and neither is any other kind of file.
+// Closing the listener removes the socket.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
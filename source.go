@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// sourceInfo is what builds need to know about a source besides its
+// contents, gathered while it is read so large sources never have to be
+// held in memory whole.
+type sourceInfo struct {
+	size int64
+	sum  [sha256.Size]byte
+	// head is the start of the source, enough to sniff its content type.
+	head []byte
+	// bareImports is hasBareImports of the source.
+	bareImports bool
+	// blank is whether the source is only whitespace.
+	blank bool
+}
+
+// sourceSniffLen is how much of a source http.DetectContentType looks at.
+const sourceSniffLen = 512
+
+// importWindow is how much of the source before each chunk is scanned
+// again along with it, so imports split across chunks are still found.
+// Longer import statements are only found when within a chunk.
+const importWindow = 8 << 10
+
+// sourceScanner gathers the sourceInfo of the data written to it.
+type sourceScanner struct {
+	info   sourceInfo
+	hasher hash.Hash
+	// window is the tail of the previous writes, which imports
+	// continuing into the next one started in.
+	window []byte
+}
+
+func newSourceScanner() *sourceScanner {
+	return &sourceScanner{info: sourceInfo{blank: true}, hasher: sha256.New()}
+}
+
+func (s *sourceScanner) Write(p []byte) (int, error) {
+	s.hasher.Write(p)
+	s.info.size += int64(len(p))
+	if n := min(len(p), sourceSniffLen-len(s.info.head)); n > 0 {
+		s.info.head = append(s.info.head, p[:n]...)
+	}
+	if s.info.blank && len(bytes.TrimSpace(p)) > 0 {
+		s.info.blank = false
+	}
+	if !s.info.bareImports {
+		s.window = append(s.window, p...)
+		s.info.bareImports = hasBareImports(s.window)
+		s.window = s.window[max(0, len(s.window)-importWindow):]
+	}
+	return len(p), nil
+}
+
+func (s *sourceScanner) result() sourceInfo {
+	copy(s.info.sum[:], s.hasher.Sum(nil))
+	return s.info
+}
+
+// scanSource returns the sourceInfo of a source already in memory.
+func scanSource(source []byte) sourceInfo {
+	s := newSourceScanner()
+	s.Write(source)
+	return s.result()
+}
+
+// writeSource puts the job's source at path.
+func (job buildJob) writeSource(path string) error {
+	if job.sourcePath == "" {
+		return os.WriteFile(path, job.source, 0644)
+	}
+	if err := os.Chmod(job.sourcePath, 0644); err != nil {
+		return err
+	}
+	return os.Rename(job.sourcePath, path)
+}
+
+// readSource returns the job's source, for the transforms that need it in
+// memory anyway.
+func (job buildJob) readSource() ([]byte, error) {
+	if job.sourcePath == "" {
+		return job.source, nil
+	}
+	return os.ReadFile(job.sourcePath)
+}
+
+// sourceTooLargeError is returned by spoolSource for sources over
+// Config.MaxSourceBytes.
+type sourceTooLargeError struct{ max int64 }
+
+func (e *sourceTooLargeError) Error() string {
+	return fmt.Sprintf("source is over the limit of %d bytes", e.max)
+}
+
+// spoolSource streams body to a new file in the build temp directory and
+// returns its path along with its sourceInfo. The caller removes the file.
+func (h *handler) spoolSource(body io.Reader) (string, sourceInfo, error) {
+	f, err := os.CreateTemp(h.cfg.BuildTmpDir, ".source-*")
+	if err != nil {
+		return "", sourceInfo{}, err
+	}
+	defer f.Close()
+	max := h.cfg.MaxSourceBytes
+	if max > 0 {
+		body = io.LimitReader(body, max+1)
+	}
+	scanner := newSourceScanner()
+	n, err := io.Copy(io.MultiWriter(f, scanner), body)
+	if err == nil && max > 0 && n > max {
+		err = &sourceTooLargeError{max}
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", sourceInfo{}, err
+	}
+	return f.Name(), scanner.result(), nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// rejectedMediaTypes are upstream content types that can't be source code.
+// Prefixes ending in "/" match a whole family. video/mp2t is deliberately
+// absent since many servers label .ts files as MPEG transport streams.
+var rejectedMediaTypes = []string{
+	"text/html",
+	"application/xhtml+xml",
+	"application/pdf",
+	"application/zip",
+	"application/gzip",
+	"image/",
+	"audio/",
+	"font/",
+}
+
+// checkSourceType returns an error if the upstream Content-Type or the
+// leading bytes of content show it isn't JavaScript or TypeScript.
+func checkSourceType(contentType string, content []byte) error {
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err == nil {
+			for _, rejected := range rejectedMediaTypes {
+				if mediaType == rejected || (strings.HasSuffix(rejected, "/") && strings.HasPrefix(mediaType, rejected)) {
+					return fmt.Errorf("upstream Content-Type is %s", mediaType)
+				}
+			}
+		}
+	}
+
+	// Sniff the body, which catches mislabelled HTML pages and binaries
+	sniffed := http.DetectContentType(content)
+	switch {
+	case strings.HasPrefix(sniffed, "text/html"), strings.HasPrefix(sniffed, "text/xml"):
+		return fmt.Errorf("upstream content looks like %s", sniffed)
+	case strings.HasPrefix(sniffed, "text/"):
+		return nil
+	default:
+		return fmt.Errorf("upstream content looks like binary data (%s)", sniffed)
+	}
+}
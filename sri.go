@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+)
+
+// integritySuffix names the sidecar holding a cache entry's integrity, so
+// it is read rather than hashed again on every response.
+const integritySuffix = ".sri"
+
+// integrity returns the subresource integrity metadata of bundle, for an
+// integrity="..." attribute on the script or modulepreload referencing it:
+// "sha384-" and the SHA-384 of the bundle in standard, padded base64, as
+// the Subresource Integrity spec defines. Browsers check it against the
+// decoded response, so it holds for every Content-Encoding the bundle is
+// served with. It covers the bytes served by URL and from /_b/, not the
+// stylesheet or assets next to them, which have no integrity of their own.
+func integrity(bundle []byte) string {
+	sum := sha512.Sum384(bundle)
+	return "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// cachedIntegrity returns the integrity recorded for the cache entry hash,
+// or "" for entries built before integrities were recorded.
+func (h *handler) cachedIntegrity(hash string) string {
+	b, err := h.readCacheFile(hash + integritySuffix)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// stateFile is where the in-memory state survives restarts, in the cache
+// directory. It doesn't match cacheFilePattern, so it can't be mistaken for
+// a cache file.
+const stateFile = "state.json"
+
+// stateSaveInterval is how often the state is saved while running, so a
+// crash loses little of it.
+const stateSaveInterval = time.Minute
+
+// persistedState is what is kept of the in-memory state across restarts.
+type persistedState struct {
+	// Hits are the request counts of popular URLs, for background
+	// refreshes.
+	Hits  map[string]int64 `json:"hits,omitempty"`
+	Stats statsSnapshot    `json:"stats"`
+	// HotFiles are the cache files held in memory, most recently used
+	// first, which are read back in the same order.
+	HotFiles []string `json:"hotFiles,omitempty"`
+}
+
+type statsSnapshot struct {
+	Since       time.Time `json:"since"`
+	Requests    int64     `json:"requests"`
+	Hits        int64     `json:"hits"`
+	Misses      int64     `json:"misses"`
+	BytesServed int64     `json:"bytesServed"`
+	Builds      int64     `json:"builds"`
+	BuildNanos  int64     `json:"buildNanos"`
+}
+
+// saveState writes the hit counts, stats and hot cache files to the cache
+// directory.
+func (h *handler) saveState() error {
+	h.hits.mu.Lock()
+	hits := maps.Clone(h.hits.hits)
+	h.hits.mu.Unlock()
+	s := &h.stats
+	b, err := json.Marshal(persistedState{
+		Hits: hits,
+		Stats: statsSnapshot{
+			Since:       time.Unix(0, s.since.Load()).UTC(),
+			Requests:    s.requests.Load(),
+			Hits:        s.hits.Load(),
+			Misses:      s.misses.Load(),
+			BytesServed: s.bytesServed.Load(),
+			Builds:      s.builds.Load(),
+			BuildNanos:  s.buildNanos.Load(),
+		},
+		HotFiles: h.hot.names(),
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(h.cfg.CacheDir, stateFile), b, 0644)
+}
+
+// loadState restores the state saved by saveState, if any, and returns how
+// many hot cache files were dropped because they no longer exist.
+func (h *handler) loadState() (pruned int, err error) {
+	b, err := os.ReadFile(filepath.Join(h.cfg.CacheDir, stateFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var state persistedState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return 0, err
+	}
+
+	h.hits.mu.Lock()
+	for uri, n := range state.Hits {
+		if len(h.hits.hits) < maxTrackedURLs {
+			h.hits.hits[uri] += n
+		}
+	}
+	h.hits.mu.Unlock()
+
+	s := &h.stats
+	if !state.Stats.Since.IsZero() {
+		s.since.Store(state.Stats.Since.UnixNano())
+	}
+	s.requests.Add(state.Stats.Requests)
+	s.hits.Add(state.Stats.Hits)
+	s.misses.Add(state.Stats.Misses)
+	s.bytesServed.Add(state.Stats.BytesServed)
+	s.builds.Add(state.Stats.Builds)
+	s.buildNanos.Add(state.Stats.BuildNanos)
+
+	// Add the least recently used first, so the most recent ends up in
+	// front
+	for _, name := range slices.Backward(state.HotFiles) {
+		if !h.hot.enabled() {
+			break
+		}
+		gen := h.hot.generation(name)
+		data, err := h.cache.Get(name)
+		if os.IsNotExist(err) {
+			pruned++
+			continue
+		}
+		if err != nil {
+			return pruned, err
+		}
+		sum, err := h.fileSum(name, data)
+		if err != nil {
+			pruned++
+			continue
+		}
+		h.hot.add(name, data, sum, gen)
+	}
+	return pruned, nil
+}
+
+// saveStateLoop saves the state every stateSaveInterval until ctx is done.
+func (h *handler) saveStateLoop(ctx context.Context) {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := h.saveState(); err != nil {
+			slog.Info("failed to save state", "error", err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// serviceStats are aggregate counters for quick inspection at /stats, as
+// opposed to the Prometheus metrics at /metrics. They can be reset with
+// DELETE /admin/stats.
+type serviceStats struct {
+	// since is when counting started, in Unix nanoseconds.
+	since       atomic.Int64
+	requests    atomic.Int64
+	hits        atomic.Int64
+	misses      atomic.Int64
+	bytesServed atomic.Int64
+	builds      atomic.Int64
+	// buildNanos is the total duration of the counted builds.
+	buildNanos atomic.Int64
+}
+
+func (s *serviceStats) reset() {
+	s.requests.Store(0)
+	s.hits.Store(0)
+	s.misses.Store(0)
+	s.bytesServed.Store(0)
+	s.builds.Store(0)
+	s.buildNanos.Store(0)
+	s.since.Store(time.Now().UnixNano())
+}
+
+// countRequest records a completed request. Stale and revalidated
+// responses are served from the cache, so they count as hits.
+func (s *serviceStats) countRequest(w *responseWriter) {
+	s.requests.Add(1)
+	s.bytesServed.Add(w.size)
+	switch w.Header().Get("X-Cache") {
+	case "HIT", "STALE", "REVALIDATED":
+		s.hits.Add(1)
+	case "MISS":
+		s.misses.Add(1)
+	}
+}
+
+func (s *serviceStats) countBuild(d time.Duration) {
+	s.builds.Add(1)
+	s.buildNanos.Add(int64(d))
+}
+
+// serveStats reports the counters as JSON.
+func (h *handler) serveStats(w http.ResponseWriter, r *http.Request) {
+	s := &h.stats
+	hits, misses := s.hits.Load(), s.misses.Load()
+	builds := s.builds.Load()
+	var hitRatio float64
+	if hits+misses > 0 {
+		hitRatio = float64(hits) / float64(hits+misses)
+	}
+	var avgBuild time.Duration
+	if builds > 0 {
+		avgBuild = time.Duration(s.buildNanos.Load() / builds)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"since":          time.Unix(0, s.since.Load()).UTC(),
+		"requests":       s.requests.Load(),
+		"hits":           hits,
+		"misses":         misses,
+		"hitRatio":       hitRatio,
+		"bytesServed":    s.bytesServed.Load(),
+		"builds":         builds,
+		"averageBuildMs": avgBuild.Milliseconds(),
+	})
+}
+
+// serveAdminStats resets the counters on DELETE.
+func (h *handler) serveAdminStats(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		http.Error(w, "Method not allowed, DELETE resets the stats", http.StatusMethodNotAllowed)
+		return
+	}
+	h.stats.reset()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// projectFiles are the files every build directory starts from, copied
+// from the project root or the template a request picks.
+var projectFiles = []string{"package.json", "bun.lock", "tsconfig.json"}
+
+// templateNamePattern matches the names of templates ?template= can pick.
+var templateNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// projectTemplate is a named set of project files, by file name, that
+// builds can start from instead of the project root's, like a React or a
+// Svelte preset of package.json and tsconfig.json.
+type projectTemplate map[string][]byte
+
+// loadTemplates reads the templates in dir, one per subdirectory, keyed by
+// the subdirectory's name. Each needs a package.json. A template without a
+// tsconfig.json uses the project root's, and one without a bun.lock starts
+// without a lockfile. A missing directory is only an error if required.
+func loadTemplates(dir string, required bool) (map[string]projectTemplate, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) && !required {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	templates := map[string]projectTemplate{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !templateNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		template := projectTemplate{}
+		for _, file := range projectFiles {
+			b, err := os.ReadFile(filepath.Join(dir, entry.Name(), file))
+			if os.IsNotExist(err) && file != "package.json" {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("template %s: %w", entry.Name(), err)
+			}
+			template[file] = b
+		}
+		templates[entry.Name()] = template
+	}
+	return templates, nil
+}
+
+// templatesFingerprint returns a stable string identifying the contents of
+// templates, so that editing one invalidates bundles built from it.
+func templatesFingerprint(templates map[string]projectTemplate) string {
+	if len(templates) == 0 {
+		return ""
+	}
+	hasher := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(templates)) {
+		for _, file := range slices.Sorted(maps.Keys(templates[name])) {
+			fmt.Fprintf(hasher, "%s/%s\x00%x\x00", name, file, sha256.Sum256(templates[name][file]))
+		}
+	}
+	return fmt.Sprintf("templates:%x", hasher.Sum(nil))
+}
+
+// projectFile returns the contents of file for a build from the named
+// template, or from the project root if name is empty. It returns nil
+// without an error for a bun.lock the template doesn't have.
+func (h *handler) projectFile(name, file string) ([]byte, error) {
+	if name == "" {
+		return os.ReadFile(filepath.Join(h.cfg.ProjectRoot, file))
+	}
+	template, ok := h.cfg.Templates[name]
+	if !ok && len(h.cfg.Templates) == 0 {
+		return nil, newBuildError(kindBadRequest, fmt.Sprintf("Unknown template %q, this server has no templates", name), fmt.Errorf("unknown template %q", name))
+	}
+	if !ok {
+		return nil, newBuildError(kindBadRequest, fmt.Sprintf("Unknown template %q, expected one of %s", name, strings.Join(slices.Sorted(maps.Keys(h.cfg.Templates)), ", ")), fmt.Errorf("unknown template %q", name))
+	}
+	if b, ok := template[file]; ok || file == "bun.lock" {
+		return b, nil
+	}
+	return os.ReadFile(filepath.Join(h.cfg.ProjectRoot, file))
+}
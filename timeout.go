@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// timeoutMiddleware gives each request a deadline of timeout, if positive.
+// Fetches, the bun subprocesses of builds and esbuild are canceled when it
+// passes, and the request fails with a 504. Unlike http.TimeoutHandler,
+// responses aren't buffered.
+func timeoutMiddleware(next http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// buildWithContext runs api.Build with opts, canceling it when ctx ends.
+// esbuild only stops between the steps of a build, so a canceled build
+// returns soon after rather than at once, with an error saying so.
+func buildWithContext(ctx context.Context, opts api.BuildOptions) api.BuildResult {
+	build, err := api.Context(opts)
+	if err != nil {
+		return api.BuildResult{Errors: err.Errors}
+	}
+	defer build.Dispose()
+	stop := context.AfterFunc(ctx, build.Cancel)
+	defer stop()
+	return build.Rebuild()
+}
+
+// deadlineExceeded answers r with a 504 if its deadline passed, which
+// would otherwise surface as whichever step it interrupted failing. It
+// returns false if the deadline hasn't passed.
+func deadlineExceeded(w http.ResponseWriter, r *http.Request) bool {
+	err := r.Context().Err()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	sendError(w, r, newBuildError(kindTimeout, "Request took longer than this server allows", err))
+	return true
+}
+
+// abandoned reports whether r's client went away before it was answered.
+// Each build runs on the context of the request that started it, so its
+// fetches, bun subprocesses and esbuild are all canceled then, instead of
+// running on for nobody. Background work like revalidations runs on
+// requests of its own that aren't canceled.
+func abandoned(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.Canceled)
+}
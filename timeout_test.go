@@ -0,0 +1,102 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startRequest serves a GET of path from h in the background. It returns
+// the recorder, to read once done is closed, and cancel, which goes away
+// as a client would.
+func startRequest(t *testing.T, h http.Handler, path string) (rec *httptest.ResponseRecorder, cancel context.CancelFunc, done <-chan struct{}) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req := httptest.NewRequest(http.MethodGet, path, nil).WithContext(ctx)
+	rec = httptest.NewRecorder()
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		h.ServeHTTP(rec, req)
+	}()
+	return rec, cancel, finished
+}
+
+// wait fails t if ch isn't closed within a few seconds.
+func wait(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestCanceledFetch(t *testing.T) {
+	started, aborted := make(chan struct{}), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	t.Cleanup(upstream.Close)
+	h := newTestHandler(t, Config{NegativeCacheTTL: time.Minute})
+
+	rec, cancel, done := startRequest(t, h, "/"+upstream.URL+"/slow.ts")
+	wait(t, started, "the fetch")
+	cancel()
+	wait(t, aborted, "the fetch to be aborted")
+	wait(t, done, "the handler to return")
+
+	if rec.Body.Len() != 0 {
+		t.Errorf("answered a client that went away: %s", rec.Body)
+	}
+	params, _ := parseBuildParams(url.Values{})
+	if _, ok := h.negCache.get(cacheKey(upstream.URL+"/slow.ts", params, h.keySalt)); ok {
+		t.Errorf("abandoned fetch was negatively cached")
+	}
+}
+
+func TestCanceledInstall(t *testing.T) {
+	upstream := newTestUpstream(t, map[string]string{"/app.ts": "import pad from \"left-pad\";\nexport default pad;\n"})
+	bin := t.TempDir()
+	pidFile := filepath.Join(bin, "bun.pid")
+	h := newTestHandler(t, Config{
+		BunxBin: writeScript(t, bin, "bunx", "echo '{\"missing\":{\"left-pad\":[\"src/index.ts\"]}}'\nexit 255\n"),
+		BunBin:  writeScript(t, bin, "bun", "echo $$ > '"+pidFile+"'\nexec sleep 30\n"),
+	})
+
+	_, cancel, done := startRequest(t, h, "/"+upstream.URL+"/app.ts")
+	var pid int
+	for deadline := time.Now().Add(5 * time.Second); pid == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for bun install to start")
+		}
+		b, _ := os.ReadFile(pidFile)
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	wait(t, done, "the handler to return")
+
+	if err := syscall.Kill(pid, 0); !errors.Is(err, syscall.ESRCH) {
+		_ = syscall.Kill(pid, syscall.SIGKILL)
+		t.Errorf("bun install (pid %d) still running after the client went away: %v", pid, err)
+	}
+	entries, _ := os.ReadDir(h.cfg.BuildTmpDir)
+	for _, entry := range entries {
+		t.Errorf("%s left behind in the build directory", entry.Name())
+	}
+}
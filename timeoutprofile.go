@@ -0,0 +1,58 @@
+package main
+
+import "time"
+
+// timeouts are the server, request and fetch timeouts TIMEOUT_PROFILE
+// sets together. Each can still be overridden by its own variable.
+type timeouts struct {
+	readHeader, read, write, idle time.Duration
+	// request is REQUEST_TIMEOUT, which bounds builds along with the rest
+	// of the request, and fetch is FETCH_TIMEOUT.
+	request, fetch time.Duration
+}
+
+// defaultTimeouts apply without a TIMEOUT_PROFILE. Requests and fetches
+// aren't bounded at all.
+var defaultTimeouts = timeouts{
+	readHeader: 10 * time.Second,
+	read:       30 * time.Second,
+	write:      30 * time.Second,
+	idle:       120 * time.Second,
+}
+
+// timeoutProfiles are the values of TIMEOUT_PROFILE:
+//
+//	          read header  read  write  idle  request  fetch
+//	strict    5s           10s   30s    30s   1m       15s
+//	balanced  10s          30s   30s    2m    5m       1m
+//	lenient   30s          2m    2m     5m    15m      5m
+//
+// strict suits public deployments, where slow clients and upstreams are
+// more likely to be attacks than cold builds. The write timeout is lifted
+// for requests that build under every profile.
+var timeoutProfiles = map[string]timeouts{
+	"strict": {
+		readHeader: 5 * time.Second,
+		read:       10 * time.Second,
+		write:      30 * time.Second,
+		idle:       30 * time.Second,
+		request:    time.Minute,
+		fetch:      15 * time.Second,
+	},
+	"balanced": {
+		readHeader: 10 * time.Second,
+		read:       30 * time.Second,
+		write:      30 * time.Second,
+		idle:       2 * time.Minute,
+		request:    5 * time.Minute,
+		fetch:      time.Minute,
+	},
+	"lenient": {
+		readHeader: 30 * time.Second,
+		read:       2 * time.Minute,
+		write:      2 * time.Minute,
+		idle:       5 * time.Minute,
+		request:    15 * time.Minute,
+		fetch:      5 * time.Minute,
+	},
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// serverTiming collects phase durations for the Server-Timing header.
+type serverTiming struct {
+	entries []string
+}
+
+func (t *serverTiming) add(name string, d time.Duration) {
+	t.entries = append(t.entries, fmt.Sprintf("%s;dur=%.1f", name, float64(d.Microseconds())/1000))
+}
+
+func (t *serverTiming) String() string {
+	return strings.Join(t.entries, ", ")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// tscDiagnosticPattern matches the errors tsc prints with --pretty false,
+// e.g. "src/index.ts(3,7): error TS2322: Type 'string' is not ...".
+var tscDiagnosticPattern = regexp.MustCompile(`^(.+)\((\d+),(\d+)\): error (TS\d+): (.*)$`)
+
+// typecheck runs tsc against the source in the build directory dir and
+// returns its type errors as esbuild messages, so they are reported like
+// build errors. Dependencies have to be installed already.
+func (h *handler) typecheck(ctx context.Context, dir string, params buildParams) ([]api.Message, error) {
+	if h.cfg.NoInstall {
+		return nil, &buildError{kind: kindBuild, status: http.StatusNotImplemented, msg: "This server can't type check because bun isn't installed", err: errors.New("typecheck without bun")}
+	}
+	// A tsconfig passed with the request replaces the project's for tsc
+	// too. It still only covers the source.
+	if params.tsconfig != "" {
+		var config map[string]any
+		if err := json.Unmarshal([]byte(params.tsconfig), &config); err != nil {
+			return nil, err
+		}
+		config["include"] = []string{"src"}
+		b, err := json.Marshal(config)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, "tsconfig.json"), b, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, h.cfg.BunxBin, "--package", "typescript", "tsc", "--noEmit", "--pretty", "false", "-p", "tsconfig.json")
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stdout
+	err := h.run(cmd, &stdout)
+	var limitErr *limitError
+	if errors.As(err, &limitErr) {
+		return nil, newBuildError(kindBuild, "tsc "+limitErr.Error(), err)
+	}
+	// tsc exits 2 when it reports errors, anything else is a failure to
+	// run it
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() != 2 || err != nil && !ok {
+		return nil, newBuildError(kindBuild, "Failed to run tsc: "+h.redactSecrets(stdout.String()), err)
+	}
+
+	var msgs []api.Message
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		m := tscDiagnosticPattern.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			// Continuation lines elaborate on the previous error
+			if len(msgs) > 0 && strings.HasPrefix(scanner.Text(), " ") {
+				msgs[len(msgs)-1].Text += "\n" + strings.TrimSpace(scanner.Text())
+			}
+			continue
+		}
+		// tsc can't resolve URL imports, which esbuild fetches itself
+		if m[4] == "TS2307" && (strings.Contains(m[5], "'http://") || strings.Contains(m[5], "'https://")) {
+			continue
+		}
+		line, _ := strconv.Atoi(m[2])
+		column, _ := strconv.Atoi(m[3])
+		msgs = append(msgs, api.Message{
+			Text: m[5] + " [" + m[4] + "]",
+			Location: &api.Location{
+				File:     m[1],
+				Line:     line,
+				Column:   column - 1,
+				LineText: sourceLine(filepath.Join(dir, m[1]), line),
+			},
+		})
+	}
+	return msgs, nil
+}
+
+// sourceLine returns line n of the file at path, or "" if it can't be
+// read.
+func sourceLine(path string, n int) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(string(b), "\n")
+	if n < 1 || n > len(lines) {
+		return ""
+	}
+	return strings.TrimSuffix(lines[n-1], "\r")
+}
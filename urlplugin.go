@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// urlNamespace is the esbuild namespace for modules loaded over HTTP.
+const urlNamespace = "http-url"
+
+// maxModuleRedirects bounds the redirects followed when loading a URL import.
+const maxModuleRedirects = 10
+
+// urlImportPlugin resolves http:// and https:// imports, and relative imports
+// made from them, by fetching them directly instead of installing them.
+// Bare imports made from fetched modules are resolved from the directory of
+// entryPath. Relative imports made from the entry source at entryPath
+// resolve against entryURL, the URL it was fetched from, if it has one.
+// Fetched modules are loaded with the loader the build's loader map gives
+// their extension, if any, like files on disk are. Fetches are canceled
+// with ctx.
+func (h *handler) urlImportPlugin(ctx context.Context, entryPath, entryURL string, loader map[string]api.Loader) api.Plugin {
+	resolveDir := path.Dir(entryPath)
+	base, _ := url.Parse(entryURL)
+	return api.Plugin{
+		Name: "url-imports",
+		Setup: func(build api.PluginBuild) {
+			build.OnResolve(api.OnResolveOptions{Filter: `^https?://`},
+				func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+					return api.OnResolveResult{Path: args.Path, Namespace: urlNamespace}, nil
+				})
+			build.OnResolve(api.OnResolveOptions{Filter: `^\.{0,2}/`, Namespace: "file"},
+				func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+					if base == nil || (base.Scheme != "http" && base.Scheme != "https") || args.Importer != entryPath {
+						return api.OnResolveResult{}, nil
+					}
+					ref, err := url.Parse(args.Path)
+					if err != nil {
+						return api.OnResolveResult{}, err
+					}
+					return api.OnResolveResult{Path: base.ResolveReference(ref).String(), Namespace: urlNamespace}, nil
+				})
+			build.OnResolve(api.OnResolveOptions{Filter: `^\.{0,2}/`, Namespace: urlNamespace},
+				func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+					base, err := url.Parse(args.Importer)
+					if err != nil {
+						return api.OnResolveResult{}, err
+					}
+					ref, err := url.Parse(args.Path)
+					if err != nil {
+						return api.OnResolveResult{}, err
+					}
+					return api.OnResolveResult{Path: base.ResolveReference(ref).String(), Namespace: urlNamespace}, nil
+				})
+			build.OnLoad(api.OnLoadOptions{Filter: `.*`, Namespace: urlNamespace},
+				func(args api.OnLoadArgs) (api.OnLoadResult, error) {
+					contents, finalURL, contentType, err := h.fetchModule(ctx, args.Path)
+					if err != nil {
+						return api.OnLoadResult{}, err
+					}
+					result := api.OnLoadResult{
+						Contents:   &contents,
+						Loader:     moduleLoader(finalURL, contentType),
+						ResolveDir: resolveDir,
+					}
+					if u, err := url.Parse(finalURL); err == nil {
+						if l, ok := loader[path.Ext(u.Path)]; ok {
+							result.Loader = l
+						}
+					}
+					return result, nil
+				})
+		},
+	}
+}
+
+// fetchModule downloads a URL import, following redirects. It returns the
+// body along with the final URL and its Content-Type.
+func (h *handler) fetchModule(ctx context.Context, moduleURL string) (string, string, string, error) {
+	for range maxModuleRedirects {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, moduleURL, nil)
+		if err != nil {
+			return "", "", "", err
+		}
+		if h.cfg.UserAgent != "" {
+			req.Header.Set("User-Agent", h.cfg.UserAgent)
+		}
+		resp, err := h.do(req)
+		if err != nil {
+			return "", "", "", err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", "", "", err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return string(body), moduleURL, resp.Header.Get("Content-Type"), nil
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+			http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			u, err := resp.Location()
+			if err != nil {
+				return "", "", "", err
+			}
+			moduleURL = u.String()
+		default:
+			return "", "", "", fmt.Errorf("fetching %s: upstream returned %d: %s", moduleURL, resp.StatusCode, truncate(string(body), 500))
+		}
+	}
+	return "", "", "", fmt.Errorf("fetching %s: too many redirects", moduleURL)
+}
+
+var extensionLoaders = map[string]api.Loader{
+	".ts":   api.LoaderTS,
+	".mts":  api.LoaderTS,
+	".cts":  api.LoaderTS,
+	".tsx":  api.LoaderTSX,
+	".jsx":  api.LoaderJSX,
+	".js":   api.LoaderJS,
+	".mjs":  api.LoaderJS,
+	".cjs":  api.LoaderJS,
+	".css":  api.LoaderCSS,
+	".json": api.LoaderJSON,
+}
+
+// entryExtension returns the extension the entry source fetched from
+// sourceURL is written with, which is how esbuild picks its loader and
+// whether it is an ES or CommonJS module. The loader given by a bare
+// ?loader= wins, then JavaScript and TypeScript extensions are kept from
+// the URL's path. Anything else is built as TypeScript.
+func entryExtension(sourceURL string, params buildParams) string {
+	if params.entryLoader != "" {
+		return "." + params.entryLoader
+	}
+	if u, err := url.Parse(sourceURL); err == nil {
+		switch ext := path.Ext(u.Path); ext {
+		case ".ts", ".mts", ".cts", ".tsx", ".js", ".mjs", ".cjs", ".jsx":
+			return ext
+		}
+	}
+	return ".ts"
+}
+
+var typeScriptMediaType = regexp.MustCompile(`typescript|mp2t`)
+
+// moduleLoader picks a loader for a fetched module from its URL's
+// extension, falling back to its Content-Type.
+func moduleLoader(moduleURL, contentType string) api.Loader {
+	if u, err := url.Parse(moduleURL); err == nil {
+		if loader, ok := extensionLoaders[path.Ext(u.Path)]; ok {
+			return loader
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case typeScriptMediaType.MatchString(mediaType):
+		return api.LoaderTS
+	case mediaType == "text/css":
+		return api.LoaderCSS
+	case mediaType == "application/json":
+		return api.LoaderJSON
+	}
+	return api.LoaderJS
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestEntryExtension(t *testing.T) {
+	// As TypeScript, a < b > (c) would be a call with a type argument,
+	// minified to e(n) instead of e<t>n
+	comparison := "export const between = (a, b, c) => a < b > (c);\n"
+	jsx := "export const App = () => <div className=\"app\">hi</div>;\n"
+	upstream := newTestUpstream(t, map[string]string{
+		"/mod.mjs":   comparison,
+		"/mod.cjs":   "module.exports = { answer: 42 };\n",
+		"/app.jsx":   jsx,
+		"/app.js":    jsx,
+		"/no-ext":    comparison,
+		"/legacy.ts": "export const cast = (x: unknown) => <string>x;\n",
+	})
+	h := newTestHandler(t, Config{})
+
+	for _, tt := range []struct {
+		path string
+		want []string
+	}{
+		{"/mod.mjs", []string{"e<t>n"}},
+		{"/mod.cjs", []string{"exports:{}", "answer:42", "export default"}},
+		{"/app.jsx", []string{"createElement", `className:"app"`}},
+		{"/app.js?loader=jsx", []string{"createElement"}},
+		{"/no-ext?loader=js", []string{"e<t>n"}},
+		{"/legacy.ts", []string{"as cast"}},
+	} {
+		rec := get(t, h, "/"+upstream.URL+tt.path, "Accept", "application/json")
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: status = %d\n%s", tt.path, rec.Code, rec.Body)
+			continue
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("%s: bundle doesn't contain %q:\n%s", tt.path, want, rec.Body)
+			}
+		}
+	}
+
+	// JSX in a .js file is an error without the override
+	if rec := get(t, h, "/"+upstream.URL+"/app.js", "Accept", "application/json"); rec.Code == http.StatusOK {
+		t.Errorf("/app.js built without ?loader=jsx:\n%s", rec.Body)
+	}
+
+	// The entry's loader is part of the cache key
+	keys := map[string]string{}
+	for _, query := range []string{"", "loader=jsx", "loader=tsx"} {
+		q, _ := url.ParseQuery(query)
+		params, err := parseBuildParams(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := cacheKey(upstream.URL+"/app.js", params, h.keySalt)
+		if other, ok := keys[key]; ok {
+			t.Errorf("%q and %q share the cache key %s", query, other, key)
+		}
+		keys[key] = query
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// verifyBundle parses bundle again as JavaScript, with Config.VerifyBundles,
+// so output esbuild unexpectedly broke fails the build instead of being
+// cached for a year. Parsing costs time on the order of a minified build of
+// the same size, without the fetches and installs.
+func verifyBundle(bundle []byte) *buildError {
+	result := api.Transform(string(bundle), api.TransformOptions{
+		Loader:     api.LoaderJS,
+		Sourcefile: "bundle.js",
+	})
+	if len(result.Errors) == 0 {
+		return nil
+	}
+	formatted := strings.Join(api.FormatMessages(result.Errors, api.FormatMessagesOptions{
+		Kind: api.ErrorMessage,
+	}), "")
+	be := newBuildError(kindBuild, "Build output doesn't parse as JavaScript, refusing to cache it:\n"+formatted, fmt.Errorf("output failed to parse with %d errors", len(result.Errors)))
+	be.messages = result.Errors
+	return be
+}
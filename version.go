@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// version and commit identify the build. They are set at link time with
+// -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+// esbuildVersion returns the version of the esbuild module compiled in.
+func esbuildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == "github.com/evanw/esbuild" {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+// toolchainFingerprint identifies the esbuild version and built-in build
+// options, so that bundles built by another toolchain aren't served.
+func toolchainFingerprint() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%+v", defaultBuildOptions())))
+	return fmt.Sprintf("esbuild:%s:%x", esbuildVersion(), sum[:8])
+}
+
+// enumName returns the key v is stored under in values.
+func enumName[T comparable](values map[string]T, v T) string {
+	for name, value := range values {
+		if value == v {
+			return name
+		}
+	}
+	return ""
+}
+
+// serveVersion reports which build of the service is running and the
+// default build options it was configured with.
+func (h *handler) serveVersion(w http.ResponseWriter, r *http.Request) {
+	opts := h.cfg.BuildOptions
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"version": version,
+		"commit":  commit,
+		"esbuild": esbuildVersion(),
+		"go":      runtime.Version(),
+		"options": map[string]any{
+			"target":            enumName(esTargets, opts.Target),
+			"format":            enumName(formats, opts.Format),
+			"platform":          enumName(platforms, opts.Platform),
+			"sourcemap":         enumName(sourceMapModes, opts.Sourcemap),
+			"minifyWhitespace":  opts.MinifyWhitespace,
+			"minifyIdentifiers": opts.MinifyIdentifiers,
+			"minifySyntax":      opts.MinifySyntax,
+			"external":          opts.External,
+		},
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// warmupRetryAfter is the Retry-After sent to requests arriving before
+// warmup completes, in seconds.
+const warmupRetryAfter = "5"
+
+// warmup runs the startup self-test and builds the warmup URLs, then marks
+// the handler ready. Requests are refused until then, so a load balancer
+// doesn't send traffic to an instance whose first builds would be cold.
+// Only a failed self-test is an error, which leaves the handler not ready
+// for good; warmup URLs that fail to build are logged and skipped.
+func (h *handler) warmup(ctx context.Context) error {
+	log := logger(ctx)
+	if h.cfg.SelfTest && h.readOnly.Load() {
+		log.Info("skipping self-test in read-only mode")
+	} else if h.cfg.SelfTest {
+		if err := h.selfTest(ctx); err != nil {
+			h.selfTestErr.Store(&err)
+			return err
+		}
+	}
+	for _, u := range h.cfg.WarmupURLs {
+		start := time.Now()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/"+strings.TrimPrefix(u, "/"), nil)
+		if err != nil {
+			log.Info("invalid warmup URL", "url", u, "error", err)
+			continue
+		}
+		w := &discardResponseWriter{header: http.Header{}}
+		h.bundle(w, req)
+		log.Info("warmed up", "url", u, "status", w.status, "cache", w.header.Get("X-Cache"), "duration", time.Since(start))
+	}
+	h.ready.Store(true)
+	return nil
+}
+
+// serveWarming refuses r while warmup is running, or after the self-test
+// failed, returning false once warmup is done.
+func (h *handler) serveWarming(w http.ResponseWriter, r *http.Request) bool {
+	if h.ready.Load() {
+		return false
+	}
+	if err := h.selfTestErr.Load(); err != nil {
+		sendError(w, r, newBuildError(kindUnavailable, "Service failed its startup self-test", *err))
+		return true
+	}
+	w.Header().Set("Retry-After", warmupRetryAfter)
+	sendError(w, r, newBuildError(kindUnavailable, "Service is warming up, please retry", errors.New("warmup in progress")))
+	return true
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// serveWatch answers a bundle request with ?watch=true once there is a
+// bundle other than the one the client has, for development against an
+// upstream that changes. The client sends the ETag it has in
+// If-None-Match, and the upstream is revalidated every WatchInterval, as
+// ?revalidate=true would, until the bundle's ETag differs. That bundle is
+// the answer, or a 304 once WatchTimeout or the request's deadline
+// passes, after which the client asks again. Without an ETag the bundle
+// is answered straight away.
+func (h *handler) serveWatch(w http.ResponseWriter, r *http.Request) {
+	// Watching outlasts the server's write timeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	req := r.Clone(r.Context())
+	req.URL.RawQuery = stripQueryParams(r.URL.RawQuery, "watch", "revalidate")
+	if req.URL.RawQuery != "" {
+		req.URL.RawQuery += "&"
+	}
+	req.URL.RawQuery += "revalidate=true"
+
+	timeout := time.NewTimer(h.cfg.WatchTimeout)
+	defer timeout.Stop()
+	tick := time.NewTicker(h.cfg.WatchInterval)
+	defer tick.Stop()
+	for {
+		rec := httptest.NewRecorder()
+		h.bundle(rec, req)
+		if rec.Code != http.StatusNotModified {
+			for k, v := range rec.Header() {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(rec.Code)
+			_, _ = w.Write(rec.Body.Bytes())
+			return
+		}
+		select {
+		case <-tick.C:
+			continue
+		case <-timeout.C:
+		case <-r.Context().Done():
+		}
+		logger(r.Context()).Info("watched bundle unchanged", "path", r.URL.Path, "timeout", h.cfg.WatchTimeout)
+		w.Header().Set("ETag", rec.Header().Get("ETag"))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+}
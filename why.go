@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// metafile is the part of esbuild's metafile needed to walk the import
+// graph.
+type metafile struct {
+	Inputs map[string]struct {
+		Imports []struct {
+			Path     string `json:"path"`
+			External bool   `json:"external"`
+		} `json:"imports"`
+	} `json:"inputs"`
+	Outputs map[string]struct {
+		EntryPoint string `json:"entryPoint"`
+	} `json:"outputs"`
+}
+
+// serveWhy explains why a module is part of a cached bundle, answering
+// /why/<url>?module=<pkg> with the import chains from the entry point to
+// it, like npm why. The bundle has to have been built already.
+func (h *handler) serveWhy(w http.ResponseWriter, r *http.Request) {
+	module := r.URL.Query().Get("module")
+	if module == "" {
+		http.Error(w, "Missing module, expected /why/<url>?module=<pkg>", http.StatusBadRequest)
+		return
+	}
+	rawPath, rawQuery := strings.TrimPrefix(r.URL.Path, "/why"), stripQueryParams(r.URL.RawQuery, "module")
+	fullURL, err := h.upstreamURL(rawPath, rawQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hash, err := h.entryHash(rawPath, rawQuery, r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b, err := h.readCacheFile(hash + ".meta.json")
+	if os.IsNotExist(err) {
+		http.Error(w, "No cached build for "+fullURL+", request it first", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read metafile: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var meta metafile
+	if err := json.Unmarshal(b, &meta); err != nil {
+		http.Error(w, "Failed to parse metafile: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"url":    fullURL,
+		"module": module,
+		"chains": importChains(meta, module),
+	})
+}
+
+// importChains returns the shortest import chain from an entry point to
+// each input belonging to module. Chains stop at the first input of the
+// module rather than continuing through its own files.
+func importChains(meta metafile, module string) [][]string {
+	parent := map[string]string{}
+	var queue []string
+	for _, out := range meta.Outputs {
+		if e := out.EntryPoint; e != "" && !slices.Contains(queue, e) {
+			queue = append(queue, e)
+			parent[e] = ""
+		}
+	}
+	slices.Sort(queue)
+
+	chains := [][]string{}
+	for len(queue) > 0 {
+		input := queue[0]
+		queue = queue[1:]
+		if belongsTo(input, module) {
+			var chain []string
+			for p := input; p != ""; p = parent[p] {
+				chain = append(chain, p)
+			}
+			slices.Reverse(chain)
+			chains = append(chains, chain)
+			continue
+		}
+		for _, imp := range meta.Inputs[input].Imports {
+			if _, seen := parent[imp.Path]; seen || imp.External {
+				continue
+			}
+			parent[imp.Path] = input
+			queue = append(queue, imp.Path)
+		}
+	}
+	return chains
+}
+
+// belongsTo reports whether a metafile input path is part of module, which
+// is either a package name or a URL.
+func belongsTo(input, module string) bool {
+	if u, ok := strings.CutPrefix(input, urlNamespace+":"); ok {
+		return u == module || strings.HasPrefix(u, strings.TrimSuffix(module, "/")+"/")
+	}
+	return input == module || strings.Contains(input, "node_modules/"+module+"/")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+)
+
+// wrapContentTypes are the forms a bundle can be wrapped in with ?wrap=,
+// and the content types they are served as.
+//
+// wrap=dataurl answers with a data:text/javascript;base64,... URL, for
+// import() or a script src without another request. Base64 makes it a
+// third larger than the bundle. wrap=json answers with the bundle as a
+// JSON string, for embedding in other documents or evaluating later, which
+// is about the size of the bundle plus its escaped quotes, backslashes and
+// newlines. Neither is compressed, so large bundles are better fetched as
+// they are.
+var wrapContentTypes = map[string]string{
+	"dataurl": "text/plain; charset=utf-8",
+	"json":    "application/json",
+}
+
+// wrapBundle returns bundle in the form named by wrap.
+func wrapBundle(wrap string, bundle []byte) ([]byte, error) {
+	if wrap == "json" {
+		return json.Marshal(string(bundle))
+	}
+	const prefix = "data:text/javascript;base64,"
+	b := make([]byte, len(prefix)+base64.StdEncoding.EncodedLen(len(bundle)))
+	copy(b, prefix)
+	base64.StdEncoding.Encode(b[len(prefix):], bundle)
+	return b, nil
+}
+
+// serveWrapped answers r with the cached bundle wrapped as ?wrap= asks.
+// Wrapped forms are made from the cache entry on each request rather than
+// stored, as they are cheap to make and rarely asked for. It returns false
+// without writing a response if the bundle isn't cached.
+func (h *handler) serveWrapped(w http.ResponseWriter, r *http.Request, hash string) bool {
+	wrap := r.URL.Query().Get("wrap")
+	if err := checkCacheName(hash); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+	bundle, err := h.readCacheFile(hash)
+	if os.IsNotExist(err) {
+		return false
+	}
+	if err != nil {
+		sendError(w, r, newBuildError(kindInternal, "Failed to read from cache: "+err.Error(), err))
+		return true
+	}
+	wrapped, err := wrapBundle(wrap, bundle)
+	if err != nil {
+		sendError(w, r, newBuildError(kindInternal, "Failed to wrap bundle: "+err.Error(), err))
+		return true
+	}
+	h.serveBytes(w, r, wrapped, h.bundleSum(wrapped), "", wrapContentTypes[wrap], h.bundleCacheControl())
+	return true
+}